@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"torrent-pi/internal/magnet"
+	"torrent-pi/internal/session"
+	torrent "torrent-pi/internal/torrent"
+)
+
+// Largest config accepted by /config
+const MAX_CONFIG_SIZE = 1024 * 1024
+
+func registerHandlers(s *session.Session) {
+	http.HandleFunc("/download", download(s))
+	http.HandleFunc("POST /add", add(s))
+	http.HandleFunc("GET /info/{id}", info(s))
+	http.HandleFunc("GET /scrape", scrape)
+	http.HandleFunc("GET /torrent/{file}", torrentFile(s))
+	http.HandleFunc("POST /create", create)
+	http.HandleFunc("POST /move/{id}", move(s))
+	http.HandleFunc("POST /limits/{id}", limits(s))
+	http.HandleFunc("GET /config", getConfig(s))
+	http.HandleFunc("PATCH /config", patchConfig(s))
+	http.HandleFunc("GET /turtle", speed(s))
+	http.HandleFunc("POST /turtle", turtle(s))
+}
+
+func download(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Println("Initiating download")
+
+		m, err := magnet.FromQuery(r.URL.Query())
+		if err != nil {
+			writeAddError(w, err)
+			return
+		}
+		if _, err := s.AddMagnet(m); err != nil {
+			writeAddError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Torrent file downloading...")
+	}
+}
+
+// add starts downloading a torrent given as one of:
+//   - a multipart upload of a .torrent file, in the "torrent" field
+//   - the url of a .torrent file, in the "url" field
+//   - a magnet link, in the "magnet" field
+func add(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t *torrent.Torrent
+		var err error
+
+		if file, _, fileErr := r.FormFile("torrent"); fileErr == nil {
+			defer file.Close()
+			var data []byte
+			if data, err = session.ReadMetainfo(file); err == nil {
+				t, err = s.AddMetainfo(data)
+			}
+		} else if torrentURL := r.FormValue("url"); torrentURL != "" {
+			t, err = s.AddURL(torrentURL)
+		} else if magnetURI := r.FormValue("magnet"); magnetURI != "" {
+			var m *magnet.Magnet
+			if m, err = magnet.Parse(magnetURI); err == nil {
+				t, err = s.AddMagnet(m)
+			}
+		} else {
+			err = fmt.Errorf("expected a torrent file, url or magnet link")
+		}
+
+		if err != nil {
+			writeAddError(w, err)
+			return
+		}
+		writeJSON(w, t.Info())
+	}
+}
+
+func writeAddError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, session.ErrTorrentExists):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, torrent.ErrMetadataTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+	default:
+		// Bad magnet links (*magnet.Error), .torrent files and urls
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprint(w, err)
+}
+
+// info returns a torrent's summary. Pass ?scrape=1 to refresh the trackers' swarm health first.
+func info(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := s.Get(strings.ToLower(r.PathValue("id")))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "torrent not found")
+			return
+		}
+		if r.URL.Query().Get("scrape") != "" {
+			t.PeerManager.Scrape()
+		}
+		writeJSON(w, t.Info())
+	}
+}
+
+// move relocates a torrent's data to the directory in the "path" field, which may be on another disk
+// Example: curl -d path=/mnt/usb/media localhost:8080/move/e7d80892bbce0bdd761d38781da480d9e64b1848
+func move(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := s.Move(strings.ToLower(r.PathValue("id")), r.FormValue("path"))
+		switch {
+		case errors.Is(err, session.ErrTorrentNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, err)
+		case t == nil:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+		default:
+			writeJSON(w, t.Info())
+		}
+	}
+}
+
+// limits changes a torrent's rate limits, in bytes a second with 0 for unlimited. Only the fields given change:
+// "download" and "upload" for the torrent, "peer_download" and "peer_upload" for each of its peers.
+// The whole session's limits are download_limit and upload_limit in /config.
+// Example: curl -d download=204800 -d peer_upload=10240 localhost:8080/limits/e7d80892bbce0bdd761d38781da480d9e64b1848
+func limits(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.ToLower(r.PathValue("id"))
+		t, ok := s.Get(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "torrent not found")
+			return
+		}
+		limits := t.Limits()
+		for field, limit := range map[string]*int64{
+			"download":      &limits.Download,
+			"upload":        &limits.Upload,
+			"peer_download": &limits.PeerDownload,
+			"peer_upload":   &limits.PeerUpload,
+		} {
+			if value := r.FormValue(field); value != "" {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "%s: %s", field, err)
+					return
+				}
+				*limit = n
+			}
+		}
+		t, err := s.SetLimits(id, limits)
+		if errors.Is(err, session.ErrTorrentNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, err)
+			return
+		} else if t == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		} else if err != nil {
+			fmt.Println("Error writing resume data:", err)
+		}
+		writeJSON(w, t.Info())
+	}
+}
+
+// speed reports the session's rate limits, and the speed profile or turtle mode they come from
+func speed(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Speed())
+	}
+}
+
+// turtle turns turtle mode on or off with the "on" field, or toggles it if there isn't one.
+// Example: curl -d on=true localhost:8080/turtle
+func turtle(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		on := !s.Speed().Turtle
+		if value := r.FormValue("on"); value != "" {
+			var err error
+			if on, err = strconv.ParseBool(value); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+		}
+		writeJSON(w, s.SetTurtle(on))
+	}
+}
+
+func getConfig(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Config())
+	}
+}
+
+// patchConfig changes the settings given in a json object, returning them all. They apply to torrents added afterwards.
+// Example: curl -X PATCH -d '{"max_connections": 20, "dial_timeout": "5s"}' localhost:8080/config
+func patchConfig(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, MAX_CONFIG_SIZE))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		cfg := s.Config()
+		if err := cfg.Patch(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		if err := s.SetConfig(cfg); errors.Is(err, session.ErrRestartRequired) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		writeJSON(w, cfg)
+	}
+}
+
+// torrentFile exports a torrent as a .torrent file. Example: /torrent/e7d80892bbce0bdd761d38781da480d9e64b1848.torrent
+func torrentFile(s *session.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.ToLower(r.PathValue("file")), ".torrent")
+		t, ok := s.Get(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "torrent not found")
+			return
+		}
+		data, err := t.Metainfo()
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", t.Name+".torrent"))
+		w.Write(data)
+	}
+}
+
+// CreateResponse is returned by /create. The .torrent file is base64 encoded.
+type CreateResponse struct {
+	torrent.TorrentInfo
+	Magnet  string `json:"magnet"`
+	Torrent []byte `json:"torrent"`
+}
+
+// create builds a .torrent file from content on the server, given as json torrent.CreateOptions
+// Example: curl -d '{"path": "/media/build", "trackers": [["http://tracker.lan/announce"]]}' localhost:8080/create
+func create(w http.ResponseWriter, r *http.Request) {
+	var opts torrent.CreateOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	t, err := torrent.Create(opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	data, err := t.Metainfo()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	writeJSON(w, CreateResponse{TorrentInfo: t.Info(), Magnet: t.Magnet(), Torrent: data})
+}
+
+// scrape reports the seeders, leechers and completed counts of a magnet link's trackers, without adding it
+// Example: /scrape?xt=urn:btih:E7D80892BBCE0BDD761D38781DA480D9E64B1848&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337%2Fannounce
+func scrape(w http.ResponseWriter, r *http.Request) {
+	m, err := magnet.FromQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	writeJSON(w, torrent.ScrapeMagnet(m))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println("Error encoding response:", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"torrent-pi/internal/config"
+	torrent "torrent-pi/internal/torrent"
+)
+
+// runAdd uploads .torrent files from disk to a running server
+func runAdd(args []string) int {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	server := flags.String("server", fmt.Sprintf("http://localhost:%d", config.PORT), "address of the torrent-pi server")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: torrent-pi add [-server url] <file.torrent>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		if err := uploadTorrent(*server, path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func uploadTorrent(server, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("torrent", filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	part.Write(data)
+	form.Close()
+
+	res, err := http.Post(server+"/add", form.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	msg, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, msg)
+	}
+	fmt.Printf("%s", msg)
+	return nil
+}
+
+// runCreate builds a .torrent file from local content and prints its magnet link
+func runCreate(args []string) int {
+	var opts torrent.CreateOptions
+	var trackers, webSeeds listFlag
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	output := flags.String("o", "", "where to write the .torrent file (default <name>.torrent)")
+	flags.UintVar(&opts.PieceLength, "piece-length", 0, "piece length in bytes, a power of two (default chosen from the content size)")
+	flags.Var(&trackers, "tracker", "announce url, repeat for more tiers. Comma separated urls share a tier")
+	flags.Var(&webSeeds, "web-seed", "web seed url, may be repeated")
+	flags.StringVar(&opts.Comment, "comment", "", "comment")
+	flags.BoolVar(&opts.Private, "private", false, "only use the trackers to find peers")
+	flags.StringVar(&opts.Source, "source", "", "source tag, which makes the info hash unique to a tracker")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: torrent-pi create [options] <file or directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	opts.Path = flags.Arg(0)
+	for _, tier := range trackers {
+		opts.Trackers = append(opts.Trackers, strings.Split(tier, ","))
+	}
+	opts.WebSeeds = webSeeds
+
+	t, err := torrent.Create(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data, err := t.Metainfo()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output == "" {
+		*output = t.Name + ".torrent"
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Wrote", *output)
+	fmt.Println(t.Magnet())
+	return 0
+}
+
+// listFlag collects every value of a repeated flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
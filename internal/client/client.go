@@ -14,42 +14,82 @@ import (
 	message "torrent-pi/internal/peerMessage"
 )
 
+// How long a peer has to complete the extension handshake
+const EXTENSION_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+var (
+	ErrBlockedClient = errors.New("blocked client")
+	ErrSelfConnect   = errors.New("connected to ourselves")
+)
+
+// Settings control how we connect to peers
+type Settings struct {
+	Port             int // we listen on, sent in the extension handshake
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	// Client families we won't talk to, see peer.ClientBlocked
+	BlockedClients []string
+}
+
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	peer     peer.Peer
 	peerID   [20]byte
 	infoHash [20]byte
-	Reserved ReservedBits
-	Bitfield message.Bitfield
+	// The peer ID the peer sent in its handshake
+	RemotePeerID [20]byte
+	Reserved     ReservedBits
+	Bitfield     message.Bitfield
 	handshake.ExtensionHandshake
+
+	// The info dictionary we serve to peers fetching metadata (BEP 9). nil until we have it.
+	metadata []byte
+
+	// PieceLayer looks up the piece hashes of a v2 file by pieces root, so we can answer hash requests (BEP 52).
+	// baseLayer is the height of the piece layer above the 16 KiB blocks.
+	PieceLayer func(root [32]byte) (layer [][32]byte, baseLayer uint32, ok bool)
 }
 
-func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// New connects to a peer. metadata is the torrent's info dictionary if we have it, so we can serve it to the peer.
+func New(peer peer.Peer, peerID, infoHash [20]byte, metadata []byte, settings Settings) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), settings.DialTimeout)
 	if err != nil {
 		return nil, err
 	}
 
 	// Start bittorrent handshake
-	h, err := completeHandshake(conn, infoHash, peerID)
+	h, err := completeHandshake(conn, infoHash, peerID, settings.HandshakeTimeout)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
+	if h.PeerID == peerID {
+		conn.Close()
+		return nil, ErrSelfConnect
+	}
+
 	c := &Client{
-		Conn:     conn,
-		Choked:   true,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-		Reserved: h.Reserved,
+		Conn:         conn,
+		Choked:       true,
+		peer:         peer,
+		infoHash:     infoHash,
+		peerID:       peerID,
+		RemotePeerID: h.PeerID,
+		Reserved:     h.Reserved,
+		metadata:     metadata,
+	}
+	// Most clients can be told from their peer ID, saving us the extension handshake
+	if err := c.checkBlocked(settings.BlockedClients); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
 	// Check whether Reserved Bit: 44 (DHT) is set
 	fmt.Println("client reservedBits", c.Reserved.String())
 	if !c.Reserved.Has(44) {
+		conn.Close()
 		return nil, errors.New("doesn't support extension bit")
 	} else {
 		fmt.Println("Client supports extension bit")
@@ -57,30 +97,59 @@ func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
 
 	// Client supports extension protocol
 	fmt.Println("Starting completeExtensionHandshake")
-	extHandshake, err := completeExtensionHandshake(c.Conn)
-
+	c.Conn.SetDeadline(time.Now().Add(EXTENSION_HANDSHAKE_TIMEOUT))
+	extHandshake, err := completeExtensionHandshake(c.Conn, settings.Port, len(metadata))
+	c.Conn.SetDeadline(time.Time{})
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	fmt.Println("Finished completeExtensionHandshake")
 	c.ExtensionHandshake = *extHandshake
+	if err := c.checkBlocked(settings.BlockedClients); err != nil {
+		conn.Close()
+		return nil, err
+	}
 
 	return c, nil
 
 }
 
-// Read reads and consumes a message from the connection
+// ClientInfo is the software the peer is running, from its extension handshake or peer ID
+func (c *Client) ClientInfo() peer.ClientInfo {
+	return peer.IdentifyPeer(c.RemotePeerID, c.Version)
+}
+
+func (c *Client) checkBlocked(blocked []string) error {
+	if info := c.ClientInfo(); peer.ClientBlocked(info, blocked) {
+		return fmt.Errorf("%w: %s", ErrBlockedClient, info)
+	}
+	return nil
+}
+
+// Read reads and consumes a message from the connection.
+// Metadata and hash requests are answered here, as they can arrive at any point.
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
 	if err == nil && msg != nil {
 		fmt.Println(c.peer.IP, "->", msg.TypeString())
+		if msg.ID == message.MsgExtended && msg.ExtID == handshake.ExtensionID("ut_metadata") {
+			if err := c.handleMetadataRequest(msg.ExtendedMessage); err != nil {
+				return msg, err
+			}
+		}
+		if msg.ID == message.MsgHashRequest {
+			if err := c.handleHashRequest(msg); err != nil {
+				return msg, err
+			}
+		}
 	}
 	return msg, err
 }
 
-func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
+func completeHandshake(conn net.Conn, infohash, peerID [20]byte, timeout time.Duration) (*handshake.Handshake, error) {
 	fmt.Println("Starting completeHandshake...")
-	conn.SetDeadline(time.Now().Add(time.Second * 4))
+	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
 	req := handshake.New(infohash, peerID)
@@ -101,9 +170,13 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func completeExtensionHandshake(conn net.Conn) (h *handshake.ExtensionHandshake, err error) {
+func completeExtensionHandshake(conn net.Conn, port int, metadataSize int) (h *handshake.ExtensionHandshake, err error) {
 	// Check whether there are further messages to be read from the connection
 	for msg, err := message.Read(conn); err == nil; msg, err = message.Read(conn) {
+		if msg == nil {
+			// keep-alive
+			continue
+		}
 		fmt.Println("Recieved message:", msg.TypeString())
 		// Handle the message
 		if msg.ID == message.MsgExtended {
@@ -122,7 +195,7 @@ func completeExtensionHandshake(conn net.Conn) (h *handshake.ExtensionHandshake,
 			// Store the handshake in state
 			time.Sleep(time.Second * 5)
 			// Send extension handshake to peer
-			req := handshake.NewExtended(6881, h.Extensions)
+			req := handshake.NewExtended(port, metadataSize)
 			if _, err := io.Copy(conn, req.Serialize()); err != nil {
 				return nil, err
 			}
@@ -131,41 +204,34 @@ func completeExtensionHandshake(conn net.Conn) (h *handshake.ExtensionHandshake,
 			fmt.Printf("Message type %v didn't match extended\n", msg.ID)
 		}
 	}
-	return initateExtensionHandshake(conn)
+	return initateExtensionHandshake(conn, port, metadataSize)
 }
 
-func initateExtensionHandshake(conn net.Conn) (h *handshake.ExtensionHandshake, err error) {
+func initateExtensionHandshake(conn net.Conn, port int, metadataSize int) (h *handshake.ExtensionHandshake, err error) {
 	// Create extension handshake
-	req := handshake.NewExtended(6881, message.Map{})
+	req := handshake.NewExtended(port, metadataSize)
 
 	// Send extension handshake
 	if _, err := io.Copy(conn, req.Serialize()); err != nil {
 		return nil, err
 	}
 
-	// Read any messages from the connection
-	for msg, err := message.Read(conn); err != nil; msg, err = message.Read(conn) {
+	// Read messages until the peer replies with its extended handshake
+	for {
+		msg, err := message.Read(conn)
 		if err != nil {
-			conn.Close()
 			return nil, err
 		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
 		fmt.Println("Recieved message:", msg.TypeString())
 
-		// Check the message type
-
 		if msg.ExtID != message.ExtHandshake {
-			conn.Close()
 			return nil, fmt.Errorf("Client doing some weird shit")
 		}
-		// Client sent us extended handshake
-
-		// Read the extended handshake
-		h, err = handshake.ReadExtension(msg.Payload)
-		if err != nil {
-			fmt.Println("Extension handshake failed to read extension msg")
-		}
+		return handshake.ReadExtension(msg.Payload)
 	}
-	return
 }
 
 // Download a full piece by sending consecutive requests for blocks which make up that piece
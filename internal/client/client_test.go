@@ -1,9 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"strconv"
 	"testing"
+	"time"
+
+	"torrent-pi/internal/handshake"
+	"torrent-pi/internal/lib"
+	"torrent-pi/internal/peer"
+	message "torrent-pi/internal/peerMessage"
 )
 
 // TestHelloName calls greetings.Hello with a name, checking
@@ -33,3 +43,133 @@ func TestReservedBitsHas(t *testing.T) {
 		}
 	}
 }
+
+// metadataResponse sends a metadata request to the client and reads its reply
+func metadataResponse(t *testing.T, c *Client, piece int) message.MetaDataData {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	c.Conn = ours
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.handleMetadataRequest(message.FormatRequestMetadata(int(handshake.ExtensionID("ut_metadata")), piece))
+	}()
+	msg, err := message.Read(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if msg.ExtID != 3 {
+		t.Fatalf("reply sent with extension ID %d, expected the peer's ID 3", msg.ExtID)
+	}
+	res, err := message.ParseMetadata(msg.ExtendedMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestServeMetadata(t *testing.T) {
+	metadata := bytes.Repeat([]byte("m"), message.METADATA_PAYLOAD_SIZE+10)
+	c := &Client{metadata: metadata}
+	c.Extensions = message.Map{"ut_metadata": 3}
+
+	res := metadataResponse(t, c, 1)
+	if message.MetadataMsgType(res.MsgType) != message.MetaData || res.Piece != 1 || res.Size != len(metadata) {
+		t.Errorf("unexpected response %+v", res)
+	}
+	if !bytes.Equal(res.Payload, metadata[message.METADATA_PAYLOAD_SIZE:]) {
+		t.Errorf("expected last %d bytes of metadata, got %d", 10, len(res.Payload))
+	}
+
+	// Out of range pieces are rejected
+	if res := metadataResponse(t, c, 2); message.MetadataMsgType(res.MsgType) != message.MetaReject {
+		t.Errorf("expected reject, got %+v", res)
+	}
+
+	// Until we have the metadata every request is rejected
+	c.metadata = nil
+	if res := metadataResponse(t, c, 0); message.MetadataMsgType(res.MsgType) != message.MetaReject {
+		t.Errorf("expected reject, got %+v", res)
+	}
+}
+
+func TestServeHashes(t *testing.T) {
+	layer := [][32]byte{{1}, {2}, {3}}
+	pad := lib.PadHash(1)
+	root := lib.MerkleRoot(layer, len(layer), pad)
+	c := &Client{PieceLayer: func(r [32]byte) ([][32]byte, uint32, bool) {
+		return layer, 1, r == root
+	}}
+
+	// Two hashes and the uncle proving them against the root
+	hashes, ok := c.hashes(message.HashRequest{PiecesRoot: root, BaseLayer: 1, Index: 0, Length: 2, ProofLayers: 1})
+	if !ok || len(hashes) != 3 || hashes[0] != layer[0] || hashes[1] != layer[1] {
+		t.Fatalf("unexpected hashes %v", hashes)
+	}
+	if lib.MerkleRoot([][32]byte{lib.MerkleRoot(hashes[:2], 2, pad), hashes[2]}, 2, pad) != root {
+		t.Error("proof does not lead to the pieces root")
+	}
+
+	for _, req := range []message.HashRequest{
+		{PiecesRoot: root, BaseLayer: 0, Length: 2},           // not the piece layer
+		{PiecesRoot: root, BaseLayer: 1, Index: 1, Length: 2}, // misaligned
+		{PiecesRoot: root, BaseLayer: 1, Length: 3},           // not a power of two
+		{PiecesRoot: [32]byte{9}, BaseLayer: 1, Length: 2},    // unknown file
+	} {
+		if _, ok := c.hashes(req); ok {
+			t.Errorf("expected %+v to be rejected", req)
+		}
+	}
+
+	// Round trip through a hashes message
+	req := message.HashRequest{PiecesRoot: root, BaseLayer: 1, Length: 4}
+	msg, err := message.Read(bytes.NewReader(message.FormatHashes(req, layer).Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, parsedHashes, err := message.ParseHashes(msg)
+	if err != nil || parsed != req || len(parsedHashes) != 3 || parsedHashes[2] != layer[2] {
+		t.Errorf("unexpected hashes message %+v %v %v", parsed, parsedHashes, err)
+	}
+}
+
+// fakePeer accepts one connection and answers the handshake with peerID
+func fakePeer(t *testing.T, infoHash, peerID [20]byte) peer.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := handshake.Read(conn); err != nil {
+			return
+		}
+		io.Copy(conn, handshake.New(infoHash, peerID).Serialize())
+		io.Copy(io.Discard, conn)
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestRefusePeers(t *testing.T) {
+	settings := Settings{DialTimeout: time.Second, HandshakeTimeout: time.Second, BlockedClients: []string{"Xunlei"}}
+	var infoHash, ours, xunlei [20]byte
+	copy(ours[:], "-MW0100-abcdefghijkl")
+	copy(xunlei[:], "-XL0012-abcdefghijkl")
+
+	if _, err := New(fakePeer(t, infoHash, xunlei), ours, infoHash, nil, settings); !errors.Is(err, ErrBlockedClient) {
+		t.Errorf("expected blocked client, got %v", err)
+	}
+	if _, err := New(fakePeer(t, infoHash, ours), ours, infoHash, nil, settings); !errors.Is(err, ErrSelfConnect) {
+		t.Errorf("expected to notice connecting to ourselves, got %v", err)
+	}
+}
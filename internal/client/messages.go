@@ -1,9 +1,11 @@
 package client
 
 import (
-	"fmt"
-	"math"
+	"errors"
 	"time"
+
+	"torrent-pi/internal/handshake"
+	"torrent-pi/internal/lib"
 	message "torrent-pi/internal/peerMessage"
 )
 
@@ -26,49 +28,153 @@ func (c *Client) SendInterested() error {
 	return err
 }
 
-func (c *Client) FetchMetadata() []byte {
-	fmt.Println("Fetching metadata...")
-	var err error
-
-	// How to find out metadata size?
-	// Metadata pieces are in form of 16 KB chunks
-	metadataPieces := int(math.Ceil(float64(c.Metadata_size) / float64(message.METADATA_PAYLOAD_SIZE)))
-	fmt.Println("total Metadata pieces:", metadataPieces)
-	dataBuf := make([]byte, c.Metadata_size)
-
-	// Request the metadata
-	// 1. Send a request for the metadata
-	for i := 0; i < metadataPieces; i++ {
-		var m = &message.Message{}
-		msg := message.FormatRequestMetadata(c.Extensions["ut_metadata"], i)
-		_, err = c.Conn.Write(msg.Serialize())
+var ErrMetadataRejected = errors.New("peer rejected metadata request")
+var ErrHashesRejected = errors.New("peer rejected hash request")
+
+// RequestMetadataPiece fetches one 16 KiB piece of the info dictionary using ut_metadata (BEP 9)
+func (c *Client) RequestMetadataPiece(piece int, timeout time.Duration) ([]byte, error) {
+	extID, ok := c.Extensions["ut_metadata"]
+	if !ok || extID == 0 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	msg := message.FormatRequestMetadata(extID, piece)
+	if _, err := c.Conn.Write(msg.Serialize()); err != nil {
+		return nil, err
+	}
+
+	// Throw away all messages until we get the piece, or the peer rejects the request
+	for {
+		m, err := c.Read()
 		if err != nil {
-			fmt.Println("Error: ", err)
+			return nil, err
+		}
+		if m == nil {
+			continue
+		}
+		if m.ID == message.MsgBitfield {
+			c.Bitfield = m.Payload
+		}
+		if m.ID != message.MsgExtended || m.ExtID != handshake.ExtensionID("ut_metadata") {
+			continue
 		}
 
-		// 2. Wait for the response
-		// Throw away all messages until we get a piece
-		for m.ID != message.MsgExtended || m.ExtID != message.ExtMsgID(c.Extensions["ut_metadata"]) {
-			m, err = message.Read(c.Conn)
-			if err != nil {
-				fmt.Println("FetchMetadata Error: ", err)
-				continue
-			}
+		data, err := message.ParseMetadata(m.ExtendedMessage)
+		if err != nil {
+			return nil, err
+		}
+		if data.Piece != piece {
+			continue
+		}
+		switch message.MetadataMsgType(data.MsgType) {
+		case message.MetaReject:
+			return nil, ErrMetadataRejected
+		case message.MetaData:
+			return data.Payload, nil
 		}
+	}
+}
+
+// handleMetadataRequest answers a peer's ut_metadata request with a piece of the info dictionary,
+// or rejects it if we don't have the metadata yet
+func (c *Client) handleMetadataRequest(msg message.ExtendedMessage) error {
+	req, err := message.ParseMetadata(msg)
+	if err != nil || message.MetadataMsgType(req.MsgType) != message.MetaRequest {
+		// Not a request, leave it to the caller
+		return nil
+	}
+	extID := c.Extensions["ut_metadata"]
+	if extID == 0 {
+		// Peer didn't tell us how to reply
+		return nil
+	}
+
+	var res message.ExtendedMessage
+	if c.metadata == nil || req.Piece < 0 || req.Piece*message.METADATA_PAYLOAD_SIZE >= len(c.metadata) {
+		res = message.FormatRejectMetadata(extID, req.Piece)
+	} else {
+		res = message.FormatMetadataPiece(extID, req.Piece, c.metadata)
+	}
+	_, err = c.Conn.Write(res.Serialize())
+	return err
+}
+
+// RequestHashes fetches a range of a v2 file's merkle hashes (BEP 52). The proof hashes follow the requested ones.
+func (c *Client) RequestHashes(req message.HashRequest, timeout time.Duration) ([][32]byte, error) {
+	c.Conn.SetDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	if _, err := c.Conn.Write(message.FormatHashRequest(req).Serialize()); err != nil {
+		return nil, err
+	}
 
-		// 3. Read the response
-		piece, err := message.ParseMetadata(m.ExtendedMessage, c.Extensions)
-		time.Sleep(time.Second * 1)
+	// Throw away all messages until we get the hashes, or the peer rejects the request
+	for {
+		m, err := c.Read()
 		if err != nil {
-			fmt.Println("Error: ", err)
-			// Put the piece back to be picked up by another request
+			return nil, err
+		}
+		if m != nil && m.ID == message.MsgBitfield {
+			c.Bitfield = m.Payload
+		}
+		if m == nil || (m.ID != message.MsgHashes && m.ID != message.MsgHashReject) {
 			continue
 		}
+		res, hashes, err := message.ParseHashes(m)
+		if res != req {
+			// Not the answer to this request
+			continue
+		}
+		if m.ID == message.MsgHashReject {
+			return nil, ErrHashesRejected
+		}
+		return hashes, err
+	}
+}
 
-		// 4. Copy the data to the buffer
-		pieceOffset := piece.Piece * message.METADATA_PAYLOAD_SIZE
-		copy(dataBuf[pieceOffset:], piece.Payload)
+// handleHashRequest answers a peer's request for piece layer hashes, or rejects it if we can't
+func (c *Client) handleHashRequest(msg *message.Message) error {
+	req, err := message.ParseHashRequest(msg)
+	if err != nil {
+		return err
+	}
+	hashes, ok := c.hashes(req)
+	var res *message.Message
+	if ok {
+		res = message.FormatHashes(req, hashes)
+	} else {
+		res = message.FormatHashReject(req)
 	}
+	_, err = c.Conn.Write(res.Serialize())
+	return err
+}
 
-	return dataBuf
+// hashes finds the requested range of the piece layer, followed by the uncle hashes proving it against the pieces root.
+// We only keep piece layers, so other layers are refused.
+func (c *Client) hashes(req message.HashRequest) ([][32]byte, bool) {
+	if c.PieceLayer == nil {
+		return nil, false
+	}
+	layer, baseLayer, ok := c.PieceLayer(req.PiecesRoot)
+	length := int(req.Length)
+	if !ok || req.BaseLayer != baseLayer || length == 0 || length&(length-1) != 0 || int(req.Index)%length != 0 {
+		return nil, false
+	}
+
+	tree := lib.MerkleLayers(layer, len(layer), lib.PadHash(int(baseLayer)))
+	if int(req.Index)+length > len(tree[0]) {
+		return nil, false
+	}
+	hashes := append([][32]byte{}, tree[0][req.Index:int(req.Index)+length]...)
+
+	// Uncles start above the subtree holding the requested hashes
+	height, index := lib.Log2(length), int(req.Index)/length
+	for i := 0; i < int(req.ProofLayers) && height+i < len(tree)-1; i++ {
+		hashes = append(hashes, tree[height+i][index^1])
+		index /= 2
+	}
+	return hashes, true
 }
@@ -0,0 +1,323 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"torrent-pi/internal/storage"
+)
+
+// Defaults
+const (
+	PORT            = 8080
+	PEER_PORT       = 6881
+	DOWNLOAD_DIR    = "downloads/torrents"
+	DATA_DIR        = "downloads"
+	MAX_CONNECTIONS = 10
+)
+
+// Environment variables are named ENV_PREFIX followed by the setting's json name in capitals, e.g. TORRENT_PI_PEER_PORT
+const ENV_PREFIX = "TORRENT_PI_"
+
+// Config holds every setting of the server. Settings are read from a json file,
+// then environment variables, then command line flags, each overriding the last.
+type Config struct {
+	Port        int    `json:"port"`         // of the web api
+	PeerPort    int    `json:"peer_port"`    // we tell trackers and peers about
+	DownloadDir string `json:"download_dir"` // .torrent files and resume data
+	DataDir     string `json:"data_dir"`     // downloaded content
+	// Where files are kept until downloaded, then moved to DataDir. Empty to download straight to DataDir.
+	IncompleteDir string `json:"incomplete_dir"`
+	// Whether files still downloading are named with storage.PART_SUFFIX
+	PartFiles bool `json:"part_files"`
+	// Run when a download finishes: a url to POST the torrent's json to, or a program. Only read at startup.
+	CompletionHook string `json:"completion_hook"`
+	// Storage backend for new torrents, see storage.Open
+	StorageBackend string `json:"storage_backend"`
+	// Bytes of cache given to each torrent, half for writes and half for reads
+	CacheSize int64 `json:"cache_size"`
+	// How to allocate files before downloading, see storage.Prepare
+	Preallocation string `json:"preallocation"`
+	// Peers each torrent downloads from at once
+	MaxConnections int `json:"max_connections"`
+	// Empty for the session to make its own, see peer.NewPeerID
+	PeerID string `json:"peer_id"`
+	// Rates in bytes a second, 0 for unlimited. The session's are shared by every torrent.
+	// The peer limits apply to each peer of torrents added afterwards.
+	DownloadLimit     int64 `json:"download_limit"`
+	UploadLimit       int64 `json:"upload_limit"`
+	PeerDownloadLimit int64 `json:"peer_download_limit"`
+	PeerUploadLimit   int64 `json:"peer_upload_limit"`
+	// Named speed profiles, which take over from download_limit and upload_limit
+	// when turned on by the schedule or turtle mode. e.g. {"day": {"download_limit": 204800}, "night": {}}
+	Profiles map[string]Profile `json:"profiles"`
+	// When each profile applies, the first matching rule winning
+	Schedule []ScheduleRule `json:"schedule"`
+	// The profile used in turtle mode
+	TurtleProfile string `json:"turtle_profile"`
+	// Client families we won't download from or upload to, e.g. ["Xunlei", "Baidu Netdisk"]. See peer.ClientBlocked.
+	BlockedClients []string `json:"blocked_clients"`
+
+	DialTimeout      Duration `json:"dial_timeout"`      // connecting to a peer
+	HandshakeTimeout Duration `json:"handshake_timeout"` // for a peer to answer our handshake
+	TrackerTimeout   Duration `json:"tracker_timeout"`   // announces and scrapes
+	MetadataTimeout  Duration `json:"metadata_timeout"`  // fetching the info dictionary of a magnet link
+}
+
+func Default() Config {
+	return Config{
+		Port:           PORT,
+		PeerPort:       PEER_PORT,
+		DownloadDir:    DOWNLOAD_DIR,
+		DataDir:        DATA_DIR,
+		StorageBackend: storage.FILE,
+		CacheSize:      storage.DEFAULT_CACHE_SIZE,
+		Preallocation:  storage.PREALLOC_SPARSE,
+		MaxConnections: MAX_CONNECTIONS,
+		Profiles: map[string]Profile{
+			TURTLE_PROFILE: {DownloadLimit: 50 * 1024, UploadLimit: 10 * 1024},
+		},
+		TurtleProfile:    TURTLE_PROFILE,
+		DialTimeout:      Duration(3 * time.Second),
+		HandshakeTimeout: Duration(4 * time.Second),
+		TrackerTimeout:   Duration(15 * time.Second),
+		MetadataTimeout:  Duration(10 * time.Minute),
+	}
+}
+
+// Clone copies the config along with its lists and profiles, so changing the copy leaves the original alone
+func (c Config) Clone() Config {
+	c.Profiles = maps.Clone(c.Profiles)
+	c.BlockedClients = slices.Clone(c.BlockedClients)
+	c.Schedule = slices.Clone(c.Schedule)
+	for i := range c.Schedule {
+		c.Schedule[i].Days = slices.Clone(c.Schedule[i].Days)
+	}
+	return c
+}
+
+// Duration is a time.Duration written as a string in json, e.g. "1m30s". Plain numbers are seconds.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var seconds float64
+		if json.Unmarshal(data, &seconds) != nil {
+			return fmt.Errorf("expected a duration, got %s", data)
+		}
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Load reads settings from a json file over the current ones. Settings missing from the file are left alone.
+func (c *Config) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := c.Patch(data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Patch sets the settings in a json object, refusing any it doesn't know
+func (c *Config) Patch(data []byte) error {
+	// Decoding reuses the lists' backing arrays, which may be shared with another copy of the config
+	*c = c.Clone()
+	// Profiles are replaced, not merged with the ones we have
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(data, &keys) == nil && keys["profiles"] != nil {
+		c.Profiles = nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// ApplyEnv sets anything given in the environment, see ENV_PREFIX
+func (c *Config) ApplyEnv(lookup func(key string) (string, bool)) error {
+	var errs []error
+	for _, name := range Names() {
+		if value, ok := lookup(ENV_PREFIX + strings.ToUpper(name)); ok {
+			if err := c.Set(name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s%s: %w", ENV_PREFIX, strings.ToUpper(name), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Names lists the json names of every setting
+func Names() []string {
+	t := reflect.TypeOf(Config{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, t.Field(i).Tag.Get("json"))
+	}
+	return names
+}
+
+// Set changes a setting, by json name, from its text form
+func (c *Config) Set(name string, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("json") != name {
+			continue
+		}
+		field := v.Field(i)
+		if d, ok := field.Addr().Interface().(*Duration); ok {
+			return d.parse(value)
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			field.SetInt(n)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s can only be set in the config file", name)
+			}
+			// Lists are comma separated
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		default:
+			return fmt.Errorf("%s can only be set in the config file", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %s", name)
+}
+
+// Validate checks every setting, returning all of the problems found
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port <= 65535, "port %d out of range", c.Port)
+	check(c.PeerPort > 0 && c.PeerPort <= 65535, "peer_port %d out of range", c.PeerPort)
+	check(c.DownloadDir != "", "download_dir is required")
+	check(c.DataDir != "", "data_dir is required")
+	switch c.StorageBackend {
+	case storage.FILE, storage.MMAP, storage.MEMORY, storage.PIECEFILE:
+	default:
+		check(false, "unknown storage_backend %q", c.StorageBackend)
+	}
+	check(c.CacheSize >= 0, "cache_size can't be negative")
+	switch c.Preallocation {
+	case storage.PREALLOC_NONE, storage.PREALLOC_SPARSE, storage.PREALLOC_FULL:
+	default:
+		check(false, "unknown preallocation %q", c.Preallocation)
+	}
+	check(c.DownloadLimit >= 0 && c.UploadLimit >= 0, "rate limits can't be negative")
+	check(c.PeerDownloadLimit >= 0 && c.PeerUploadLimit >= 0, "rate limits can't be negative")
+	check(c.MaxConnections > 0, "max_connections must be at least 1")
+	check(c.PeerID == "" || len(c.PeerID) == 20, "peer_id must be 20 bytes, or empty")
+	check(c.DialTimeout > 0, "dial_timeout must be positive")
+	check(c.HandshakeTimeout > 0, "handshake_timeout must be positive")
+	check(c.TrackerTimeout > 0, "tracker_timeout must be positive")
+	check(c.MetadataTimeout > 0, "metadata_timeout must be positive")
+	errs = append(errs, c.validateSchedule()...)
+	return errors.Join(errs...)
+}
+
+// Parse builds the server's config from the defaults, the file given by -config (or TORRENT_PI_CONFIG),
+// the environment and then the rest of the flags in args. Every setting has a flag named after it, e.g. -peer_port.
+func Parse(args []string) (Config, error) {
+	flags := flag.NewFlagSet("torrent-pi", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv(ENV_PREFIX+"CONFIG"), "json file to read settings from")
+	defaults := Default()
+	var set [][2]string
+	for _, name := range Names() {
+		name := name
+		flags.Func(name, fmt.Sprintf("(default %v)", defaults.get(name)), func(value string) error {
+			// Check the value now, so mistakes are reported against the flag
+			scratch := Default()
+			if err := scratch.Set(name, value); err != nil {
+				return err
+			}
+			set = append(set, [2]string{name, value})
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	c := Default()
+	if *path != "" {
+		if err := c.Load(*path); err != nil {
+			return c, err
+		}
+	}
+	if err := c.ApplyEnv(os.LookupEnv); err != nil {
+		return c, err
+	}
+	for _, flag := range set {
+		c.Set(flag[0], flag[1])
+	}
+	return c, c.Validate()
+}
+
+// get returns a setting by json name
+func (c Config) get(name string) any {
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("json") == name {
+			return v.Field(i).Interface()
+		}
+	}
+	return nil
+}
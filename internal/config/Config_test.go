@@ -0,0 +1,94 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "torrent-pi.json")
+	os.WriteFile(path, []byte(`{"port": 9000, "peer_port": 7000, "max_connections": 30, "dial_timeout": "5s"}`), 0644)
+	t.Setenv(ENV_PREFIX+"PEER_PORT", "7001")
+	t.Setenv(ENV_PREFIX+"MAX_CONNECTIONS", "40")
+
+	c, err := Parse([]string{"-config", path, "-max_connections", "50", "-metadata_timeout", "90", "-blocked_clients", "Xunlei, Baidu Netdisk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9000 {
+		t.Errorf("port from file: got %d", c.Port)
+	}
+	if c.PeerPort != 7001 {
+		t.Errorf("peer_port from env: got %d", c.PeerPort)
+	}
+	if c.MaxConnections != 50 {
+		t.Errorf("max_connections from flag: got %d", c.MaxConnections)
+	}
+	if c.DialTimeout != Duration(5*time.Second) || c.MetadataTimeout != Duration(90*time.Second) {
+		t.Errorf("timeouts: got %s and %s", c.DialTimeout, c.MetadataTimeout)
+	}
+	if !reflect.DeepEqual(c.BlockedClients, []string{"Xunlei", "Baidu Netdisk"}) {
+		t.Errorf("blocked_clients from flag: got %q", c.BlockedClients)
+	}
+	if c.DataDir != DATA_DIR {
+		t.Errorf("unset settings should be defaults, got data_dir %q", c.DataDir)
+	}
+
+	if _, err := Parse([]string{"-max_connections", "many"}); err == nil {
+		t.Error("expected bad flag to fail")
+	}
+	if _, err := Parse([]string{"-peer_port", "70000"}); err == nil {
+		t.Error("expected out of range port to fail validation")
+	}
+}
+
+func TestPatch(t *testing.T) {
+	c := Default()
+	if err := c.Patch([]byte(`{"part_files": true, "tracker_timeout": 30}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !c.PartFiles || c.TrackerTimeout != Duration(30*time.Second) || c.Port != PORT {
+		t.Errorf("patch not applied: %+v", c)
+	}
+	if err := c.Patch([]byte(`{"max_peers": 3}`)); err == nil {
+		t.Error("expected unknown setting to be refused")
+	}
+
+	// Round trips through json, as served by /config
+	data, _ := json.Marshal(c)
+	loaded := Default()
+	if err := loaded.Patch(data); err != nil || !reflect.DeepEqual(loaded, c) {
+		t.Errorf("json round trip: %v %s", err, data)
+	}
+
+	// Patching a copy leaves the original's lists alone
+	c.Schedule = []ScheduleRule{{Profile: TURTLE_PROFILE, Days: []string{"mon"}, Start: "09:00", End: "17:00"}}
+	c.BlockedClients = []string{"Xunlei"}
+	patched := c
+	if err := patched.Patch([]byte(`{"schedule": [{"profile": "nope", "days": ["tue"], "start": "01:00", "end": "02:00"}], "blocked_clients": ["Baidu Netdisk"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Schedule[0].Profile != TURTLE_PROFILE || c.BlockedClients[0] != "Xunlei" {
+		t.Errorf("patch changed the original: %+v %v", c.Schedule, c.BlockedClients)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.StorageBackend = "tape"
+	c.MaxConnections = 0
+	c.PeerID = "short"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected invalid config")
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Profile is a named pair of session rate limits, in bytes a second with 0 for unlimited
+type Profile struct {
+	DownloadLimit int64 `json:"download_limit"`
+	UploadLimit   int64 `json:"upload_limit"`
+}
+
+// ScheduleRule switches to a profile between two times of day, on some days of the week.
+// Times are local and written 15:04. A rule can run past midnight, e.g. 22:00 to 07:00,
+// in which case the days are those it starts on. A rule starting and ending at the same time lasts all day.
+type ScheduleRule struct {
+	Profile string   `json:"profile"`
+	Days    []string `json:"days,omitempty"` // mon, tue..., weekdays or weekends. Empty for every day.
+	Start   string   `json:"start"`
+	End     string   `json:"end"`
+}
+
+// The profile turtle mode uses, unless the config names another
+const TURTLE_PROFILE = "turtle"
+
+var dayNames = map[string][]time.Weekday{
+	"sun": {time.Sunday}, "mon": {time.Monday}, "tue": {time.Tuesday}, "wed": {time.Wednesday},
+	"thu": {time.Thursday}, "fri": {time.Friday}, "sat": {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// ActiveProfile works out which limits apply at now. Turtle mode wins, then the first schedule rule covering now.
+// With neither, the name is empty and the limits are download_limit and upload_limit.
+func (c Config) ActiveProfile(now time.Time, turtle bool) (string, Profile) {
+	if turtle {
+		return c.TurtleProfile, c.Profiles[c.TurtleProfile]
+	}
+	for _, rule := range c.Schedule {
+		if rule.covers(now) {
+			return rule.Profile, c.Profiles[rule.Profile]
+		}
+	}
+	return "", Profile{DownloadLimit: c.DownloadLimit, UploadLimit: c.UploadLimit}
+}
+
+// covers is true if now falls within the rule. The rule is assumed to be valid.
+func (r ScheduleRule) covers(now time.Time) bool {
+	start, _ := minuteOfDay(r.Start)
+	end, _ := minuteOfDay(r.End)
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	if end <= start {
+		// Past midnight, the rule started the day before
+		if minute < end {
+			day = (day + 6) % 7
+		} else if minute < start {
+			return false
+		}
+	} else if minute < start || minute >= end {
+		return false
+	}
+	return r.onDay(day)
+}
+
+func (r ScheduleRule) onDay(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, name := range r.Days {
+		for _, d := range dayNames[strings.ToLower(name)] {
+			if d == day {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// minuteOfDay reads a time like 22:30
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q, expected hh:mm", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validateSchedule checks the profiles and the rules that refer to them
+func (c Config) validateSchedule() []error {
+	var errs []error
+	for name, profile := range c.Profiles {
+		if profile.DownloadLimit < 0 || profile.UploadLimit < 0 {
+			errs = append(errs, fmt.Errorf("profile %s: rate limits can't be negative", name))
+		}
+	}
+	if _, ok := c.Profiles[c.TurtleProfile]; !ok {
+		errs = append(errs, fmt.Errorf("turtle_profile: no profile named %q", c.TurtleProfile))
+	}
+	for i, rule := range c.Schedule {
+		if _, ok := c.Profiles[rule.Profile]; !ok {
+			errs = append(errs, fmt.Errorf("schedule %d: no profile named %q", i, rule.Profile))
+		}
+		for _, day := range rule.Days {
+			if _, ok := dayNames[strings.ToLower(day)]; !ok {
+				errs = append(errs, fmt.Errorf("schedule %d: unknown day %q", i, day))
+			}
+		}
+		for _, s := range []string{rule.Start, rule.End} {
+			if _, err := minuteOfDay(s); err != nil {
+				errs = append(errs, fmt.Errorf("schedule %d: %w", i, err))
+			}
+		}
+	}
+	return errs
+}
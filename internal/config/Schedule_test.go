@@ -0,0 +1,90 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func scheduled() Config {
+	c := Default()
+	c.DownloadLimit = 1000
+	c.Profiles["night"] = Profile{}
+	c.Profiles["day"] = Profile{DownloadLimit: 200 * 1024, UploadLimit: 50 * 1024}
+	c.Schedule = []ScheduleRule{
+		{Profile: "night", Start: "22:00", End: "07:00"},
+		{Profile: "day", Days: []string{"weekdays"}, Start: "09:00", End: "18:00"},
+	}
+	return c
+}
+
+func TestActiveProfile(t *testing.T) {
+	c := scheduled()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// 2024-06-03 is a Monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, time.Local)
+	}
+	for _, test := range []struct {
+		now      time.Time
+		turtle   bool
+		expected string
+	}{
+		{at(3, 23, 0), false, "night"},
+		{at(4, 6, 59), false, "night"}, // the night that started on Monday
+		{at(4, 7, 0), false, ""},
+		{at(3, 9, 0), false, "day"},
+		{at(3, 17, 59), false, "day"},
+		{at(3, 18, 0), false, ""},
+		{at(8, 12, 0), false, ""}, // Saturday
+		{at(3, 12, 0), true, TURTLE_PROFILE},
+	} {
+		name, profile := c.ActiveProfile(test.now, test.turtle)
+		if name != test.expected {
+			t.Errorf("%s turtle %v: expected %q, got %q", test.now, test.turtle, test.expected, name)
+		}
+		if name == "" && profile.DownloadLimit != 1000 {
+			t.Errorf("%s: expected the configured limits, got %+v", test.now, profile)
+		}
+		if name != "" && profile != c.Profiles[name] {
+			t.Errorf("%s: expected %s's limits, got %+v", test.now, name, profile)
+		}
+	}
+
+	// Overnight rules only start on their days
+	c.Schedule = []ScheduleRule{{Profile: "night", Days: []string{"fri"}, Start: "22:00", End: "07:00"}}
+	if name, _ := c.ActiveProfile(at(8, 3, 0), false); name != "night" {
+		t.Errorf("expected Friday night to run into Saturday, got %q", name)
+	}
+	if name, _ := c.ActiveProfile(at(7, 3, 0), false); name != "" {
+		t.Errorf("expected Thursday night to be unscheduled, got %q", name)
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, rule := range []ScheduleRule{
+		{Profile: "evening", Start: "18:00", End: "22:00"},
+		{Profile: "day", Days: []string{"someday"}, Start: "09:00", End: "18:00"},
+		{Profile: "day", Start: "9am", End: "18:00"},
+	} {
+		c := scheduled()
+		c.Schedule = append(c.Schedule, rule)
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", rule)
+		}
+	}
+
+	c := scheduled()
+	c.TurtleProfile = "snail"
+	if err := c.Validate(); err == nil {
+		t.Error("expected missing turtle profile to be invalid")
+	}
+
+	// Profiles are replaced as a whole by a patch
+	c = scheduled()
+	c.Schedule = nil
+	if err := c.Patch([]byte(`{"profiles": {"turtle": {"download_limit": 1}}}`)); err != nil || len(c.Profiles) != 1 {
+		t.Errorf("expected profiles to be replaced, got %+v %v", c.Profiles, err)
+	}
+}
@@ -2,5 +2,5 @@ package constants
 
 const VERSION = "v0.1"
 const CLIENT_NAME = "MWOWTorrent"
-const PEER_ID = "MW-MWOWTorrent0-1-012"
+const CLIENT_ID = "MW"        // in our peer IDs, see peer.NewPeerID
 const BLOCK_SIZE uint = 16384 // 2^14 bytes
@@ -16,21 +16,32 @@ var supportedExtensions = message.Map{
 
 type ExtensionHandshake struct {
 	Extensions    message.Map `bencode:"m"`
-	Port          int         `bencode:"p"`             // Port to connect to
-	Version       string      `bencode:"v"`             // Verson of the peer's client
-	Metadata_size int         `bencode:"metadata_size"` // in bytes
-	MyIP          []byte      `bencode:"yourip"`        // My IP (as seen by the other peer)
+	Port          int         `bencode:"p"`                       // Port to connect to
+	Version       string      `bencode:"v"`                       // Verson of the peer's client
+	Metadata_size int         `bencode:"metadata_size,omitempty"` // in bytes
+	MyIP          []byte      `bencode:"yourip,omitempty"`        // My IP (as seen by the other peer)
 	// reqLimit      []int  "reqq"          // Request queue size limit
 }
 
-func NewExtended(port int, extensions message.Map) *ExtensionHandshake {
-	m := supportedExtensions
-	for extension, extensionID := range extensions {
-		if supportedExtensions[extension] > 0 && extensionID > 0 {
-			m[extension] = extensionID
-		}
+// NewExtended creates our extension handshake.
+// Peers send us extension messages using the IDs we advertise here, which need not match theirs.
+// metadataSize is the size of the info dictionary we can serve, or 0 if we don't have it yet.
+func NewExtended(port int, metadataSize int) *ExtensionHandshake {
+	m := message.Map{}
+	for extension, extensionID := range supportedExtensions {
+		m[extension] = extensionID
 	}
-	return &ExtensionHandshake{Extensions: m, Port: port, Version: string(constants.CLIENT_NAME + constants.VERSION)}
+	return &ExtensionHandshake{
+		Extensions:    m,
+		Port:          port,
+		Version:       string(constants.CLIENT_NAME + constants.VERSION),
+		Metadata_size: metadataSize,
+	}
+}
+
+// ExtensionID returns the ID peers use when sending us the given extension's messages
+func ExtensionID(extension string) message.ExtMsgID {
+	return message.ExtMsgID(supportedExtensions[extension])
 }
 
 /*
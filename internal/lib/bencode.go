@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// BencodeEnd returns the index just past the bencoded value starting at data[start].
+// Used to find the exact bytes of a value, which a decode & re-encode would not preserve.
+func BencodeEnd(data []byte, start int) (int, error) {
+	if start >= len(data) {
+		return 0, fmt.Errorf("bencode: unexpected end of data")
+	}
+	switch c := data[start]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[start:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("bencode: unterminated integer at %d", start)
+		}
+		return start + end + 1, nil
+	case c == 'l' || c == 'd':
+		i := start + 1
+		for i < len(data) && data[i] != 'e' {
+			end, err := BencodeEnd(data, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		}
+		if i >= len(data) {
+			return 0, fmt.Errorf("bencode: unterminated %c at %d", c, start)
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[start:], ':')
+		if colon < 0 {
+			return 0, fmt.Errorf("bencode: bad string at %d", start)
+		}
+		length, err := strconv.Atoi(string(data[start : start+colon]))
+		if err != nil || length < 0 {
+			return 0, fmt.Errorf("bencode: bad string length at %d", start)
+		}
+		end := start + colon + 1 + length
+		if end > len(data) {
+			return 0, fmt.Errorf("bencode: string at %d overruns data", start)
+		}
+		return end, nil
+	default:
+		return 0, fmt.Errorf("bencode: unexpected %q at %d", c, start)
+	}
+}
+
+// BencodeDictValue returns the raw bytes of the value stored under key in a bencoded dictionary
+func BencodeDictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("bencode: not a dictionary")
+	}
+	i := 1
+	for i < len(data) && data[i] != 'e' {
+		keyEnd, err := BencodeEnd(data, i)
+		if err != nil {
+			return nil, err
+		}
+		if data[i] < '0' || data[i] > '9' {
+			return nil, fmt.Errorf("bencode: dictionary key at %d is not a string", i)
+		}
+		colon := bytes.IndexByte(data[i:], ':')
+		k := string(data[i+colon+1 : keyEnd])
+
+		valueEnd, err := BencodeEnd(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if k == key {
+			return data[keyEnd:valueEnd], nil
+		}
+		i = valueEnd
+	}
+	return nil, fmt.Errorf("bencode: key %q not found", key)
+}
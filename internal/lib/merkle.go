@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"crypto/sha256"
+)
+
+// v2 torrents hash files as merkle trees of SHA256s of 16 KiB blocks (BEP 52)
+const MERKLE_BLOCK_SIZE = 16384
+
+// BlockHashes returns the merkle tree leaves for some file data
+func BlockHashes(data []byte) [][32]byte {
+	leaves := make([][32]byte, 0, (len(data)+MERKLE_BLOCK_SIZE-1)/MERKLE_BLOCK_SIZE)
+	for start := 0; start < len(data); start += MERKLE_BLOCK_SIZE {
+		leaves = append(leaves, sha256.Sum256(data[start:min(start+MERKLE_BLOCK_SIZE, len(data))]))
+	}
+	return leaves
+}
+
+// PadHash is the root of a subtree of 2^height zero leaves, used to fill out a layer beyond the end of a file
+func PadHash(height int) [32]byte {
+	var pad [32]byte
+	for i := 0; i < height; i++ {
+		pad = hashPair(pad, pad)
+	}
+	return pad
+}
+
+// MerkleLayers builds a tree over the leaves, padded with pad out to width leaves.
+// layers[0] holds the padded leaves and the last layer holds the root.
+func MerkleLayers(leaves [][32]byte, width int, pad [32]byte) [][][32]byte {
+	width = NextPowerOfTwo(max(width, len(leaves)))
+	layer := make([][32]byte, width)
+	copy(layer, leaves)
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+
+	layers := [][][32]byte{layer}
+	for len(layer) > 1 {
+		parent := make([][32]byte, len(layer)/2)
+		for i := range parent {
+			parent[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layers = append(layers, parent)
+		layer = parent
+	}
+	return layers
+}
+
+// MerkleRoot is the root of a tree over the leaves, padded with pad out to width leaves
+func MerkleRoot(leaves [][32]byte, width int, pad [32]byte) [32]byte {
+	layers := MerkleLayers(leaves, width, pad)
+	return layers[len(layers)-1][0]
+}
+
+// NextPowerOfTwo returns the smallest power of two >= n
+func NextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// Log2 returns the exponent of a power of two
+func Log2(n int) int {
+	height := 0
+	for n > 1 {
+		n /= 2
+		height++
+	}
+	return height
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
@@ -1,56 +1,78 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"os"
 	"time"
 )
 
-const UDP_Timeout = time.Duration(15) * time.Second
+// UDP_TIMEOUT is how long to wait for the first response. It doubles after every retransmission (BEP 15).
+const UDP_TIMEOUT = 15 * time.Second
 
-func UDPRequest(address string, reader io.Reader) (res []byte, err error) {
+// Requests are retransmitted up to UDP_MAX_RETRANSMITS times, the last waiting 15 * 2^8 seconds.
+// Callers should give up well before then, see the tracker timeout.
+const UDP_MAX_RETRANSMITS = 8
+
+// Large enough for any tracker response
+const UDP_BUFFER_SIZE = 1024 * 64
+
+// RetransmitTimeout returns how long to wait for a response after the n-th retransmission,
+// given how long we waited for the first, usually UDP_TIMEOUT
+func RetransmitTimeout(first time.Duration, n int) time.Duration {
+	return first << n
+}
+
+// IsTimeout reports whether err was caused by a request timing out
+func IsTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// UDPConn is a connection to a udp server, for request/response protocols
+type UDPConn struct {
+	conn   *net.UDPConn
+	buffer []byte
+}
+
+func DialUDP(address string) (*UDPConn, error) {
 	returnAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
 
 	conn, err := net.DialUDP("udp", nil, returnAddr)
 	if err != nil {
 		fmt.Println("Error dialing UDP tracker:", err)
 		return nil, err
 	}
-	defer conn.Close()
+	return &UDPConn{conn: conn, buffer: make([]byte, UDP_BUFFER_SIZE)}, nil
+}
 
-	doneChan := make(chan error, 1)
-	bytesChan := make(chan []byte, 1)
-	go func() {
-		buffer := make([]byte, 1024*512) // 0.5 mb buffer
+func (c *UDPConn) Close() error {
+	return c.conn.Close()
+}
 
-		// Copy to the connection from the reader
-		_, err := io.Copy(conn, reader)
-		if err != nil {
-			doneChan <- err
-			return
-		}
+// Request sends packet and waits up to timeout for a response.
+// Packets which accept rejects (e.g. late responses to an earlier request) are skipped.
+// The returned slice is only valid until the next call to Request.
+func (c *UDPConn) Request(packet []byte, timeout time.Duration, accept func(res []byte) bool) ([]byte, error) {
+	if _, err := c.conn.Write(packet); err != nil {
+		return nil, err
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
 
-		deadline := time.Now().Add(UDP_Timeout)
-		err = conn.SetReadDeadline(deadline)
+	for {
+		nRead, err := c.conn.Read(c.buffer)
 		if err != nil {
-			doneChan <- err
-			return
+			return nil, err
 		}
-
-		nRead, addr, err := conn.ReadFrom(buffer)
-		if err != nil {
-			doneChan <- err
-			return
+		res := c.buffer[:nRead]
+		if accept == nil || accept(res) {
+			return res, nil
 		}
-		fmt.Printf("packet-received: bytes=%d from=%s\n", nRead, addr.String())
-		bytesChan <- buffer
-		doneChan <- nil
-	}()
-
-	select {
-	case err = <-doneChan:
-	case res = <-bytesChan:
+		fmt.Printf("ignoring unexpected packet: bytes=%d from=%s\n", nRead, c.conn.RemoteAddr())
 	}
-	return res, err
 }
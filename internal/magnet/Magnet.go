@@ -0,0 +1,267 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Magnet is a parsed magnet link (BEP 9, BEP 53)
+type Magnet struct {
+	InfoHash   [20]byte // v1 info hash, or for v2 only links the truncated v2 hash
+	InfoHashV2 [32]byte // zero unless the link has a urn:btmh xt (BEP 52)
+	HasV1      bool     // whether the link had a urn:btih xt
+
+	Name       string    // dn
+	Length     int64     // xl, 0 if unknown
+	Trackers   []string  // tr
+	WebSeeds   []string  // ws
+	Peers      []string  // x.pe, as host:port
+	SelectOnly Selection // so, the files to download (BEP 53)
+}
+
+// FileRange is an inclusive range of file indices
+type FileRange struct {
+	First int
+	Last  int
+}
+
+// Selection is a list of file indices and ranges of them. Ranges are kept as they are,
+// since a link can name far more files than the torrent has.
+type Selection []FileRange
+
+var (
+	ErrNotMagnet       = errors.New("not a magnet link")
+	ErrNoInfoHash      = errors.New("magnet link has no info hash")
+	ErrInvalidInfoHash = errors.New("invalid info hash")
+	ErrConflict        = errors.New("conflicting info hashes")
+	ErrInvalidParam    = errors.New("invalid parameter")
+)
+
+// Error describes what was wrong with a magnet link. Kind is one of the Err values above.
+type Error struct {
+	Param string
+	Value string
+	Kind  error
+}
+
+func (e *Error) Error() string {
+	if e.Param == "" {
+		return fmt.Sprintf("magnet: %s", e.Kind)
+	}
+	return fmt.Sprintf("magnet: %s %s=%q", e.Kind, e.Param, e.Value)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// Parse reads a magnet:? uri
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "magnet" {
+		return nil, &Error{Kind: ErrNotMagnet}
+	}
+	return FromQuery(u.Query())
+}
+
+// FromQuery reads the parameters of a magnet link, as passed to /download
+func FromQuery(query url.Values) (*Magnet, error) {
+	m := &Magnet{Name: query.Get("dn")}
+
+	for _, xt := range query["xt"] {
+		if err := m.parseXT(xt); err != nil {
+			return nil, err
+		}
+	}
+	if !m.HasV1 && m.InfoHashV2 == [32]byte{} {
+		return nil, &Error{Kind: ErrNoInfoHash}
+	}
+	if !m.HasV1 {
+		// v2 swarms use the truncated hash in place of the info hash
+		copy(m.InfoHash[:], m.InfoHashV2[:20])
+	}
+
+	if xl := query.Get("xl"); xl != "" {
+		length, err := strconv.ParseInt(xl, 10, 64)
+		if err != nil || length < 0 {
+			return nil, &Error{Param: "xl", Value: xl, Kind: ErrInvalidParam}
+		}
+		m.Length = length
+	}
+	for _, tr := range query["tr"] {
+		// Trackers we can't talk to, like websocket ones, are left out rather than refusing the link
+		if !validURL(tr, "http", "https", "udp") {
+			fmt.Println("Skipping unsupported tracker", tr)
+			continue
+		}
+		m.Trackers = append(m.Trackers, tr)
+	}
+	for _, ws := range query["ws"] {
+		if !validURL(ws, "http", "https") {
+			return nil, &Error{Param: "ws", Value: ws, Kind: ErrInvalidParam}
+		}
+		m.WebSeeds = append(m.WebSeeds, ws)
+	}
+	for _, pe := range query["x.pe"] {
+		host, port, err := net.SplitHostPort(pe)
+		if n, portErr := strconv.ParseUint(port, 10, 16); err != nil || portErr != nil || n == 0 || host == "" {
+			return nil, &Error{Param: "x.pe", Value: pe, Kind: ErrInvalidParam}
+		}
+		m.Peers = append(m.Peers, pe)
+	}
+	if so := query.Get("so"); so != "" {
+		selectOnly, err := parseSelectOnly(so)
+		if err != nil {
+			return nil, &Error{Param: "so", Value: so, Kind: ErrInvalidParam}
+		}
+		m.SelectOnly = selectOnly
+	}
+	return m, nil
+}
+
+// parseXT reads an exact topic. Topics other than BitTorrent info hashes are ignored.
+func (m *Magnet) parseXT(xt string) error {
+	switch {
+	case strings.HasPrefix(xt, "urn:btih:"):
+		encoded := strings.TrimPrefix(xt, "urn:btih:")
+		var infoHash []byte
+		var err error
+		switch len(encoded) {
+		case 40:
+			infoHash, err = hex.DecodeString(encoded)
+		case 32:
+			infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		default:
+			err = ErrInvalidInfoHash
+		}
+		if err != nil || len(infoHash) != 20 {
+			return &Error{Param: "xt", Value: xt, Kind: ErrInvalidInfoHash}
+		}
+		if m.HasV1 && [20]byte(infoHash) != m.InfoHash {
+			return &Error{Param: "xt", Value: xt, Kind: ErrConflict}
+		}
+		copy(m.InfoHash[:], infoHash)
+		m.HasV1 = true
+
+	case strings.HasPrefix(xt, "urn:btmh:"):
+		// A multihash: 0x12 for SHA256, then 0x20 for the 32 byte length
+		multihash, err := hex.DecodeString(strings.TrimPrefix(xt, "urn:btmh:"))
+		if err != nil || len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+			return &Error{Param: "xt", Value: xt, Kind: ErrInvalidInfoHash}
+		}
+		if m.InfoHashV2 != [32]byte{} && [32]byte(multihash[2:]) != m.InfoHashV2 {
+			return &Error{Param: "xt", Value: xt, Kind: ErrConflict}
+		}
+		copy(m.InfoHashV2[:], multihash[2:])
+	}
+	return nil
+}
+
+func validURL(rawURL string, schemes ...string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSelectOnly reads a list of file indices and inclusive ranges, like "0,2,4-6"
+func parseSelectOnly(so string) (Selection, error) {
+	var selection Selection
+	for _, item := range strings.Split(so, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, ErrInvalidParam
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, ErrInvalidParam
+			}
+		}
+		selection = append(selection, FileRange{First: start, Last: end})
+	}
+	return selection, nil
+}
+
+// Files lists the selected indices of a torrent with count files, in order
+func (s Selection) Files(count int) []int {
+	selected := make([]bool, count)
+	for _, r := range s {
+		for i := r.First; i <= min(r.Last, count-1); i++ {
+			selected[i] = true
+		}
+	}
+	var files []int
+	for i, ok := range selected {
+		if ok {
+			files = append(files, i)
+		}
+	}
+	return files
+}
+
+// String writes the selection as given in so, with overlapping and adjacent ranges joined
+func (s Selection) String() string {
+	ranges := append(Selection{}, s...)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].First < ranges[j].First })
+	var items []string
+	for i := 0; i < len(ranges); {
+		r := ranges[i]
+		i++
+		for i < len(ranges) && ranges[i].First <= r.Last+1 {
+			r.Last = max(r.Last, ranges[i].Last)
+			i++
+		}
+		if r.First == r.Last {
+			items = append(items, strconv.Itoa(r.First))
+		} else {
+			items = append(items, fmt.Sprintf("%d-%d", r.First, r.Last))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// String formats the magnet link. The xt parameters are kept unescaped and first, as some clients expect.
+func (m *Magnet) String() string {
+	var xts []string
+	if m.HasV1 {
+		xts = append(xts, "xt=urn:btih:"+hex.EncodeToString(m.InfoHash[:]))
+	}
+	if m.InfoHashV2 != [32]byte{} {
+		xts = append(xts, "xt=urn:btmh:1220"+hex.EncodeToString(m.InfoHashV2[:]))
+	}
+
+	query := url.Values{}
+	if m.Name != "" {
+		query.Set("dn", m.Name)
+	}
+	if m.Length > 0 {
+		query.Set("xl", strconv.FormatInt(m.Length, 10))
+	}
+	query["tr"] = m.Trackers
+	query["ws"] = m.WebSeeds
+	query["x.pe"] = m.Peers
+	if len(m.SelectOnly) > 0 {
+		query.Set("so", m.SelectOnly.String())
+	}
+
+	uri := "magnet:?" + strings.Join(xts, "&")
+	if params := query.Encode(); params != "" {
+		uri += "&" + params
+	}
+	return uri
+}
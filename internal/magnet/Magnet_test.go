@@ -0,0 +1,111 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const hexHash = "e7d80892bbce0bdd761d38781da480d9e64b1848"
+const v2Hash = "6c4a1a6d0a0f1b0c3e3e7a6f8c9c4c5b7f0a1e2d3c4b5a69788796a5b4c3d2e1"
+
+func TestParse(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:1220" + v2Hash +
+		"&dn=A+Film&xl=1234&tr=udp%3A%2F%2Ftracker.example.com%3A1337&tr=http%3A%2F%2Fb.example.com%2Fannounce" +
+		"&ws=http%3A%2F%2Fmirror.example.com%2F&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:51413&x.pe=peer.example.com:6881" +
+		"&so=0,2,4-6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(m.InfoHash[:]) != hexHash || !m.HasV1 || hex.EncodeToString(m.InfoHashV2[:]) != v2Hash {
+		t.Errorf("unexpected info hashes %x %x", m.InfoHash, m.InfoHashV2)
+	}
+	if m.Name != "A Film" || m.Length != 1234 || len(m.Trackers) != 2 || len(m.WebSeeds) != 1 || len(m.Peers) != 3 {
+		t.Errorf("unexpected magnet %+v", m)
+	}
+	if files := m.SelectOnly.Files(10); len(files) != 5 || files[2] != 4 || files[4] != 6 {
+		t.Errorf("unexpected so %v", files)
+	}
+
+	// Formatting and parsing again gives the same link
+	again, err := Parse(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != m.String() {
+		t.Errorf("round trip changed magnet:\n%s\n%s", m.String(), again.String())
+	}
+}
+
+func TestParseBase32(t *testing.T) {
+	hash, _ := hex.DecodeString(hexHash)
+	// Some clients lowercase the base32
+	encoded := strings.ToLower(base32.StdEncoding.EncodeToString(hash))
+	m, err := Parse("magnet:?xt=urn:btih:" + encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(m.InfoHash[:]) != hexHash {
+		t.Errorf("unexpected info hash %x", m.InfoHash)
+	}
+}
+
+func TestParseV2Only(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btmh:1220" + v2Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.HasV1 || hex.EncodeToString(m.InfoHash[:]) != v2Hash[:40] {
+		t.Errorf("expected truncated v2 hash, got %x", m.InfoHash)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for uri, kind := range map[string]error{
+		"http://example.com":                                             ErrNotMagnet,
+		"magnet:?dn=nothing":                                             ErrNoInfoHash,
+		"magnet:?xt=urn:sha1:abc":                                        ErrNoInfoHash,
+		"magnet:?xt=urn:btih:" + hexHash[:39]:                            ErrInvalidInfoHash,
+		"magnet:?xt=urn:btih:zz" + hexHash[2:]:                           ErrInvalidInfoHash,
+		"magnet:?xt=urn:btmh:1120" + v2Hash:                              ErrInvalidInfoHash,
+		"magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btih:" + v2Hash[:40]: ErrConflict,
+		"magnet:?xt=urn:btih:" + hexHash + "&ws=ftp://a/b":               ErrInvalidParam,
+		"magnet:?xt=urn:btih:" + hexHash + "&x.pe=10.0.0.1":              ErrInvalidParam,
+		"magnet:?xt=urn:btih:" + hexHash + "&x.pe=10.0.0.1:0":            ErrInvalidParam,
+		"magnet:?xt=urn:btih:" + hexHash + "&xl=-1":                      ErrInvalidParam,
+		"magnet:?xt=urn:btih:" + hexHash + "&so=3-1":                     ErrInvalidParam,
+		"magnet:?xt=urn:btih:" + hexHash + "&so=a":                       ErrInvalidParam,
+	} {
+		_, err := Parse(uri)
+		var magnetErr *Error
+		if !errors.As(err, &magnetErr) || !errors.Is(err, kind) {
+			t.Errorf("Parse(%q) = %v, expected %v", uri, err, kind)
+		}
+	}
+}
+
+func TestUnsupportedTrackersSkipped(t *testing.T) {
+	m, err := Parse("magnet:?xt=urn:btih:" + hexHash + "&tr=wss%3A%2F%2Ftracker.openwebtorrent.com&tr=tracker&tr=udp%3A%2F%2Fa.example.com%3A1337")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Trackers) != 1 || m.Trackers[0] != "udp://a.example.com:1337" {
+		t.Errorf("expected only the udp tracker, got %v", m.Trackers)
+	}
+}
+
+func TestSelectOnlyRanges(t *testing.T) {
+	// A huge range is kept as it is, and only expanded up to the torrent's files
+	m, err := Parse("magnet:?xt=urn:btih:" + hexHash + "&so=2-20000000,0,1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := m.SelectOnly.Files(4); len(files) != 4 || files[0] != 0 || files[3] != 3 {
+		t.Errorf("unexpected files %v", files)
+	}
+	if so := m.SelectOnly.String(); so != "0-20000000" {
+		t.Errorf("unexpected so %s", so)
+	}
+}
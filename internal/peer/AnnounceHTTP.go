@@ -1,7 +1,10 @@
 package peer
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -13,45 +16,138 @@ import (
 const protocol_id uint64 = 0x41727101980
 
 type HTTPTrackerResponse struct {
-	interval   int
-	incomplete int
-	complete   int
-	downloaded int
-	peers      []byte
+	FailureReason  string // when set, no other keys are present
+	WarningMessage string
+	Interval       int
+	MinInterval    int
+	TrackerID      string // to be sent back on later announces
+	Complete       int    // seeders
+	Incomplete     int    // leechers
+	Peers          []Peer
 }
 
-func (pm *PeerManager) announceHTTP(tracker url.URL, port uint16) (peers []Peer, err error) {
+// ParseHTTPTrackerResponse decodes an http tracker's announce response.
+// The peers key is either a compact string (BEP 23) or a list of {ip, port, peer id} dictionaries,
+// so the response has to be decoded generically.
+func ParseHTTPTrackerResponse(r io.Reader) (res HTTPTrackerResponse, err error) {
+	data, err := bencode.Decode(r)
+	if err != nil {
+		return res, err
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return res, fmt.Errorf("malformed tracker response")
+	}
+
+	res.FailureReason, _ = dict["failure reason"].(string)
+	if res.FailureReason != "" {
+		return res, nil
+	}
+	res.WarningMessage, _ = dict["warning message"].(string)
+	res.Interval = bencodeInt(dict["interval"])
+	res.MinInterval = bencodeInt(dict["min interval"])
+	res.TrackerID, _ = dict["tracker id"].(string)
+	res.Complete = bencodeInt(dict["complete"])
+	res.Incomplete = bencodeInt(dict["incomplete"])
+
+	switch peers := dict["peers"].(type) {
+	case string:
+		res.Peers, err = Unmarshal([]byte(peers))
+	case []interface{}:
+		res.Peers = unmarshalPeerDicts(peers)
+	}
+	return res, err
+}
+
+// unmarshalPeerDicts reads the non-compact peer list, skipping any peer we can't use
+func unmarshalPeerDicts(list []interface{}) []Peer {
+	peers := make([]Peer, 0, len(list))
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ipString, _ := dict["ip"].(string)
+		ip := net.ParseIP(ipString)
+		port := bencodeInt(dict["port"])
+		if ip == nil || port <= 0 || port > 65535 {
+			continue
+		}
+		peers = append(peers, Peer{IP: ip, Port: uint16(port)})
+	}
+	return peers
+}
+
+func (pm *PeerManager) announceHTTP(ctx context.Context, tracker url.URL, port uint16, event AnnounceEvent) (res AnnounceResponse, err error) {
 	// Build the tracker URL
-	trackerURL, err := pm.buildTrackerURL(tracker, port)
+	trackerURL, err := pm.buildTrackerURL(tracker, port, event)
 	if err != nil {
 		fmt.Println("Error building tracker URL:", err)
 		return
 	}
 	// Build a client to talk to the tracker
-	trackerClient := http.Client{Timeout: time.Second * 15}
-	res, err := trackerClient.Get(trackerURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerURL, nil)
 	if err != nil {
-		return nil, err
+		return res, err
+	}
+	trackerClient := http.Client{Timeout: pm.TrackerTimeout}
+	httpRes, err := trackerClient.Do(req)
+	if err != nil {
+		return res, err
 	}
 
-	defer res.Body.Close()
+	defer httpRes.Body.Close()
 
 	// decode the bEncode response
-	data := HTTPTrackerResponse{}
-	err = bencode.Unmarshal(res.Body, &data)
-	// Unmarshall the peers
-	peers, err = Unmarshal(data.peers)
-	return
+	data, err := ParseHTTPTrackerResponse(httpRes.Body)
+	if err != nil {
+		return res, err
+	}
+	if data.FailureReason != "" {
+		return res, fmt.Errorf("tracker error: %s", data.FailureReason)
+	}
+	if data.WarningMessage != "" {
+		fmt.Println("Tracker warning from", tracker.Hostname(), data.WarningMessage)
+	}
+	if data.TrackerID != "" {
+		pm.mu.Lock()
+		pm.trackerIDs[tracker.String()] = data.TrackerID
+		pm.mu.Unlock()
+	}
+
+	res = AnnounceResponse{
+		Interval:    time.Duration(data.Interval) * time.Second,
+		MinInterval: time.Duration(data.MinInterval) * time.Second,
+		Leechers:    data.Incomplete,
+		Seeders:     data.Complete,
+		Peers:       data.Peers,
+		Warning:     data.WarningMessage,
+	}
+	return res, nil
 }
 
-func (pm *PeerManager) buildTrackerURL(trackerURL url.URL, port uint16) (string, error) {
-	params := url.Values{
-		"info_hash":  []string{string(pm.InfoHash[:])},
-		"peer_id":    []string{string(pm.PeerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
+func (pm *PeerManager) buildTrackerURL(trackerURL url.URL, port uint16, event AnnounceEvent) (string, error) {
+	stats := pm.stats()
+
+	pm.mu.Lock()
+	trackerID := pm.trackerIDs[trackerURL.String()]
+	pm.mu.Unlock()
+
+	// Keep any existing query params, private trackers put the passkey there
+	params := trackerURL.Query()
+	params.Set("info_hash", string(pm.InfoHash[:]))
+	params.Set("peer_id", string(pm.PeerID[:]))
+	params.Set("port", strconv.Itoa(int(port)))
+	params.Set("uploaded", strconv.FormatUint(stats.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatUint(stats.Downloaded, 10))
+	params.Set("left", strconv.FormatUint(stats.Left, 10))
+	params.Set("numwant", strconv.Itoa(NUM_WANT))
+	params.Set("compact", "1")
+	if event != EventNone {
+		params.Set("event", event.String())
+	}
+	if trackerID != "" {
+		params.Set("trackerid", trackerID)
 	}
 	trackerURL.RawQuery = params.Encode()
 	return trackerURL.String(), nil
@@ -0,0 +1,92 @@
+package peer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestParseHTTPTrackerResponseCompact(t *testing.T) {
+	body := "d8:completei5e10:incompletei3e8:intervali1800e12:min intervali60e5:peers12:" +
+		"\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2" + "10:tracker id3:abce"
+	res, err := ParseHTTPTrackerResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Interval != 1800 || res.MinInterval != 60 || res.Complete != 5 || res.Incomplete != 3 || res.TrackerID != "abc" {
+		t.Errorf("unexpected response %+v", res)
+	}
+	if len(res.Peers) != 2 || res.Peers[1].String() != "10.0.0.2:6882" {
+		t.Errorf("unexpected peers %v", res.Peers)
+	}
+}
+
+func TestParseHTTPTrackerResponseDictionaryPeers(t *testing.T) {
+	body := "d8:intervali900e5:peersl" +
+		"d2:ip8:10.0.0.17:peer id20:-XX0001-0123456789ab4:porti6881ee" +
+		"d2:ip11:2001:db8::14:porti51413ee" +
+		"d2:ip11:example.com4:porti6881ee" +
+		"ee"
+	res, err := ParseHTTPTrackerResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The hostname can't be used as a peer
+	if len(res.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %v", res.Peers)
+	}
+	if res.Peers[0].String() != "10.0.0.1:6881" || res.Peers[1].Port != 51413 {
+		t.Errorf("unexpected peers %v", res.Peers)
+	}
+}
+
+func TestAnnounceHTTP(t *testing.T) {
+	announces := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces++
+		query := r.URL.Query()
+		if query.Get("passkey") != "secret" {
+			t.Errorf("expected passkey to be kept, got %q", r.URL.RawQuery)
+		}
+		switch announces {
+		case 1:
+			if query.Get("event") != "started" || query.Get("trackerid") != "" {
+				t.Errorf("unexpected first announce %q", r.URL.RawQuery)
+			}
+			bencode.Marshal(w, map[string]interface{}{
+				"interval":        1800,
+				"tracker id":      "abc",
+				"warning message": "slow down",
+				"peers":           "\x0a\x00\x00\x01\x1a\xe1",
+			})
+		case 2:
+			if query.Get("trackerid") != "abc" {
+				t.Errorf("expected tracker id to be sent back, got %q", r.URL.RawQuery)
+			}
+			bencode.Marshal(w, map[string]interface{}{"failure reason": "unregistered torrent"})
+		}
+	}))
+	defer server.Close()
+
+	tracker, _ := url.Parse(server.URL + "/announce?passkey=secret")
+	pm := NewPeerManager(make([]byte, 20), make([]byte, 20), nil)
+
+	res, err := pm.Announce(context.Background(), tracker, 6881, EventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Interval != 30*time.Minute || res.Warning != "slow down" || len(res.Peers) != 1 {
+		t.Errorf("unexpected response %+v", res)
+	}
+
+	_, err = pm.Announce(context.Background(), tracker, 6881, EventNone)
+	if err == nil || !strings.Contains(err.Error(), "unregistered torrent") {
+		t.Errorf("expected failure reason, got %v", err)
+	}
+}
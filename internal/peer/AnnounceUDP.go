@@ -1,24 +1,69 @@
 package peer
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/url"
+	"sync"
+	"time"
 	"torrent-pi/internal/lib"
 )
 
-// Implement announce UDP request
-func (pm *PeerManager) announceUDP(tracker url.URL, port uint16) (peers []Peer, err error) {
-	t_stats := TorrentStats{}
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+// A connection ID can be reused for a minute after the tracker sent it (BEP 15)
+const CONNECTION_ID_TTL = time.Minute
+
+type connectionID struct {
+	id      uint64
+	expires time.Time
+}
+
+// Connection IDs by tracker host
+var connectionIDs = struct {
+	sync.Mutex
+	ids map[string]connectionID
+}{ids: map[string]connectionID{}}
+
+func cachedConnectionID(host string) (uint64, bool) {
+	connectionIDs.Lock()
+	defer connectionIDs.Unlock()
+	c, ok := connectionIDs.ids[host]
+	if !ok || time.Now().After(c.expires) {
+		return 0, false
+	}
+	return c.id, true
+}
 
-	// Implement UDP client that sends a UDP packet to the tracker
-	// and waits for a response.
+func cacheConnectionID(host string, id uint64) {
+	connectionIDs.Lock()
+	defer connectionIDs.Unlock()
+	connectionIDs.ids[host] = connectionID{id: id, expires: time.Now().Add(CONNECTION_ID_TTL)}
+}
 
-	/* Step 1: Connect */
+func forgetConnectionID(host string) {
+	connectionIDs.Lock()
+	defer connectionIDs.Unlock()
+	delete(connectionIDs.ids, host)
+}
 
+// matchTransaction accepts only responses to the given transaction
+func matchTransaction(transactionID uint32) func([]byte) bool {
+	return func(res []byte) bool {
+		return len(res) >= 8 && binary.BigEndian.Uint32(res[4:8]) == transactionID
+	}
+}
+
+// udpConnect obtains a connection ID from a udp tracker, which must be sent with every following request
+func udpConnect(conn *lib.UDPConn, timeout time.Duration) (connectionID uint64, err error) {
 	// Generate transaction ID
 	transactionID := rand.Uint32()
 
@@ -28,73 +73,132 @@ func (pm *PeerManager) announceUDP(tracker url.URL, port uint16) (peers []Peer,
 	// Write the protocol ID
 	binary.BigEndian.PutUint64(packet[0:8], protocol_id)
 	// Write the action
-	binary.BigEndian.PutUint32(packet[8:12], uint32(0))
+	binary.BigEndian.PutUint32(packet[8:12], udpActionConnect)
 	// Write the transaction ID
 	binary.BigEndian.PutUint32(packet[12:16], transactionID)
 
-	reader := bytes.NewReader(packet)
-
 	// Send the UDP packet
-	res, err := lib.UDPRequest(tracker.Host, reader)
+	res, err := conn.Request(packet, timeout, matchTransaction(transactionID))
+	if err != nil {
+		return
+	}
+	res, err = parseUDPResponse(res, udpActionConnect)
 	if err != nil {
 		return
 	}
+	if len(res) < 16 {
+		return 0, fmt.Errorf("connect response too short")
+	}
+	connectionID = binary.BigEndian.Uint64(res[8:16])
 
-	// Parse the response
-	res_action := binary.BigEndian.Uint32(res[0:4])
-	res_transactionID := binary.BigEndian.Uint32(res[4:8])
-	connectionID := binary.BigEndian.Uint64(res[8:16])
+	fmt.Println("Successfully connected to UDP tracker")
+	return connectionID, nil
+}
 
-	if res_action != 0 {
-		return peers, fmt.Errorf("action not 0")
+// parseUDPResponse checks the response is for the expected action, and reads the tracker's error message if not
+func parseUDPResponse(res []byte, action uint32) ([]byte, error) {
+	res_action := binary.BigEndian.Uint32(res[0:4])
+	if res_action == udpActionError {
+		return nil, fmt.Errorf("tracker error: %s", string(res[8:]))
 	}
+	if res_action != action {
+		return nil, fmt.Errorf("expected action %d, got %d", action, res_action)
+	}
+	return append([]byte(nil), res...), nil
+}
 
-	if res_transactionID != transactionID {
-		return peers, fmt.Errorf("transaction ID not equal")
+// udpTrackerRequest sends a request to a udp tracker, retransmitting it until the tracker answers or ctx is done.
+// firstTimeout is how long to wait before the first retransmission, usually lib.UDP_TIMEOUT.
+// body is everything after the connection ID, action and transaction ID.
+// We connect first whenever we don't hold an unexpired connection ID for the tracker.
+func udpTrackerRequest(ctx context.Context, tracker url.URL, action uint32, body []byte, firstTimeout time.Duration) (res []byte, err error) {
+	conn, err := lib.DialUDP(tracker.Host)
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
+	// Closing the connection wakes up a request waiting on it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for n := 0; n <= lib.UDP_MAX_RETRANSMITS; n++ {
+		timeout := lib.RetransmitTimeout(firstTimeout, n)
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = min(timeout, time.Until(deadline))
+		}
+		if ctx.Err() != nil || timeout <= 0 {
+			break
+		}
 
-	fmt.Println("Successfully connected to UDP tracker")
+		connectionID, ok := cachedConnectionID(tracker.Host)
+		if !ok {
+			connectionID, err = udpConnect(conn, timeout)
+			if lib.IsTimeout(err) || ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			cacheConnectionID(tracker.Host, connectionID)
+		}
 
-	/* Step 2: Announce */
+		transactionID := rand.Uint32()
+		packet := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(packet[0:8], connectionID)
+		binary.BigEndian.PutUint32(packet[8:12], action)
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		copy(packet[16:], body)
 
-	// Create Announce UDP packet
-	packet = make([]byte, 98)
-	transactionID = rand.Uint32()
+		res, err = conn.Request(packet, timeout, matchTransaction(transactionID))
+		if lib.IsTimeout(err) || ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res, err = parseUDPResponse(res, action)
+		if err != nil {
+			// The connection ID may have been rejected
+			forgetConnectionID(tracker.Host)
+		}
+		return res, err
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return nil, fmt.Errorf("no response from UDP tracker: %s", err)
+}
+
+// Implement announce UDP request
+func (pm *PeerManager) announceUDP(ctx context.Context, tracker url.URL, port uint16, event AnnounceEvent) (announce AnnounceResponse, err error) {
+	t_stats := pm.stats()
+
+	// Create Announce UDP packet body, which follows the connection ID, action & transaction ID
+	body := make([]byte, 82)
 
-	binary.BigEndian.PutUint64(packet[0:8], connectionID)
-	// action
-	binary.BigEndian.PutUint32(packet[8:12], 0x1)
-	// transactionID
-	binary.BigEndian.PutUint32(packet[12:16], transactionID)
 	// info hash
-	copy(packet[16:36], pm.InfoHash[:])
+	copy(body[0:20], pm.InfoHash[:])
 	// peer id
-	copy(packet[36:56], pm.PeerID[:])
+	copy(body[20:40], pm.PeerID[:])
 	// downloaded
-	binary.BigEndian.PutUint64(packet[56:64], t_stats.Downloaded)
+	binary.BigEndian.PutUint64(body[40:48], t_stats.Downloaded)
 	// left
-	binary.BigEndian.PutUint64(packet[64:72], t_stats.Uploaded)
+	binary.BigEndian.PutUint64(body[48:56], t_stats.Left)
 	// uploaded
-	binary.BigEndian.PutUint64(packet[72:80], 0)
+	binary.BigEndian.PutUint64(body[56:64], t_stats.Uploaded)
 	// event
-	binary.BigEndian.PutUint32(packet[80:84], 2)
+	binary.BigEndian.PutUint32(body[64:68], uint32(event))
 	// IP address
-	binary.BigEndian.PutUint32(packet[84:88], 0)
+	binary.BigEndian.PutUint32(body[68:72], 0)
 	// key
-	binary.BigEndian.PutUint32(packet[88:92], 0)
+	binary.BigEndian.PutUint32(body[72:76], 0)
 	// num want
-	binary.BigEndian.PutUint32(packet[92:96], rand.Uint32())
+	binary.BigEndian.PutUint32(body[76:80], NUM_WANT)
 	// port
-	binary.BigEndian.PutUint16(packet[96:98], uint16(port))
+	binary.BigEndian.PutUint16(body[80:82], uint16(port))
 
 	if tracker.Path != "" || tracker.RawQuery != "" {
-		// Add URLData extension to packet
-		URLData := make([]byte, 2+len(tracker.Path)+len(tracker.RawQuery))
-		// Add Option-type
-		URLData[0] = byte(0x2)
-		// Add URLData length
-		URLData[1] = byte(len(tracker.Path) + len(tracker.RawQuery))
-		// Add URLData
+		// Add URLData extension (BEP 41)
 		var data []byte
 		if tracker.Path != "" {
 			data = []byte(tracker.Path)
@@ -102,33 +206,29 @@ func (pm *PeerManager) announceUDP(tracker url.URL, port uint16) (peers []Peer,
 		if tracker.RawQuery != "" {
 			data = append(data, []byte("?"+tracker.RawQuery)...)
 		}
+		data = data[:min(len(data), 255)]
 
-		copy(URLData[2:], data)
-		// Reprovision packet to include URLData
-		packet = append(packet, URLData...)
+		// Option-type, length, then the data itself
+		body = append(body, byte(0x2), byte(len(data)))
+		body = append(body, data...)
 	}
 
 	// Send the UDP packet
-	res, err = lib.UDPRequest(tracker.Host, bytes.NewReader(packet))
+	res, err := udpTrackerRequest(ctx, tracker, udpActionAnnounce, body, pm.udpTimeout)
 	if err != nil {
-		return peers, fmt.Errorf("error reading UDP tracker: %s", err)
+		return announce, fmt.Errorf("error reading UDP tracker: %s", err)
+	}
+	if len(res) < 20 {
+		return announce, fmt.Errorf("announce response too short")
 	}
 
-	// Verify & parse the response
-	res_action = binary.BigEndian.Uint32(res[0:4])
-	res_transactionID = binary.BigEndian.Uint32(res[4:8])
+	// Parse the response
 	interval := binary.BigEndian.Uint32(res[8:12])
 	leechers := binary.BigEndian.Uint32(res[12:16])
 	seeders := binary.BigEndian.Uint32(res[16:20])
 
-	if res_action != 1 {
-		return peers, fmt.Errorf("action not Announce")
-	}
-	if res_transactionID != transactionID {
-		return peers, fmt.Errorf("transaction ID not equal")
-	}
-
-	peers = make([]Peer, leechers+seeders)
+	// The rest of the packet is the peer list, which can be shorter than leechers+seeders
+	peers := make([]Peer, (len(res)-20)/6)
 	fmt.Println("Interval", interval)
 	fmt.Println("Leechers:", leechers)
 	fmt.Println("Seeders:", seeders)
@@ -139,5 +239,11 @@ func (pm *PeerManager) announceUDP(tracker url.URL, port uint16) (peers []Peer,
 		peers[i].IP = net.IPv4(res[startIP], res[startIP+1], res[startIP+2], res[startIP+3])
 		peers[i].Port = binary.BigEndian.Uint16(res[startIP+4 : startIP+6])
 	}
-	return peers, nil
+	announce = AnnounceResponse{
+		Interval: time.Duration(interval) * time.Second,
+		Leechers: int(leechers),
+		Seeders:  int(seeders),
+		Peers:    peers,
+	}
+	return announce, nil
 }
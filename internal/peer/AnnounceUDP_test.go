@@ -0,0 +1,196 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker is a local BEP 15 tracker
+type fakeUDPTracker struct {
+	conn net.PacketConn
+
+	mu         sync.Mutex
+	connects   int
+	announces  int
+	dropFirst  int    // number of announce packets to ignore, to force retransmits
+	errMessage string // sent in reply to announces when set
+	peers      [][6]byte
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUDPTracker{conn: conn}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+	return f
+}
+
+func (f *fakeUDPTracker) url() *url.URL {
+	u, _ := url.Parse("udp://" + f.conn.LocalAddr().String() + "/announce")
+	return u
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		action := binary.BigEndian.Uint32(req[8:12])
+		transactionID := req[12:16]
+
+		f.mu.Lock()
+		var res []byte
+		switch action {
+		case udpActionConnect:
+			f.connects++
+			res = make([]byte, 16)
+			binary.BigEndian.PutUint64(res[8:16], 0xC0FFEE)
+		case udpActionAnnounce:
+			f.announces++
+			if f.dropFirst > 0 {
+				f.dropFirst--
+				f.mu.Unlock()
+				continue
+			}
+			if binary.BigEndian.Uint64(req[0:8]) != 0xC0FFEE {
+				action, res = udpActionError, append(make([]byte, 8), "bad connection id"...)
+				break
+			}
+			if f.errMessage != "" {
+				action, res = udpActionError, append(make([]byte, 8), f.errMessage...)
+				break
+			}
+			res = make([]byte, 20, 20+6*len(f.peers))
+			binary.BigEndian.PutUint32(res[8:12], 1800)
+			binary.BigEndian.PutUint32(res[12:16], 10)
+			binary.BigEndian.PutUint32(res[16:20], 90)
+			for _, p := range f.peers {
+				res = append(res, p[:]...)
+			}
+		}
+		f.mu.Unlock()
+
+		binary.BigEndian.PutUint32(res[0:4], action)
+		copy(res[4:8], transactionID)
+		// A stray packet from another transaction should be ignored by the client
+		f.conn.WriteTo([]byte{0, 0, 0, 1, 0xde, 0xad, 0xbe, 0xef}, addr)
+		f.conn.WriteTo(res, addr)
+	}
+}
+
+// newTestPeerManager retransmits quickly to the fake tracker
+func newTestPeerManager() *PeerManager {
+	pm := NewPeerManager(make([]byte, 20), make([]byte, 20), nil)
+	pm.udpTimeout = 50 * time.Millisecond
+	return pm
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.peers = [][6]byte{{10, 0, 0, 1, 0x1a, 0xe1}, {10, 0, 0, 2, 0x1a, 0xe2}}
+	f.mu.Unlock()
+
+	pm := newTestPeerManager()
+	res, err := pm.announceUDP(context.Background(), *f.url(), 6881, EventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tracker claims 100 peers, but only sent 2
+	if len(res.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(res.Peers))
+	}
+	if res.Peers[1].String() != "10.0.0.2:6882" {
+		t.Errorf("unexpected peer %s", res.Peers[1])
+	}
+	if res.Interval != 30*time.Minute || res.Seeders != 90 || res.Leechers != 10 {
+		t.Errorf("unexpected response %+v", res)
+	}
+
+	// The connection ID is reused for the next announce
+	if _, err := pm.announceUDP(context.Background(), *f.url(), 6881, EventNone); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connects != 1 {
+		t.Errorf("expected 1 connect, got %d", f.connects)
+	}
+}
+
+func TestAnnounceUDPRetransmit(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.dropFirst = 2
+	f.mu.Unlock()
+
+	pm := newTestPeerManager()
+	if _, err := pm.announceUDP(context.Background(), *f.url(), 6881, EventStarted); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.announces != 3 {
+		t.Errorf("expected 2 retransmits, got %d announces", f.announces)
+	}
+}
+
+func TestAnnounceUDPError(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.errMessage = "torrent not registered"
+	f.mu.Unlock()
+
+	pm := newTestPeerManager()
+	_, err := pm.announceUDP(context.Background(), *f.url(), 6881, EventStarted)
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Fatalf("expected tracker error message, got %v", err)
+	}
+	if _, ok := cachedConnectionID(f.url().Host); ok {
+		t.Error("expected connection ID to be forgotten after an error")
+	}
+}
+
+func TestAnnounceUDPDeadTracker(t *testing.T) {
+	// Listens, but never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tracker, _ := url.Parse("udp://" + conn.LocalAddr().String() + "/announce")
+
+	pm := newTestPeerManager()
+	pm.TrackerTimeout = 300 * time.Millisecond
+	start := time.Now()
+	if _, err := pm.Announce(context.Background(), tracker, 6881, EventStarted); err == nil {
+		t.Fatal("expected dead tracker to fail")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("announce took %s, longer than the tracker timeout", took)
+	}
+
+	// Cancelling gives up straight away
+	pm.TrackerTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := pm.Announce(ctx, tracker, 6881, EventStarted); err == nil {
+		t.Fatal("expected cancelled announce to fail")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("cancelled announce took %s", took)
+	}
+}
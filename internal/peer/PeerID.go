@@ -0,0 +1,190 @@
+package peer
+
+import (
+	"crypto/rand"
+	"strconv"
+	"strings"
+
+	"torrent-pi/internal/constants"
+)
+
+// Characters the random part of our peer IDs is drawn from. Keeping to these means the ID
+// reads the same in tracker urls, logs and json.
+const PEER_ID_CHARS = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// NewPeerID makes an Azureus-style peer ID: -MW0100- followed by 12 random characters.
+// Each session gets its own, so several of our clients in the same swarm aren't mistaken for one peer.
+func NewPeerID() [20]byte {
+	var id [20]byte
+	prefix := "-" + constants.CLIENT_ID + versionDigits(constants.VERSION) + "-"
+	copy(id[:], prefix)
+
+	// Skip bytes past the last whole multiple of len(PEER_ID_CHARS), so every character is as likely
+	limit := 256 - 256%len(PEER_ID_CHARS)
+	b := make([]byte, 1)
+	for i := len(prefix); i < len(id); {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		if int(b[0]) < limit {
+			id[i] = PEER_ID_CHARS[int(b[0])%len(PEER_ID_CHARS)]
+			i++
+		}
+	}
+	return id
+}
+
+// versionDigits turns a version like v0.1 into the four characters of an Azureus-style peer ID, 0100
+func versionDigits(version string) string {
+	digits := ""
+	for _, part := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			n = 0
+		}
+		// Numbers past 9 become letters, as in other clients
+		digits += strings.ToUpper(strconv.FormatInt(int64(n%36), 36))
+	}
+	return (digits + "0000")[:4]
+}
+
+// ClientInfo is the software a peer is running, as far as we can tell
+type ClientInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func (c ClientInfo) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Two letter codes of Azureus-style peer IDs, -XX1234-
+var azureusClients = map[string]string{
+	"AG": "Ares", "AZ": "Vuze", "BC": "BitComet", "BF": "Bitflu", "BI": "BiglyBT", "BN": "Baidu Netdisk",
+	"BT": "BitTorrent", "DE": "Deluge", "FD": "Free Download Manager", "FG": "FlashGet", "KT": "KTorrent",
+	"LT": "libtorrent", "lt": "libtorrent (Rasterbar)", "MW": constants.CLIENT_NAME, "PI": "PicoTorrent",
+	"qB": "qBittorrent", "SD": "Thunder", "TR": "Transmission", "UM": "µTorrent Mac", "UT": "µTorrent",
+	"UW": "µTorrent Web", "WW": "WebTorrent", "XL": "Xunlei",
+}
+
+// First letters of Shadow-style peer IDs, X123--
+var shadowClients = map[byte]string{
+	'A': "ABC", 'O': "Osprey Permaseed", 'Q': "BTQueue", 'R': "Tribler", 'S': "Shadow's client",
+	'T': "BitTornado", 'U': "UPnP NAT Bit Torrent",
+}
+
+// Digits of Shadow-style versions
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// IdentifyClient works out a peer's client from its peer ID, which comes in one of three styles:
+//   - Azureus: -UT355S- , a two letter client code and four version digits
+//   - Shadow: T03I--- , a client letter and up to five version digits, ended by dashes
+//   - Mainline: M7-4-1-- , the letter M and a dotted version written with dashes
+//
+// Unrecognised IDs give an empty name.
+func IdentifyClient(id [20]byte) ClientInfo {
+	s := string(id[:])
+	switch {
+	case s[0] == '-' && s[7] == '-':
+		name, ok := azureusClients[s[1:3]]
+		if !ok {
+			name = "unknown (" + s[1:3] + ")"
+		}
+		return ClientInfo{Name: name, Version: azureusVersion(s[1:3], s[3:7])}
+
+	case s[0] == 'M' && mainlineVersion(s[1:]) != "":
+		return ClientInfo{Name: "BitTorrent", Version: mainlineVersion(s[1:])}
+
+	case shadowClients[s[0]] != "" && strings.Contains(s[1:9], "--"):
+		return ClientInfo{Name: shadowClients[s[0]], Version: shadowVersion(s[1:6])}
+	}
+	return ClientInfo{}
+}
+
+// azureusVersion reads the four version digits of an Azureus-style ID
+func azureusVersion(code string, digits string) string {
+	// Transmission writes 3.00 as 300Z, the last character being the kind of build
+	if code == "TR" {
+		return digits[:1] + "." + digits[1:3]
+	}
+	// µTorrent and others end with a build letter, 355S being 3.5.5
+	if c := digits[3]; c >= 'A' && c <= 'Z' && strings.Trim(digits[:3], "0123456789") == "" {
+		digits = digits[:3]
+	}
+	parts := make([]string, 0, len(digits))
+	for _, c := range digits {
+		parts = append(parts, strconv.Itoa(strings.IndexRune(shadowDigits, c)))
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+// mainlineVersion reads 7-4-1-- as 7.4.1, or returns an empty string if s isn't written that way.
+// The version and its dashes take up 7 characters, padded with more dashes.
+func mainlineVersion(s string) string {
+	parts := strings.SplitN(s, "-", 4)
+	if len(parts) < 4 || len(parts[0])+len(parts[1])+len(parts[2])+3 > 7 {
+		return ""
+	}
+	for _, part := range parts[:3] {
+		if _, err := strconv.Atoi(part); err != nil {
+			return ""
+		}
+	}
+	return strings.Join(parts[:3], ".")
+}
+
+// shadowVersion reads the digits of a Shadow-style version up to the first dash
+func shadowVersion(digits string) string {
+	parts := []string{}
+	for _, c := range strings.TrimRight(strings.SplitN(digits, "--", 2)[0], "-") {
+		i := strings.IndexRune(shadowDigits, c)
+		if i < 0 {
+			break
+		}
+		parts = append(parts, strconv.Itoa(i))
+	}
+	return strings.Join(parts, ".")
+}
+
+// ParseClientVersion reads the v string of an extension handshake, like "qBittorrent/4.5.2", "Transmission 3.00"
+// or our own "MWOWTorrentv0.1"
+func ParseClientVersion(v string) ClientInfo {
+	v = strings.TrimSpace(v)
+	if i := strings.LastIndexAny(v, "/ "); i > 0 {
+		if version := strings.TrimPrefix(v[i+1:], "v"); version != "" && version[0] >= '0' && version[0] <= '9' {
+			return ClientInfo{Name: strings.TrimSpace(v[:i]), Version: version}
+		}
+	}
+	// A name running straight into a version
+	if i := strings.IndexAny(v, "0123456789"); i > 0 {
+		return ClientInfo{Name: strings.TrimSuffix(v[:i], "v"), Version: v[i:]}
+	}
+	return ClientInfo{Name: v}
+}
+
+// IdentifyPeer prefers the client the peer names in its extension handshake, falling back to its peer ID
+func IdentifyPeer(id [20]byte, v string) ClientInfo {
+	if v != "" {
+		return ParseClientVersion(v)
+	}
+	return IdentifyClient(id)
+}
+
+// ClientBlocked is true if the client's name matches any of the blocked families, e.g. "Xunlei".
+// Names are matched ignoring case, and a family covers all of its variants, so "µTorrent" blocks "µTorrent Mac".
+func ClientBlocked(c ClientInfo, blocked []string) bool {
+	name := strings.ToLower(c.Name)
+	for _, family := range blocked {
+		family = strings.ToLower(strings.TrimSpace(family))
+		if family != "" && strings.HasPrefix(name, family) {
+			return true
+		}
+	}
+	return false
+}
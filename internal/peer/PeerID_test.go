@@ -0,0 +1,91 @@
+package peer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewPeerID(t *testing.T) {
+	a, b := NewPeerID(), NewPeerID()
+	if !strings.HasPrefix(string(a[:]), "-MW0100-") {
+		t.Errorf("expected Azureus-style prefix, got %q", a)
+	}
+	for _, c := range a[8:] {
+		if !strings.ContainsRune(PEER_ID_CHARS, rune(c)) {
+			t.Errorf("unexpected character %q in %q", c, a)
+		}
+	}
+	if a == b {
+		t.Errorf("peer IDs should differ, both %q", a)
+	}
+}
+
+func TestVersionDigits(t *testing.T) {
+	for version, expected := range map[string]string{
+		"v0.1":       "0100",
+		"v1.2.3":     "1230",
+		"2.10.0.4":   "2A04",
+		"v1.2.3.4.5": "1234",
+		"dev":        "0000",
+	} {
+		if got := versionDigits(version); got != expected {
+			t.Errorf("%s: expected %s, got %s", version, expected, got)
+		}
+	}
+}
+
+func TestIdentifyClient(t *testing.T) {
+	for id, expected := range map[string]ClientInfo{
+		"-qB4520-abcdefghijkl":         {"qBittorrent", "4.5.2"},
+		"-TR300Z-abcdefghijkl":         {"Transmission", "3.00"},
+		"-UT355S-abcdefghijkl":         {"µTorrent", "3.5.5"},
+		"-lt0D60-abcdefghijkl":         {"libtorrent (Rasterbar)", "0.13.6"},
+		"-ZZ1000-abcdefghijkl":         {"unknown (ZZ)", "1.0"},
+		"M7-4-1--abcdefghijkl":         {"BitTorrent", "7.4.1"},
+		"M4-10-3-abcdefghijkl":         {"BitTorrent", "4.10.3"},
+		"T03I--abcdefghijklmn":         {"BitTornado", "0.3.18"},
+		"S58B-----abcdefghijk":         {"Shadow's client", "5.8.11"},
+		"\x00\x01random-bytes\xff\xfe": {},
+	} {
+		var peerID [20]byte
+		copy(peerID[:], id)
+		if got := IdentifyClient(peerID); got != expected {
+			t.Errorf("%q: expected %+v, got %+v", id, expected, got)
+		}
+	}
+}
+
+func TestParseClientVersion(t *testing.T) {
+	for v, expected := range map[string]ClientInfo{
+		"qBittorrent/4.5.2":     {"qBittorrent", "4.5.2"},
+		"Transmission 3.00":     {"Transmission", "3.00"},
+		"µTorrent Web 1.2":      {"µTorrent Web", "1.2"},
+		"libtorrent/v2.0.9":     {"libtorrent", "2.0.9"},
+		"MWOWTorrentv0.1":       {"MWOWTorrent", "0.1"},
+		"Free Download Manager": {"Free Download Manager", ""},
+	} {
+		if got := ParseClientVersion(v); got != expected {
+			t.Errorf("%q: expected %+v, got %+v", v, expected, got)
+		}
+	}
+
+	var id [20]byte
+	copy(id[:], "-UT355S-abcdefghijkl")
+	if got := IdentifyPeer(id, "BitTorrent 7.10.5"); got.Name != "BitTorrent" {
+		t.Errorf("expected the extension handshake to win, got %+v", got)
+	}
+}
+
+func TestClientBlocked(t *testing.T) {
+	blocked := []string{"xunlei", " µTorrent "}
+	for client, expected := range map[ClientInfo]bool{
+		{"Xunlei", "0.0.1"}:  true,
+		{"µTorrent Mac", ""}: true,
+		{"qBittorrent", ""}:  false,
+		{}:                   false,
+	} {
+		if ClientBlocked(client, blocked) != expected {
+			t.Errorf("%+v: expected blocked %v", client, expected)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package peer
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"torrent-pi/internal/lib"
 )
 
 // Manages peers
@@ -28,46 +33,84 @@ const UNKNOWN PeerStatus = 0
 const GOOD PeerStatus = 1
 const BAD PeerStatus = 2
 
-var lock sync.Mutex
+// BANNED peers sent us corrupt data and are never used again
+const BANNED PeerStatus = 3
+
+// When the number of usable peers drops below this, trackers are asked for more
+const LOW_PEER_THRESHOLD = 5
 
 type PeerState struct {
 	peer   Peer
 	status PeerStatus
 	conns  int // connections (perhaps not needed)
 }
+
+// TorrentStats are the transfer counters reported to trackers on every announce
 type TorrentStats struct {
 	Downloaded uint64
 	Uploaded   uint64
+	Left       uint64
 }
 
 type PeerManager struct {
 	peers    map[string]PeerState
 	InfoHash []byte
 	PeerID   []byte
-	Trackers []*url.URL
-}
+	Tiers    Tiers
+
+	// Stats reports the torrent's transfer counters. Must be set before Start.
+	Stats func() TorrentStats
+	// How long trackers have to answer an announce or scrape
+	TrackerTimeout time.Duration
+	udpTimeout     time.Duration // before retransmitting to udp trackers
 
-func NewPeerManager(infoHash, peerId []byte, trackers []*url.URL) PeerManager {
-	pm := PeerManager{InfoHash: infoHash, PeerID: peerId, Trackers: trackers, peers: make(map[string]PeerState, 0)}
+	mu         sync.Mutex
+	scheduler  *scheduler
+	ready      chan struct{} // closed once the first peers arrive
+	readyOnce  sync.Once
+	done       chan struct{} // closed by Stop
+	stopOnce   sync.Once
+	wg         sync.WaitGroup // running scheduler
+	completed  atomic.Bool
+	scrapes    []TrackerScrape   // last scrape of each tracker
+	trackerIDs map[string]string // tracker id sent by each http tracker
+}
 
-	lock.Lock()
+func NewPeerManager(infoHash, peerId []byte, tiers Tiers) *PeerManager {
+	pm := &PeerManager{
+		InfoHash:       infoHash,
+		PeerID:         peerId,
+		Tiers:          tiers,
+		TrackerTimeout: TRACKER_TIMEOUT,
+		udpTimeout:     lib.UDP_TIMEOUT,
+		peers:          make(map[string]PeerState, 0),
+		trackerIDs:     map[string]string{},
+		ready:          make(chan struct{}),
+		done:           make(chan struct{}),
+	}
 	return pm
 }
 
-func (pm PeerManager) GetPeers() []Peer {
-	peers := make([]Peer, len(pm.peers))
+func (pm *PeerManager) GetPeers() []Peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	peers := make([]Peer, 0, len(pm.peers))
 	for _, peer := range pm.peers {
-		if len(peer.peer.IP) > 0 {
+		if len(peer.peer.IP) > 0 && peer.status != BANNED {
 			peers = append(peers, peer.peer)
 		}
 	}
 	return peers
 }
 
-func (pm PeerManager) GetPeer() Peer {
+func (pm *PeerManager) GetPeer() Peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
 	var p Peer
 	for _, peer := range pm.peers {
-		if peer.status == BAD {
+		if peer.status == BAD || peer.status == BANNED {
 			continue
 		}
 		p = peer.peer
@@ -75,7 +118,10 @@ func (pm PeerManager) GetPeer() Peer {
 	return p
 }
 
-func (pm PeerManager) AddPeers(peers []Peer) {
+func (pm *PeerManager) AddPeers(peers []Peer) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
 	for _, peer := range peers {
 		// Skip if peer exists
 		if _, ok := pm.peers[peer.IP.String()]; ok || peer.IP == nil {
@@ -83,52 +129,153 @@ func (pm PeerManager) AddPeers(peers []Peer) {
 		}
 		pm.peers[peer.IP.String()] = PeerState{peer: peer}
 	}
+	if len(pm.peers) > 0 {
+		pm.readyOnce.Do(func() { close(pm.ready) })
+	}
 }
 
-func (pm PeerManager) SetPeerStatus(peerIp string, status PeerStatus) {
+func (pm *PeerManager) SetPeerStatus(peerIp string, status PeerStatus) {
+	pm.mu.Lock()
 	if _, ok := pm.peers[peerIp]; ok {
 		temp := pm.peers[peerIp]
+		if temp.status == BANNED {
+			// Bans are permanent
+			pm.mu.Unlock()
+			return
+		}
 		temp.status = status
 		pm.peers[peerIp] = temp
 		fmt.Printf("Peer %v status changed to %v\n", peerIp, pm.peers[peerIp].status)
 	} else {
 		fmt.Println("Err: Unable to find peer", peerIp)
 	}
+	pm.mu.Unlock()
+
+	if status == BAD || status == BANNED {
+		pm.checkPeerCount()
+	}
 }
 
-func (pm PeerManager) DropPeer(peerIp string) {
+func (pm *PeerManager) DropPeer(peerIp string) {
+	pm.mu.Lock()
 	if _, ok := pm.peers[peerIp]; ok {
 		temp := pm.peers[peerIp]
 		temp.conns = 0
 		pm.peers[peerIp] = temp
 	}
+	pm.mu.Unlock()
+
+	pm.checkPeerCount()
 }
 
-func (pm PeerManager) Start(port uint16) {
-	fmt.Println("Announcing to all trackers")
+// IsBanned reports whether the peer has been banned for sending corrupt data
+func (pm *PeerManager) IsBanned(peerIp string) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.peers[peerIp].status == BANNED
+}
 
-	var peerChan = make(chan []Peer, len(pm.Trackers))
-	defer close(peerChan)
+// usablePeers counts the peers which have not been marked bad or banned
+func (pm *PeerManager) usablePeers() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
 
-	pm.Announce(peerChan, port)
+	count := 0
+	for _, peer := range pm.peers {
+		if peer.status != BAD && peer.status != BANNED {
+			count++
+		}
+	}
+	return count
+}
 
-	for newPeers := range peerChan {
+// checkPeerCount asks the trackers for more peers when we are running low
+func (pm *PeerManager) checkPeerCount() {
+	if pm.usablePeers() < LOW_PEER_THRESHOLD {
+		pm.Reannounce()
+	}
+}
 
-		if len(pm.peers) < 1 && len(newPeers) > 0 {
-			pm.AddPeers(newPeers)
-			lock.Unlock()
-		} else {
-			pm.AddPeers(newPeers)
+// Reannounce asks the trackers for more peers as soon as the min interval allows
+func (pm *PeerManager) Reannounce() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.scheduler != nil {
+		pm.scheduler.trigger()
+	}
+}
+
+// TrackerStates returns the announce state of every tracker
+func (pm *PeerManager) TrackerStates() []TrackerState {
+	pm.mu.Lock()
+	s := pm.scheduler
+	pm.mu.Unlock()
+
+	if s == nil {
+		states := []TrackerState{}
+		for tierIndex, tier := range pm.Tiers {
+			for _, tracker := range tier {
+				states = append(states, TrackerState{URL: tracker.String(), Tier: tierIndex})
+			}
 		}
+		return states
 	}
-	// TODO announce to tracker at regular intervals, following the value of 'interval' in response
+	return s.states()
 }
 
-// Wait until the peerManager has found at least 1 peer before proceeding with execution
-func (pm PeerManager) WaitReady() {
+func (pm *PeerManager) stats() TorrentStats {
+	if pm.Stats == nil {
+		return TorrentStats{}
+	}
+	return pm.Stats()
+}
+
+// Completed tells every tracker that the download has finished
+func (pm *PeerManager) Completed() {
+	if pm.completed.Swap(true) {
+		return
+	}
+	pm.Reannounce()
+}
 
-	// Wait for the mutex to become unlocked
-	fmt.Println("Waiting for peer Lock...")
-	lock.Lock()
-	fmt.Println("Peer Lock unlocked")
+// Start announces to the trackers, tier by tier, and keeps re-announcing on the tracker's interval until Stop is called.
+// complete should be true when we already have every piece, so trackers are never sent a completed event.
+func (pm *PeerManager) Start(port uint16, complete bool) {
+	fmt.Println("Announcing to trackers")
+
+	pm.mu.Lock()
+	select {
+	case <-pm.done:
+		pm.mu.Unlock()
+		return
+	default:
+	}
+	pm.scheduler = newScheduler(pm.Tiers, complete, func(ctx context.Context, tracker *url.URL, event AnnounceEvent) (AnnounceResponse, error) {
+		return pm.Announce(ctx, tracker, port, event)
+	})
+	pm.wg.Add(1)
+	pm.mu.Unlock()
+
+	defer pm.wg.Done()
+	pm.runScheduler(pm.scheduler)
+}
+
+// Stop halts the tracker scheduler, and waits for it to send the stopped events
+func (pm *PeerManager) Stop() {
+	pm.mu.Lock()
+	pm.stopOnce.Do(func() { close(pm.done) })
+	pm.mu.Unlock()
+
+	pm.wg.Wait()
+}
+
+// Wait until the peerManager has found at least 1 peer before proceeding with execution
+func (pm *PeerManager) WaitReady() {
+	fmt.Println("Waiting for peers...")
+	select {
+	case <-pm.ready:
+		fmt.Println("Peers ready")
+	case <-pm.done:
+	}
 }
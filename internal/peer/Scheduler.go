@@ -0,0 +1,389 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Used when a tracker does not tell us how often to announce
+const DEFAULT_INTERVAL = 30 * time.Minute
+
+// Failed announces are retried after MIN_BACKOFF, doubling on each failure up to MAX_BACKOFF
+const MIN_BACKOFF = 15 * time.Second
+const MAX_BACKOFF = 30 * time.Minute
+
+// How long trackers have, between them, to hear that we've stopped
+const STOP_TIMEOUT = 5 * time.Second
+
+// Tiers of trackers (BEP 12). Trackers in a tier are tried in order until one answers,
+// and the next tier is only used when every tracker in the tier has failed.
+type Tiers [][]*url.URL
+
+// NewTiers builds tiers from a torrent's announce and announce-list keys.
+// announce is ignored when announce-list is present.
+func NewTiers(announce string, announceList [][]string) Tiers {
+	if len(announceList) == 0 && announce != "" {
+		announceList = [][]string{{announce}}
+	}
+	tiers := make(Tiers, 0, len(announceList))
+	for _, tierList := range announceList {
+		tier := make([]*url.URL, 0, len(tierList))
+		for _, t := range tierList {
+			tracker, err := url.Parse(t)
+			if err != nil || tracker.Host == "" {
+				continue
+			}
+			tier = append(tier, tracker)
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// Trackers returns every tracker in every tier
+func (t Tiers) Trackers() []*url.URL {
+	trackers := make([]*url.URL, 0, len(t))
+	for _, tier := range t {
+		trackers = append(trackers, tier...)
+	}
+	return trackers
+}
+
+// List returns the tiers as strings, as stored in a torrent's announce-list
+func (t Tiers) List() [][]string {
+	list := make([][]string, len(t))
+	for i, tier := range t {
+		for _, tracker := range tier {
+			list[i] = append(list[i], tracker.String())
+		}
+	}
+	return list
+}
+
+// TrackerState is the announce state of a single tracker, as reported by the web api
+type TrackerState struct {
+	URL          string    `json:"url"`
+	Tier         int       `json:"tier"`
+	LastAnnounce time.Time `json:"last_announce"`
+	Error        string    `json:"error,omitempty"`
+	Warning      string    `json:"warning,omitempty"`
+	Peers        int       `json:"peers"` // number of peers returned by the last announce
+	Seeders      int       `json:"seeders"`
+	Leechers     int       `json:"leechers"`
+}
+
+// tracker holds what we know about a single tracker
+type tracker struct {
+	url          *url.URL
+	interval     time.Duration
+	minInterval  time.Duration
+	lastAnnounce time.Time
+	err          error
+	warning      string
+	peers        int
+	seeders      int
+	leechers     int
+
+	started       bool // tracker has acknowledged our started event
+	sentCompleted bool // tracker has acknowledged our completed event (or we were complete from the start)
+}
+
+// event returns the event to send with the next regular announce to this tracker
+func (t *tracker) event(completed bool) AnnounceEvent {
+	if !t.started {
+		return EventStarted
+	}
+	if completed && !t.sentCompleted {
+		return EventCompleted
+	}
+	return EventNone
+}
+
+// update records the outcome of an announce
+func (t *tracker) update(now time.Time, event AnnounceEvent, res AnnounceResponse, err error) {
+	t.lastAnnounce = now
+	t.err = err
+	if err != nil {
+		return
+	}
+	switch event {
+	case EventStarted:
+		t.started = true
+	case EventCompleted:
+		t.sentCompleted = true
+	}
+	t.warning = res.Warning
+	t.peers = len(res.Peers)
+	t.seeders = res.Seeders
+	t.leechers = res.Leechers
+	t.interval = DEFAULT_INTERVAL
+	if res.Interval > 0 {
+		t.interval = res.Interval
+	}
+	t.minInterval = res.MinInterval
+	if t.minInterval > t.interval {
+		t.minInterval = t.interval
+	}
+}
+
+// announceFunc sends a single announce to a tracker, giving up when ctx is done
+type announceFunc func(ctx context.Context, tracker *url.URL, event AnnounceEvent) (AnnounceResponse, error)
+
+// scheduler decides which tracker to announce to, and when
+type scheduler struct {
+	mu       sync.Mutex
+	tiers    [][]*tracker
+	current  *tracker // tracker which answered the last announce
+	failures int      // consecutive announces where every tier failed
+	last     time.Time
+	announce announceFunc
+
+	reannounce chan struct{}
+}
+
+// newScheduler shuffles each tier, as required by BEP 12
+func newScheduler(tiers Tiers, complete bool, announce announceFunc) *scheduler {
+	s := &scheduler{announce: announce, reannounce: make(chan struct{}, 1)}
+	for _, tier := range tiers {
+		trackers := make([]*tracker, 0, len(tier))
+		for _, u := range tier {
+			if u == nil {
+				continue
+			}
+			trackers = append(trackers, &tracker{url: u, interval: DEFAULT_INTERVAL, sentCompleted: complete})
+		}
+		rand.Shuffle(len(trackers), func(i, j int) { trackers[i], trackers[j] = trackers[j], trackers[i] })
+		if len(trackers) > 0 {
+			s.tiers = append(s.tiers, trackers)
+		}
+	}
+	return s
+}
+
+// trigger requests an early announce. Does not block if one is already pending.
+func (s *scheduler) trigger() {
+	select {
+	case s.reannounce <- struct{}{}:
+	default:
+	}
+}
+
+// backoff returns how long to wait after the given number of consecutive failures
+func backoff(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	wait := MIN_BACKOFF
+	for i := 1; i < failures; i++ {
+		wait *= 2
+		if wait >= MAX_BACKOFF {
+			return MAX_BACKOFF
+		}
+	}
+	return wait
+}
+
+// next returns how long to wait from now until the next regular announce
+func (s *scheduler) next(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last.IsZero() {
+		return 0
+	}
+	wait := DEFAULT_INTERVAL
+	if s.failures > 0 {
+		wait = backoff(s.failures)
+	} else if s.current != nil {
+		wait = s.current.interval
+	}
+	return max(s.last.Add(wait).Sub(now), 0)
+}
+
+// nextOnDemand returns how long an early announce has to wait to respect the tracker's min interval
+func (s *scheduler) nextOnDemand(now time.Time) time.Duration {
+	regular := s.next(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last.IsZero() {
+		return 0
+	}
+	var wait time.Duration
+	if s.current != nil {
+		wait = s.current.minInterval
+	}
+	if s.failures > 0 {
+		// Don't hammer trackers which are failing
+		wait = max(wait, backoff(s.failures))
+	}
+	return min(max(s.last.Add(wait).Sub(now), 0), regular)
+}
+
+// completedPending reports whether a tracker still has to be told that we completed
+func (s *scheduler) completedPending(completed bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current != nil && s.current.event(completed) == EventCompleted
+}
+
+// announceTiers announces to each tier in turn until a tracker answers, or ctx is done.
+// The tracker which answered is moved to the front of its tier.
+func (s *scheduler) announceTiers(ctx context.Context, now time.Time, completed bool) (AnnounceResponse, error) {
+	s.mu.Lock()
+	tiers := make([][]*tracker, len(s.tiers))
+	for i, tier := range s.tiers {
+		tiers[i] = append([]*tracker(nil), tier...)
+	}
+	s.mu.Unlock()
+
+	err := fmt.Errorf("no trackers")
+	for tierIndex, tier := range tiers {
+		for i, t := range tier {
+			if ctx.Err() != nil {
+				return AnnounceResponse{}, ctx.Err()
+			}
+			s.mu.Lock()
+			event := t.event(completed)
+			s.mu.Unlock()
+
+			var res AnnounceResponse
+			res, err = s.announce(ctx, t.url, event)
+
+			s.mu.Lock()
+			t.update(now, event, res, err)
+			s.last = now
+			if err != nil {
+				s.mu.Unlock()
+				fmt.Println("Error announcing", t.url.Hostname(), err)
+				continue
+			}
+			s.failures = 0
+			s.current = t
+			// Move the tracker to the front of its tier
+			copy(s.tiers[tierIndex][1:i+1], s.tiers[tierIndex][0:i])
+			s.tiers[tierIndex][0] = t
+			s.mu.Unlock()
+			return res, nil
+		}
+	}
+
+	s.mu.Lock()
+	s.failures++
+	s.current = nil
+	s.last = now
+	s.mu.Unlock()
+	return AnnounceResponse{}, fmt.Errorf("every tracker failed, last error: %s", err)
+}
+
+// stop sends a stopped event to every tracker we have started with, all at once,
+// giving up on those which haven't answered after STOP_TIMEOUT
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	var started []*tracker
+	for _, tier := range s.tiers {
+		for _, t := range tier {
+			if t.started {
+				started = append(started, t)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), STOP_TIMEOUT)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, t := range started {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.announce(ctx, t.url, EventStopped); err != nil {
+				fmt.Println("Error announcing", t.url.Hostname(), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// states returns the state of every tracker, in announce order
+func (s *scheduler) states() []TrackerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]TrackerState, 0, len(s.tiers))
+	for tierIndex, tier := range s.tiers {
+		for _, t := range tier {
+			state := TrackerState{
+				URL:          t.url.String(),
+				Tier:         tierIndex,
+				LastAnnounce: t.lastAnnounce,
+				Warning:      t.warning,
+				Peers:        t.peers,
+				Seeders:      t.seeders,
+				Leechers:     t.leechers,
+			}
+			if t.err != nil {
+				state.Error = t.err.Error()
+			}
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// runScheduler announces on the current tracker's interval until the peer manager is stopped
+func (pm *PeerManager) runScheduler(s *scheduler) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	// Announces in progress are abandoned on Stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-pm.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-pm.done:
+			// Let the trackers know we are leaving the swarm
+			s.stop()
+			return
+		case <-s.reannounce:
+			// Reschedule to the earliest time the tracker allows.
+			// A pending completed event is sent straight away.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if s.completedPending(pm.completed.Load()) {
+				timer.Reset(0)
+			} else {
+				timer.Reset(s.nextOnDemand(time.Now()))
+			}
+			continue
+		case <-timer.C:
+		}
+
+		res, err := s.announceTiers(ctx, time.Now(), pm.completed.Load())
+		if err != nil {
+			fmt.Println("Error announcing:", err)
+		} else {
+			fmt.Printf("%d peers, %d seeders, %d leechers\n", len(res.Peers), res.Seeders, res.Leechers)
+			pm.AddPeers(res.Peers)
+		}
+		timer.Reset(s.next(time.Now()))
+	}
+}
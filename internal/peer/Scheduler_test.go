@@ -0,0 +1,185 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	expected := map[int]time.Duration{
+		0:  0,
+		1:  15 * time.Second,
+		2:  30 * time.Second,
+		3:  time.Minute,
+		20: MAX_BACKOFF,
+	}
+	for failures, wait := range expected {
+		if got := backoff(failures); got != wait {
+			t.Errorf("backoff(%d) = %s, expected %s", failures, got, wait)
+		}
+	}
+}
+
+// fakeAnnounce records announces and fails for any tracker in failing
+type fakeAnnounce struct {
+	mu        sync.Mutex
+	failing   map[string]bool
+	announces []string
+	events    []AnnounceEvent
+	res       AnnounceResponse
+}
+
+func (f *fakeAnnounce) announce(ctx context.Context, tracker *url.URL, event AnnounceEvent) (AnnounceResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.announces = append(f.announces, tracker.Host)
+	f.events = append(f.events, event)
+	if f.failing[tracker.Host] {
+		return AnnounceResponse{}, errors.New("timeout")
+	}
+	return f.res, nil
+}
+
+func TestSchedulerIntervals(t *testing.T) {
+	f := &fakeAnnounce{res: AnnounceResponse{Interval: 30 * time.Minute, MinInterval: 5 * time.Minute}}
+	s := newScheduler(NewTiers("udp://a:1337/announce", nil), false, f.announce)
+	now := time.Now()
+
+	if wait := s.next(now); wait != 0 {
+		t.Fatalf("first announce should be immediate, got %s", wait)
+	}
+
+	s.announceTiers(context.Background(), now, false)
+	if wait := s.next(now); wait != 30*time.Minute {
+		t.Errorf("expected regular announce after interval, got %s", wait)
+	}
+	if wait := s.nextOnDemand(now.Add(time.Minute)); wait != 4*time.Minute {
+		t.Errorf("expected on demand announce to respect min interval, got %s", wait)
+	}
+	if wait := s.nextOnDemand(now.Add(10 * time.Minute)); wait != 0 {
+		t.Errorf("expected immediate on demand announce after min interval, got %s", wait)
+	}
+
+	f.failing = map[string]bool{"a:1337": true}
+	s.announceTiers(context.Background(), now, false)
+	s.announceTiers(context.Background(), now, false)
+	if wait := s.next(now); wait != 30*time.Second {
+		t.Errorf("expected backoff after 2 failures, got %s", wait)
+	}
+	if wait := s.nextOnDemand(now); wait != 30*time.Second {
+		t.Errorf("expected on demand announce to respect backoff, got %s", wait)
+	}
+}
+
+func TestSchedulerEvents(t *testing.T) {
+	f := &fakeAnnounce{failing: map[string]bool{"a": true}}
+	s := newScheduler(NewTiers("http://a/announce", nil), false, f.announce)
+	now := time.Now()
+
+	s.announceTiers(context.Background(), now, false)
+	f.failing = nil
+	s.announceTiers(context.Background(), now, false)
+	s.announceTiers(context.Background(), now, false)
+	s.announceTiers(context.Background(), now, true)
+	s.announceTiers(context.Background(), now, true)
+	s.stop()
+
+	expected := []AnnounceEvent{EventStarted, EventStarted, EventNone, EventCompleted, EventNone, EventStopped}
+	if len(f.events) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, f.events)
+	}
+	for i := range expected {
+		if f.events[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, f.events)
+		}
+	}
+}
+
+func TestSchedulerTierFailover(t *testing.T) {
+	tiers := NewTiers("", [][]string{
+		{"http://a1/announce", "http://a2/announce"},
+		{"http://b1/announce"},
+	})
+	f := &fakeAnnounce{failing: map[string]bool{"a1": true, "a2": true}}
+	s := newScheduler(tiers, false, f.announce)
+	now := time.Now()
+
+	// The whole first tier has to fail before the second tier is used
+	if _, err := s.announceTiers(context.Background(), now, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.announces) != 3 || f.announces[2] != "b1" {
+		t.Fatalf("expected both first tier trackers to be tried before b1, got %v", f.announces)
+	}
+
+	// Once a2 answers it is moved to the front of its tier, and later tiers are not used
+	f.failing = map[string]bool{"a1": true}
+	f.announces = nil
+	s.announceTiers(context.Background(), now, false)
+	f.announces = nil
+	s.announceTiers(context.Background(), now, false)
+	if len(f.announces) != 1 || f.announces[0] != "a2" {
+		t.Fatalf("expected only a2 to be announced to, got %v", f.announces)
+	}
+
+	states := s.states()
+	if states[0].URL != "http://a2/announce" || states[0].Tier != 0 || states[0].Error != "" {
+		t.Errorf("expected a2 first in tier 0, got %+v", states[0])
+	}
+	if states[1].URL != "http://a1/announce" || states[1].Error == "" {
+		t.Errorf("expected a1 to have an error, got %+v", states[1])
+	}
+
+	// Every tier failing counts as a failure
+	f.failing = map[string]bool{"a1": true, "a2": true, "b1": true}
+	if _, err := s.announceTiers(context.Background(), now, false); err == nil {
+		t.Fatal("expected an error when every tracker fails")
+	}
+	if wait := s.next(now); wait != MIN_BACKOFF {
+		t.Errorf("expected backoff after every tier failed, got %s", wait)
+	}
+}
+
+func TestSchedulerStopInParallel(t *testing.T) {
+	// Each tracker only answers once both have been asked, so stopping them one by one would time out
+	var mu sync.Mutex
+	asked, stopped := 0, 0
+	both := make(chan struct{})
+	announce := func(ctx context.Context, tracker *url.URL, event AnnounceEvent) (AnnounceResponse, error) {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > STOP_TIMEOUT {
+			t.Errorf("expected stop to have a deadline, got %v", deadline)
+		}
+		mu.Lock()
+		if asked++; asked == 2 {
+			close(both)
+		}
+		mu.Unlock()
+		select {
+		case <-both:
+		case <-ctx.Done():
+			return AnnounceResponse{}, ctx.Err()
+		}
+		mu.Lock()
+		stopped++
+		mu.Unlock()
+		return AnnounceResponse{}, nil
+	}
+	s := newScheduler(Tiers{{mustParse("http://a/announce"), mustParse("http://b/announce")}}, false, announce)
+	for _, tracker := range s.tiers[0] {
+		tracker.started = true
+	}
+
+	s.stop()
+	if stopped != 2 {
+		t.Errorf("expected both trackers to be stopped, got %d", stopped)
+	}
+}
+
+func mustParse(s string) *url.URL {
+	u, _ := url.Parse(s)
+	return u
+}
@@ -0,0 +1,216 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"torrent-pi/internal/lib"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// A udp scrape packet can hold at most this many info hashes (BEP 15)
+const MAX_UDP_SCRAPE = 74
+
+// ScrapeResult is the swarm health of a single torrent as reported by a tracker
+type ScrapeResult struct {
+	Seeders   int `json:"seeders"`
+	Leechers  int `json:"leechers"`
+	Completed int `json:"completed"` // number of times the torrent has been downloaded
+}
+
+// TrackerScrape is the outcome of scraping a single tracker
+type TrackerScrape struct {
+	Tracker string    `json:"tracker"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"`
+	ScrapeResult
+}
+
+// ScrapeURL converts an announce url to its scrape url, following the convention
+// that the last path component starting with "announce" is replaced by "scrape".
+// Trackers which don't follow the convention do not support http scrape.
+func ScrapeURL(announce url.URL) (*url.URL, error) {
+	i := strings.LastIndex(announce.Path, "/")
+	if i < 0 || !strings.HasPrefix(announce.Path[i+1:], "announce") {
+		return nil, fmt.Errorf("tracker %s does not support scrape", announce.Host)
+	}
+	announce.Path = announce.Path[:i+1] + "scrape" + strings.TrimPrefix(announce.Path[i+1:], "announce")
+	return &announce, nil
+}
+
+// Scrape asks a tracker for the swarm health of one or more torrents without announcing
+func Scrape(tracker *url.URL, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	return scrapeTracker(tracker, TRACKER_TIMEOUT, infoHashes...)
+}
+
+// scrapeTracker is Scrape, giving the tracker timeout to answer
+func scrapeTracker(tracker *url.URL, timeout time.Duration, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("no info hashes to scrape")
+	}
+	switch tracker.Scheme {
+	case "http", "https":
+		return scrapeHTTP(*tracker, timeout, infoHashes)
+	case "udp":
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+		for start := 0; start < len(infoHashes); start += MAX_UDP_SCRAPE {
+			end := min(start+MAX_UDP_SCRAPE, len(infoHashes))
+			if err := scrapeUDP(ctx, *tracker, infoHashes[start:end], results); err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", tracker.Scheme)
+	}
+}
+
+func scrapeHTTP(tracker url.URL, timeout time.Duration, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrapeURL, err := ScrapeURL(tracker)
+	if err != nil {
+		return nil, err
+	}
+	params := scrapeURL.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	scrapeURL.RawQuery = params.Encode()
+
+	trackerClient := http.Client{Timeout: timeout}
+	res, err := trackerClient.Get(scrapeURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// The files dictionary is keyed by raw info hash, so decode it generically
+	data, err := bencode.Decode(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed scrape response")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker error: %s", reason)
+	}
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("scrape response has no files")
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(files))
+	for key, value := range files {
+		stats, ok := value.(map[string]interface{})
+		if !ok || len(key) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], key)
+		results[infoHash] = ScrapeResult{
+			Seeders:   bencodeInt(stats["complete"]),
+			Leechers:  bencodeInt(stats["incomplete"]),
+			Completed: bencodeInt(stats["downloaded"]),
+		}
+	}
+	return results, nil
+}
+
+func scrapeUDP(ctx context.Context, tracker url.URL, infoHashes [][20]byte, results map[[20]byte]ScrapeResult) error {
+	// info hashes
+	body := make([]byte, 20*len(infoHashes))
+	for i, infoHash := range infoHashes {
+		copy(body[i*20:], infoHash[:])
+	}
+
+	res, err := udpTrackerRequest(ctx, tracker, udpActionScrape, body, lib.UDP_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("error reading UDP tracker: %s", err)
+	}
+
+	// The response holds seeders, completed & leechers for each info hash, in the order requested
+	for i, infoHash := range infoHashes {
+		offset := 8 + i*12
+		if offset+12 > len(res) {
+			return fmt.Errorf("scrape response too short")
+		}
+		results[infoHash] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(res[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(res[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(res[offset+8 : offset+12])),
+		}
+	}
+	return nil
+}
+
+// bencodeInt reads an integer from a generically decoded bencode value
+func bencodeInt(v interface{}) int {
+	if i, ok := v.(int64); ok {
+		return int(i)
+	}
+	return 0
+}
+
+// ScrapeTrackers scrapes every tracker concurrently for a single torrent
+func ScrapeTrackers(trackers []*url.URL, infoHash [20]byte) []TrackerScrape {
+	return scrapeTrackers(trackers, infoHash, TRACKER_TIMEOUT)
+}
+
+func scrapeTrackers(trackers []*url.URL, infoHash [20]byte, timeout time.Duration) []TrackerScrape {
+	scrapes := make([]TrackerScrape, 0, len(trackers))
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, tracker := range trackers {
+		if tracker == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(tracker *url.URL) {
+			defer wg.Done()
+			scrape := TrackerScrape{Tracker: tracker.String(), Time: time.Now()}
+			results, err := scrapeTracker(tracker, timeout, infoHash)
+			if err != nil {
+				scrape.Error = err.Error()
+			} else if result, ok := results[infoHash]; ok {
+				scrape.ScrapeResult = result
+			} else {
+				scrape.Error = fmt.Sprintf("tracker does not know torrent %s", hex.EncodeToString(infoHash[:]))
+			}
+			lock.Lock()
+			scrapes = append(scrapes, scrape)
+			lock.Unlock()
+		}(tracker)
+	}
+	wg.Wait()
+	return scrapes
+}
+
+// Scrape refreshes the swarm health reported by each of the torrent's trackers
+func (pm *PeerManager) Scrape() []TrackerScrape {
+	var infoHash [20]byte
+	copy(infoHash[:], pm.InfoHash)
+	scrapes := scrapeTrackers(pm.Tiers.Trackers(), infoHash, pm.TrackerTimeout)
+
+	pm.mu.Lock()
+	pm.scrapes = scrapes
+	pm.mu.Unlock()
+	return scrapes
+}
+
+// LastScrape returns the results of the most recent Scrape
+func (pm *PeerManager) LastScrape() []TrackerScrape {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.scrapes
+}
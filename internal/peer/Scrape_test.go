@@ -0,0 +1,67 @@
+package peer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestScrapeURL(t *testing.T) {
+	expected := map[string]string{
+		"http://example.com/announce":           "http://example.com/scrape",
+		"http://example.com/x/announce":         "http://example.com/x/scrape",
+		"http://example.com/announce.php":       "http://example.com/scrape.php",
+		"http://example.com/announce?x2%0644=6": "http://example.com/scrape?x2%0644=6",
+		"http://example.com/a":                  "",
+		"http://example.com/announce?x=2/4":     "http://example.com/scrape?x=2/4",
+		"http://example.com/x%064announce":      "",
+	}
+	for announce, scrape := range expected {
+		u, _ := url.Parse(announce)
+		got, err := ScrapeURL(*u)
+		if scrape == "" {
+			if err == nil {
+				t.Errorf("expected %s not to support scrape, got %s", announce, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != scrape {
+			t.Errorf("ScrapeURL(%s) = %v %v, expected %s", announce, got, err, scrape)
+		}
+	}
+}
+
+func TestScrapeHTTPMultipleHashes(t *testing.T) {
+	a := [20]byte{1, 2, 3}
+	b := [20]byte{4, 5, 6}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			t.Errorf("unexpected scrape path %s", r.URL.Path)
+		}
+		if hashes := r.URL.Query()["info_hash"]; len(hashes) != 2 {
+			t.Errorf("expected 2 info hashes, got %d", len(hashes))
+		}
+		bencode.Marshal(w, map[string]interface{}{
+			"files": map[string]interface{}{
+				string(a[:]): map[string]interface{}{"complete": 5, "incomplete": 3, "downloaded": 50},
+				string(b[:]): map[string]interface{}{"complete": 1, "incomplete": 0, "downloaded": 2},
+			},
+		})
+	}))
+	defer server.Close()
+
+	tracker, _ := url.Parse(server.URL + "/announce")
+	results, err := Scrape(tracker, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[a] != (ScrapeResult{Seeders: 5, Leechers: 3, Completed: 50}) {
+		t.Errorf("unexpected result for a: %+v", results[a])
+	}
+	if results[b] != (ScrapeResult{Seeders: 1, Leechers: 0, Completed: 2}) {
+		t.Errorf("unexpected result for b: %+v", results[b])
+	}
+}
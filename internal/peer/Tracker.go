@@ -1,31 +1,66 @@
 package peer
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"time"
 )
 
-func (pm PeerManager) Announce(peerChan chan []Peer, port uint16) {
-	for _, tracker := range pm.Trackers {
-		fmt.Println("Announcing to", tracker.Hostname())
-		go func(tracker *url.URL) {
-			var peers []Peer
-			var err error
-
-			switch tracker.Scheme {
-			case "http":
-				peers, err = pm.announceHTTP(*tracker, port)
-			case "udp":
-				peers, err = pm.announceUDP(*tracker, port)
-			default:
-				fmt.Println("unsupporter tracker scheme:", tracker.Scheme)
-				return
-			}
-			if err != nil {
-				fmt.Println("Error announcing", tracker.Hostname(), err)
-				return
-			}
-			peerChan <- peers
-		}(tracker)
+// AnnounceEvent tells the tracker where we are in the torrent's lifecycle.
+// Values match the udp tracker protocol (BEP 15).
+type AnnounceEvent uint32
+
+const (
+	EventNone      AnnounceEvent = 0
+	EventCompleted AnnounceEvent = 1
+	EventStarted   AnnounceEvent = 2
+	EventStopped   AnnounceEvent = 3
+)
+
+// Number of peers we ask trackers for
+const NUM_WANT = 50
+
+// How long trackers have to answer, unless the PeerManager says otherwise
+const TRACKER_TIMEOUT = 15 * time.Second
+
+// String returns the event as sent to http trackers
+func (e AnnounceEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// AnnounceResponse is a tracker's reply to an announce, for both the http and udp protocols
+type AnnounceResponse struct {
+	Interval    time.Duration // how long to wait before the next regular announce
+	MinInterval time.Duration // never re-announce more often than this (0 if not given)
+	Leechers    int
+	Seeders     int
+	Peers       []Peer
+	Warning     string // warning message from the tracker, the announce still succeeded
+}
+
+// Announce sends a single announce to the tracker and returns its response.
+// The tracker has TrackerTimeout to answer, or until ctx is done.
+func (pm *PeerManager) Announce(ctx context.Context, tracker *url.URL, port uint16, event AnnounceEvent) (AnnounceResponse, error) {
+	fmt.Println("Announcing to", tracker.Hostname(), event.String())
+	ctx, cancel := context.WithTimeout(ctx, pm.TrackerTimeout)
+	defer cancel()
+
+	switch tracker.Scheme {
+	case "http", "https":
+		return pm.announceHTTP(ctx, *tracker, port, event)
+	case "udp":
+		return pm.announceUDP(ctx, *tracker, port, event)
+	default:
+		return AnnounceResponse{}, fmt.Errorf("unsupported tracker scheme: %s", tracker.Scheme)
 	}
 }
@@ -30,5 +30,5 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 }
 
 func (p Peer) String() string {
-	return p.IP.String() + ":" + strconv.Itoa(int(p.Port))
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
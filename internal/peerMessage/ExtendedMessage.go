@@ -3,7 +3,7 @@ package message
 import (
 	"bytes"
 	"fmt"
-	"math"
+	"torrent-pi/internal/lib"
 
 	"github.com/jackpal/bencode-go"
 )
@@ -62,37 +62,34 @@ func (m *ExtendedMessage) Serialize() []byte {
 // It also adds "metadata_size" to the handshake message (not the "m" dictionary)
 // specifying an integer value of the number of bytes of the metadata.
 
-func ParseMetadata(msg ExtendedMessage, extensions Map) (MetaDataData, error) {
+// ParseMetadata reads a ut_metadata message. For data messages, the piece follows the bencoded dictionary.
+func ParseMetadata(msg ExtendedMessage) (MetaDataData, error) {
 	var metadata MetaDataData
-	if int(msg.ExtID) != extensions["ut_metadata"] {
-		return metadata, fmt.Errorf("bad extended message ID. Expected %v got: %v", msg.ExtID, extensions["ut_metadata"])
-	}
 
-	// 1. Parse the metadata response
+	// 1. Parse the metadata message dictionary
 	r := bytes.NewReader(msg.Payload[:])
 	if err := bencode.Unmarshal(r, &metadata); err != nil {
 		return metadata, err
 	}
 
 	// 2. Check the message type
-	if metadata.MsgType != int(MetaData) {
-		return metadata, fmt.Errorf("bad message type. Expected %v got: %v", MetaData, metadata.MsgType)
+	switch MetadataMsgType(metadata.MsgType) {
+	case MetaRequest, MetaReject:
+		return metadata, nil
+	case MetaData:
+	default:
+		return metadata, fmt.Errorf("bad message type. got: %v", metadata.MsgType)
 	}
 
-	// 3. calculate total metadata pieces
-	totalPieces := int(math.Ceil(float64(metadata.Size) / float64(METADATA_PAYLOAD_SIZE)))
-
-	// 4. Calculate the payload offset (room for improvement??)
-	var payloadOffset int
-	if metadata.Piece < totalPieces-1 {
-		payloadOffset = len(msg.Payload) - METADATA_PAYLOAD_SIZE
-	} else {
-		payloadOffset = len(msg.Payload) - (metadata.Size % METADATA_PAYLOAD_SIZE)
+	// 3. The rest of the msg payload is the piece
+	dictEnd, err := lib.BencodeEnd(msg.Payload, 0)
+	if err != nil {
+		return metadata, err
 	}
-
-	// 5. Read the rest of the msg payload & copy into piece payload
-	metadata.Payload = make([]byte, METADATA_PAYLOAD_SIZE) // 16KB
-	copy(metadata.Payload[:], msg.Payload[payloadOffset:])
+	if len(msg.Payload)-dictEnd > METADATA_PAYLOAD_SIZE {
+		return metadata, fmt.Errorf("metadata piece too large: %d", len(msg.Payload)-dictEnd)
+	}
+	metadata.Payload = append([]byte(nil), msg.Payload[dictEnd:]...)
 
 	return metadata, nil
 }
@@ -109,3 +106,35 @@ func FormatRequestMetadata(extensionId, startBlock int) ExtendedMessage {
 
 	return ExtendedMessage{ExtID: ExtMsgID(extensionId), Payload: b.Bytes()}
 }
+
+// FormatMetadataPiece answers a metadata request with a piece of the info dictionary
+func FormatMetadataPiece(extensionId, piece int, metadata []byte) ExtendedMessage {
+	var b bytes.Buffer
+	res := MetaDataData{
+		MsgType: int(MetaData),
+		Piece:   piece,
+		Size:    len(metadata),
+	}
+	if err := bencode.Marshal(&b, res); err != nil {
+		fmt.Println("bencode error: ", err)
+	}
+	start := piece * METADATA_PAYLOAD_SIZE
+	end := min(start+METADATA_PAYLOAD_SIZE, len(metadata))
+	b.Write(metadata[start:end])
+
+	return ExtendedMessage{ExtID: ExtMsgID(extensionId), Payload: b.Bytes()}
+}
+
+// FormatRejectMetadata tells the peer we won't send them a piece of the info dictionary
+func FormatRejectMetadata(extensionId, piece int) ExtendedMessage {
+	var b bytes.Buffer
+	res := MetaReq{
+		MsgType: int(MetaReject),
+		Piece:   piece,
+	}
+	if err := bencode.Marshal(&b, res); err != nil {
+		fmt.Println("bencode error: ", err)
+	}
+
+	return ExtendedMessage{ExtID: ExtMsgID(extensionId), Payload: b.Bytes()}
+}
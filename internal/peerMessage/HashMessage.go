@@ -0,0 +1,91 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Hash messages let peers fetch the merkle hashes of v2 torrents (BEP 52)
+const (
+	// MsgHashRequest asks for a range of hashes from one layer of a file's merkle tree
+	MsgHashRequest messageID = 21
+	// MsgHashes delivers the requested hashes, followed by the proof hashes
+	MsgHashes messageID = 22
+	// MsgHashReject refuses a hash request
+	MsgHashReject messageID = 23
+)
+
+// HashRequest identifies a range of hashes in a file's merkle tree.
+// The same fields head hash request, hashes and hash reject messages.
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   uint32 // layers above the 16 KiB block layer
+	Index       uint32 // of the first hash in the base layer
+	Length      uint32 // number of hashes, a power of two
+	ProofLayers uint32 // uncle hashes to include, verifying the range against the pieces root
+}
+
+const hashRequestSize = 48
+
+func (r HashRequest) payload() []byte {
+	payload := make([]byte, hashRequestSize)
+	copy(payload, r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], r.BaseLayer)
+	binary.BigEndian.PutUint32(payload[36:40], r.Index)
+	binary.BigEndian.PutUint32(payload[40:44], r.Length)
+	binary.BigEndian.PutUint32(payload[44:48], r.ProofLayers)
+	return payload
+}
+
+func FormatHashRequest(r HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: r.payload()}
+}
+
+func FormatHashReject(r HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: r.payload()}
+}
+
+func FormatHashes(r HashRequest, hashes [][32]byte) *Message {
+	payload := r.payload()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// ParseHashRequest reads the request fields of a hash request, hashes or hash reject message
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	var r HashRequest
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashes && msg.ID != MsgHashReject {
+		return r, fmt.Errorf("expected hash message, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) < hashRequestSize {
+		return r, fmt.Errorf("payload too short. %d < %d", len(msg.Payload), hashRequestSize)
+	}
+	copy(r.PiecesRoot[:], msg.Payload[:32])
+	r.BaseLayer = binary.BigEndian.Uint32(msg.Payload[32:36])
+	r.Index = binary.BigEndian.Uint32(msg.Payload[36:40])
+	r.Length = binary.BigEndian.Uint32(msg.Payload[40:44])
+	r.ProofLayers = binary.BigEndian.Uint32(msg.Payload[44:48])
+	return r, nil
+}
+
+// ParseHashes reads a hashes message, returning the request it answers and the hashes, proof hashes included
+func ParseHashes(msg *Message) (HashRequest, [][32]byte, error) {
+	r, err := ParseHashRequest(msg)
+	if err != nil {
+		return r, nil, err
+	}
+	if msg.ID != MsgHashes {
+		return r, nil, fmt.Errorf("expected HASHES (ID %d), got ID %d", MsgHashes, msg.ID)
+	}
+	data := msg.Payload[hashRequestSize:]
+	if len(data)%32 != 0 {
+		return r, nil, fmt.Errorf("hashes length %d is not a multiple of 32", len(data))
+	}
+	hashes := make([][32]byte, len(data)/32)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*32:])
+	}
+	return r, hashes, nil
+}
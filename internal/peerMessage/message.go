@@ -179,6 +179,12 @@ func (m *Message) TypeString() string {
 	case MsgExtended:
 
 		return "extended"
+	case MsgHashRequest:
+		return "hash request"
+	case MsgHashes:
+		return "hashes"
+	case MsgHashReject:
+		return "hash reject"
 	default:
 		return "unknown"
 	}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"net"
+)
+
+// Conn is a connection throttled by a download and an upload limiter, either of which can be nil
+type Conn struct {
+	net.Conn
+	Download *Limiter
+	Upload   *Limiter
+}
+
+// NewConn wraps conn in the limiters
+func NewConn(conn net.Conn, download *Limiter, upload *Limiter) *Conn {
+	return &Conn{Conn: conn, Download: download, Upload: upload}
+}
+
+// Read takes at most MIN_BURST bytes at a time, then waits for the download limiter,
+// so the peer is slowed down by TCP once our buffers fill
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.Download != nil && len(p) > MIN_BURST {
+		p = p[:MIN_BURST]
+	}
+	n, err := c.Conn.Read(p)
+	c.Download.Wait(n)
+	return n, err
+}
+
+// Write waits for the upload limiter before each MIN_BURST bytes
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.Upload == nil {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+MIN_BURST)]
+		c.Upload.Wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	down := newTestLimiter(clock, MIN_BURST, nil)
+	up := newTestLimiter(clock, MIN_BURST, nil)
+	conn := NewConn(ours, down, up)
+
+	data := bytes.Repeat([]byte("x"), 3*MIN_BURST)
+	go func() {
+		theirs.Write(data)
+		io.ReadFull(theirs, make([]byte, len(data)))
+	}()
+
+	buf := make([]byte, len(data))
+	n, err := conn.Read(buf)
+	if err != nil || n > MIN_BURST {
+		t.Fatalf("read %d bytes at once: %v", n, err)
+	}
+	if _, err := io.ReadFull(conn, buf[n:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(clock.sleeps) != 2 {
+		t.Errorf("expected two waits for the bytes past the burst, got %v", clock.sleeps)
+	}
+
+	clock.sleeps = nil
+	if n, err := conn.Write(data); n != len(data) || err != nil {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	if len(clock.sleeps) != 2 {
+		t.Errorf("expected two waits writing, got %v", clock.sleeps)
+	}
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Smallest burst a limiter allows, enough for a block and its message header
+const MIN_BURST = 32 * 1024
+
+// Limiter is a token bucket, filled at rate bytes a second, up to a second's worth.
+// Callers take tokens in the order they arrive, running the bucket into debt which later callers wait out,
+// so every connection sharing a limiter gets a fair turn.
+// A limiter can sit inside a parent, e.g. a peer's inside its torrent's inside the session's,
+// and transfers wait for whichever is slowest.
+type Limiter struct {
+	mu     sync.Mutex
+	parent *Limiter
+	rate   int64 // bytes per second, 0 for unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// New makes a limiter of rate bytes a second, 0 for unlimited, within parent if it isn't nil
+func New(rate int64, parent *Limiter) *Limiter {
+	l := &Limiter{parent: parent, now: time.Now, sleep: time.Sleep}
+	l.SetRate(rate)
+	return l
+}
+
+// Rate is the limit in bytes a second, 0 for unlimited
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit. Transfers already waiting keep to the old one.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	if l.rate == 0 {
+		// Start out full
+		l.tokens = float64(max(rate, MIN_BURST))
+		l.last = l.now()
+	}
+	l.rate = rate
+	l.burst = float64(max(rate, MIN_BURST))
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// SetParent moves the limiter inside another. nil for none.
+func (l *Limiter) SetParent(parent *Limiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.parent = parent
+}
+
+// Wait blocks until n bytes can be sent or received, taking them from the limiter and its parents
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	var delay time.Duration
+	for limiter := l; limiter != nil; limiter = limiter.getParent() {
+		delay = max(delay, limiter.reserve(int64(n)))
+	}
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+func (l *Limiter) getParent() *Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.parent
+}
+
+// reserve takes n tokens, returning how long to wait for them
+func (l *Limiter) reserve(n int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	now := l.now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for time, moving forward only when slept
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+}
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// newTestLimiter makes a limiter that runs on clock
+func newTestLimiter(clock *fakeClock, rate int64, parent *Limiter) *Limiter {
+	l := &Limiter{parent: parent, now: clock.Now, sleep: clock.Sleep}
+	l.SetRate(rate)
+	return l
+}
+
+func TestUnlimited(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newTestLimiter(clock, 0, nil)
+	l.Wait(100 * 1024 * 1024)
+	var none *Limiter
+	none.Wait(10)
+	if len(clock.sleeps) != 0 {
+		t.Errorf("unlimited limiter slept %v", clock.sleeps)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newTestLimiter(clock, 100*1024, nil)
+
+	// A second's worth to start with
+	l.Wait(100 * 1024)
+	if len(clock.sleeps) != 0 {
+		t.Fatalf("burst should not wait, slept %v", clock.sleeps)
+	}
+	// Then callers queue up behind each other
+	l.Wait(50 * 1024)
+	l.Wait(50 * 1024)
+	if len(clock.sleeps) != 2 || clock.sleeps[0] != 500*time.Millisecond || clock.sleeps[1] != time.Second {
+		t.Fatalf("expected waits of 0.5s then 1s, got %v", clock.sleeps)
+	}
+
+	// Time pays off the debt and refills the bucket, up to the burst
+	clock.advance(10 * time.Second)
+	clock.sleeps = nil
+	l.Wait(100 * 1024)
+	l.Wait(10 * 1024)
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != 100*time.Millisecond {
+		t.Errorf("expected the bucket to hold a second's worth, got %v", clock.sleeps)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newTestLimiter(clock, 0, nil)
+	l.SetRate(MIN_BURST)
+	l.Wait(MIN_BURST)
+	l.Wait(MIN_BURST)
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != time.Second {
+		t.Errorf("expected a second's wait after limiting, got %v", clock.sleeps)
+	}
+	if l.Rate() != MIN_BURST {
+		t.Errorf("rate is %d", l.Rate())
+	}
+
+	l.SetRate(0)
+	l.Wait(10 * MIN_BURST)
+	if len(clock.sleeps) != 1 {
+		t.Errorf("expected no more waits once unlimited, got %v", clock.sleeps)
+	}
+}
+
+func TestParent(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	session := newTestLimiter(clock, 64*1024, nil)
+	a := newTestLimiter(clock, 0, session)
+	b := newTestLimiter(clock, 128*1024, session)
+
+	// Peers share the session's bucket
+	a.Wait(64 * 1024)
+	b.Wait(64 * 1024)
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != time.Second {
+		t.Errorf("expected b to wait for the session, got %v", clock.sleeps)
+	}
+
+	// and wait for the slowest of their limits. b has half its burst left.
+	session.SetRate(0)
+	clock.sleeps = nil
+	b.Wait(128 * 1024)
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != 500*time.Millisecond {
+		t.Errorf("expected b to wait for its own limit, got %v", clock.sleeps)
+	}
+}
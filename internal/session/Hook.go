@@ -0,0 +1,55 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	"torrent-pi/internal/torrent"
+)
+
+// Longest a completion hook can run for
+const HOOK_TIMEOUT = time.Minute
+
+// runHook lets something else know a torrent has finished downloading. hook is either:
+//   - an http(s) url, which is sent the torrent's json in a POST
+//   - a program, run with the torrent's json on stdin and TORRENT_ID, TORRENT_NAME and TORRENT_DIR set
+func runHook(hook string, info torrent.TorrentInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HOOK_TIMEOUT)
+	defer cancel()
+
+	if u, err := url.Parse(hook); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("webhook %s: %s", hook, res.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "TORRENT_ID="+info.ID, "TORRENT_NAME="+info.Name, "TORRENT_DIR="+info.DataDir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", hook, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"torrent-pi/internal/torrent"
+)
+
+func TestWebhook(t *testing.T) {
+	received := make(chan torrent.TorrentInfo, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info torrent.TorrentInfo
+		json.NewDecoder(r.Body).Decode(&info)
+		received <- info
+	}))
+	defer server.Close()
+
+	if err := runHook(server.URL+"/done", torrent.TorrentInfo{ID: "abc", Name: "film"}); err != nil {
+		t.Fatal(err)
+	}
+	if info := <-received; info.ID != "abc" || info.Name != "film" {
+		t.Errorf("unexpected webhook body %+v", info)
+	}
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	if err := runHook(failing.URL, torrent.TorrentInfo{}); err == nil {
+		t.Errorf("expected error from failing webhook")
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$TORRENT_NAME $TORRENT_DIR\" > \"$(dirname \"$0\")/out\"\ncat >> \"$(dirname \"$0\")/out\"\n"), 0755)
+
+	if err := runHook(script, torrent.TorrentInfo{ID: "abc", Name: "film", DataDir: "/media"}); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := os.ReadFile(filepath.Join(dir, "out"))
+	env, body, _ := strings.Cut(string(out), "\n")
+	var info torrent.TorrentInfo
+	if err := json.Unmarshal([]byte(body), &info); env != "film /media" || err != nil || info.ID != "abc" {
+		t.Errorf("unexpected hook output %q", out)
+	}
+	if err := runHook(filepath.Join(dir, "missing"), torrent.TorrentInfo{}); err == nil {
+		t.Errorf("expected error for missing program")
+	}
+}
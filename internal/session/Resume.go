@@ -0,0 +1,108 @@
+package session
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"torrent-pi/internal/torrent"
+)
+
+// ResumeData is what we need to carry on with a torrent after a restart. It is kept next to the .torrent file.
+type ResumeData struct {
+	ID       string `json:"id"`
+	Metainfo string `json:"metainfo"` // name of the .torrent file in DownloadDir, see Torrent.MetadataFile
+	DataDir  string `json:"data_dir"`
+	// Set while the files are staged: where they go when finished, and the suffix they have until then
+	CompleteDir string `json:"complete_dir,omitempty"`
+	PartSuffix  string `json:"part_suffix,omitempty"`
+	// The torrent's own rate limits
+	Limits *torrent.Limits `json:"limits,omitempty"`
+	// Pieces verified so far, as a hex bitfield, see Torrent.Bitfield
+	Pieces string `json:"pieces,omitempty"`
+	// Set once downloaded, so the torrent isn't downloaded again or the hook run twice
+	Completed bool `json:"completed,omitempty"`
+}
+
+func (s *Session) resumePath(id string) string {
+	return filepath.Join(s.Config().DownloadDir, id+".resume")
+}
+
+// saveResume writes a torrent's resume data, replacing the old file in one step
+func (s *Session) saveResume(t *torrent.Torrent) error {
+	resume := ResumeData{ID: t.ID(), Metainfo: t.MetadataFile(), DataDir: t.DataDir()}
+	resume.CompleteDir, resume.PartSuffix = t.CompleteDir()
+	if limits := t.Limits(); limits != (torrent.Limits{}) {
+		resume.Limits = &limits
+	}
+	resume.Pieces = hex.EncodeToString(t.Bitfield())
+	state, _ := t.State()
+	resume.Completed = state == torrent.COMPLETED
+	data, err := json.MarshalIndent(resume, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.resumePath(t.ID()) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.resumePath(t.ID()))
+}
+
+// Resume adds every torrent with resume data back into the session, downloading to wherever it was left
+func (s *Session) Resume() error {
+	paths, err := filepath.Glob(filepath.Join(s.Config().DownloadDir, "*.resume"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, path := range paths {
+		if err := s.resume(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Session) resume(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var resume ResumeData
+	if err := json.Unmarshal(data, &resume); err != nil {
+		return err
+	}
+	cfg := s.Config()
+	metainfo, err := os.ReadFile(filepath.Join(cfg.DownloadDir, filepath.Base(resume.Metainfo)))
+	if err != nil {
+		return err
+	}
+	t, err := torrent.FromMetadata(metainfo)
+	if err != nil {
+		return err
+	}
+	if t.ID() != resume.ID {
+		return fmt.Errorf("%s is not torrent %s", resume.Metainfo, resume.ID)
+	}
+	t.Configure(cfg)
+	if resume.Limits != nil {
+		t.SetLimits(*resume.Limits)
+	}
+	if bitfield, err := hex.DecodeString(resume.Pieces); err == nil {
+		t.SetBitfield(bitfield)
+	}
+	if resume.Completed {
+		t.SetCompleted()
+	}
+	if resume.DataDir == "" {
+		s.stage(t, cfg)
+	} else {
+		t.SetDataDir(resume.DataDir)
+		t.SetCompleteDir(resume.CompleteDir, resume.PartSuffix)
+	}
+	return s.add(t)
+}
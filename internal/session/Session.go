@@ -0,0 +1,277 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"torrent-pi/internal/config"
+	"torrent-pi/internal/magnet"
+	"torrent-pi/internal/peer"
+	"torrent-pi/internal/ratelimit"
+	"torrent-pi/internal/storage"
+	"torrent-pi/internal/torrent"
+)
+
+// Largest .torrent file we will read
+const MAX_METAINFO_SIZE = 10 * 1024 * 1024
+
+var (
+	ErrTorrentExists   = errors.New("torrent already added")
+	ErrTorrentNotFound = errors.New("torrent not found")
+	ErrRestartRequired = errors.New("port, download_dir and completion_hook can't be changed while running")
+)
+
+// Session holds every torrent the server is running
+type Session struct {
+	mu       sync.Mutex
+	cfg      config.Config
+	torrents map[string]*torrent.Torrent // by ID
+
+	// Shared by every torrent
+	download *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+	speed    Speed
+	now      func() time.Time
+
+	done     chan struct{} // closed by Stop
+	stopOnce sync.Once
+}
+
+// New starts a session. Unless cfg has a peer ID, the session makes one up.
+func New(cfg config.Config) *Session {
+	return newSession(cfg, time.Now)
+}
+
+// newSession starts a session whose speed schedule runs on the clock now
+func newSession(cfg config.Config, now func() time.Time) *Session {
+	if cfg.PeerID == "" {
+		id := peer.NewPeerID()
+		cfg.PeerID = string(id[:])
+	}
+	s := &Session{
+		cfg:      cfg,
+		torrents: map[string]*torrent.Torrent{},
+		download: ratelimit.New(0, nil),
+		upload:   ratelimit.New(0, nil),
+		now:      now,
+		done:     make(chan struct{}),
+	}
+	s.applySpeed()
+	go s.runSchedule()
+	return s
+}
+
+// Config returns the session's current settings
+func (s *Session) Config() config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg.Clone()
+}
+
+// SetConfig changes the session's settings. The session's rate limits and speed profiles change straight away,
+// otherwise torrents added from now on use the new settings and torrents already running keep theirs.
+// The port and download_dir are only read at startup, so can't be changed. Nor can the completion_hook,
+// since the api would otherwise let anyone run any program on the server.
+func (s *Session) SetConfig(cfg config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cfg.Port != s.cfg.Port || cfg.DownloadDir != s.cfg.DownloadDir || cfg.CompletionHook != s.cfg.CompletionHook {
+		return ErrRestartRequired
+	}
+	if cfg.PeerID == "" {
+		cfg.PeerID = s.cfg.PeerID
+	}
+	s.cfg = cfg.Clone()
+	s.applySpeed()
+	return nil
+}
+
+// Get returns the torrent with the given ID
+func (s *Session) Get(id string) (*torrent.Torrent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[id]
+	return t, ok
+}
+
+// List returns every torrent in the session
+func (s *Session) List() []*torrent.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*torrent.Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		list = append(list, t)
+	}
+	return list
+}
+
+// AddMagnet joins the swarm of a magnet link and starts downloading once the metadata has been fetched
+func (s *Session) AddMagnet(m *magnet.Magnet) (*torrent.Torrent, error) {
+	cfg := s.Config()
+	t, err := torrent.NewTorrentFromMagnet(m, cfg)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Received metadata for torrent: ", t.Name)
+	s.stage(t, cfg)
+	if err := s.add(t); err != nil {
+		// Leave the swarm we joined to fetch the metadata
+		go t.Stop()
+		return t, err
+	}
+	return t, nil
+}
+
+// AddMetainfo starts downloading the torrent described by the contents of a .torrent file
+func (s *Session) AddMetainfo(data []byte) (*torrent.Torrent, error) {
+	t, err := torrent.FromMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg := s.Config()
+	t.Configure(cfg)
+	s.stage(t, cfg)
+	return t, s.add(t)
+}
+
+// AddURL downloads a .torrent file and starts downloading the torrent it describes
+func (s *Session) AddURL(torrentURL string) (*torrent.Torrent, error) {
+	httpClient := http.Client{Timeout: 30 * time.Second}
+	res, err := httpClient.Get(torrentURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s: %s", torrentURL, res.Status)
+	}
+
+	data, err := ReadMetainfo(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddMetainfo(data)
+}
+
+// ReadMetainfo reads a .torrent file, refusing anything too large to be one
+func ReadMetainfo(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MAX_METAINFO_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_METAINFO_SIZE {
+		return nil, fmt.Errorf(".torrent file too large")
+	}
+	return data, nil
+}
+
+// stage sets up a new torrent to download into the incomplete dir, if there is one, and end up in the data dir
+func (s *Session) stage(t *torrent.Torrent, cfg config.Config) {
+	suffix := ""
+	if cfg.PartFiles {
+		suffix = storage.PART_SUFFIX
+	}
+	if cfg.IncompleteDir != "" {
+		t.SetDataDir(cfg.IncompleteDir)
+		t.SetCompleteDir(cfg.DataDir, suffix)
+	} else {
+		t.SetDataDir(cfg.DataDir)
+		t.SetCompleteDir("", suffix)
+	}
+}
+
+// add registers the torrent, joins its swarm and starts downloading it, unless it was finished in an earlier run
+func (s *Session) add(t *torrent.Torrent) error {
+	s.mu.Lock()
+	if _, ok := s.torrents[t.ID()]; ok {
+		s.mu.Unlock()
+		return ErrTorrentExists
+	}
+	s.torrents[t.ID()] = t
+	downloadDir := s.cfg.DownloadDir
+	s.mu.Unlock()
+	t.OnComplete = s.completed
+	t.LimitWithin(s.download, s.upload)
+
+	fmt.Println("Writing .torrent file")
+	if err := t.WriteMetadataFile(downloadDir); err != nil {
+		fmt.Println("Error writing .torrent file:", err)
+	} else if err := s.saveResume(t); err != nil {
+		fmt.Println("Error writing resume data:", err)
+	}
+
+	t.Start()
+	if state, _ := t.State(); state == torrent.COMPLETED {
+		return nil
+	}
+	// Download in goroutine (non-blocking)
+	go t.Download()
+	return nil
+}
+
+// Move relocates a torrent's data to dir, which can be on another filesystem, and remembers the new location
+func (s *Session) Move(id string, dir string) (*torrent.Torrent, error) {
+	t, ok := s.Get(id)
+	if !ok {
+		return nil, ErrTorrentNotFound
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("no directory to move to")
+	}
+	if err := t.Move(filepath.Clean(dir)); err != nil {
+		return t, err
+	}
+	return t, s.saveResume(t)
+}
+
+// SetLimits changes a torrent's rate limits, remembering them for next time
+func (s *Session) SetLimits(id string, limits torrent.Limits) (*torrent.Torrent, error) {
+	t, ok := s.Get(id)
+	if !ok {
+		return nil, ErrTorrentNotFound
+	}
+	if limits.Download < 0 || limits.Upload < 0 || limits.PeerDownload < 0 || limits.PeerUpload < 0 {
+		return nil, fmt.Errorf("rate limits can't be negative")
+	}
+	t.SetLimits(limits)
+	return t, s.saveResume(t)
+}
+
+// completed remembers where a finished torrent's files ended up, then runs the completion hook
+func (s *Session) completed(t *torrent.Torrent) {
+	if err := s.saveResume(t); err != nil {
+		fmt.Println("Error writing resume data:", err)
+	}
+	hook := s.Config().CompletionHook
+	if hook == "" {
+		return
+	}
+	if err := runHook(hook, t.Info()); err != nil {
+		fmt.Printf("Completion hook for %s failed: %s\n", t.Name, err)
+	}
+}
+
+// Stop leaves every swarm, letting the trackers know we have gone, and remembers the pieces each torrent has
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+	wg := sync.WaitGroup{}
+	for _, t := range s.List() {
+		wg.Add(1)
+		go func(t *torrent.Torrent) {
+			defer wg.Done()
+			t.Stop()
+			if err := s.saveResume(t); err != nil {
+				fmt.Println("Error writing resume data:", err)
+			}
+		}(t)
+	}
+	wg.Wait()
+}
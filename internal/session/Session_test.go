@@ -0,0 +1,200 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent-pi/internal/config"
+	"torrent-pi/internal/torrent"
+)
+
+func TestResumeAndMove(t *testing.T) {
+	content := t.TempDir()
+	os.WriteFile(filepath.Join(content, "film.mkv"), []byte("not really a film"), 0644)
+	created, err := torrent.Create(torrent.CreateOptions{Path: filepath.Join(content, "film.mkv")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A torrent saved by an earlier run, with its data in content
+	downloadDir := t.TempDir()
+	created.WriteMetadataFile(downloadDir)
+	created.SetDataDir(content)
+	cfg := config.Default()
+	cfg.DownloadDir = downloadDir
+	s := New(cfg)
+	if err := s.saveResume(created); err != nil {
+		t.Fatal(err)
+	}
+
+	s = New(cfg)
+	defer s.Stop()
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	resumed, ok := s.Get(created.ID())
+	if !ok || resumed.DataDir() != content {
+		t.Fatalf("torrent not resumed into %s", content)
+	}
+
+	archive := filepath.Join(t.TempDir(), "usb")
+	if _, err := s.Move(created.ID(), archive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(archive, "film.mkv")); err != nil {
+		t.Errorf("data not moved: %v", err)
+	}
+	var resume ResumeData
+	data, _ := os.ReadFile(s.resumePath(created.ID()))
+	if json.Unmarshal(data, &resume); resume.DataDir != archive {
+		t.Errorf("resume data not updated: %s", data)
+	}
+	if resume.Metainfo != created.ID()+".torrent" {
+		t.Errorf("expected the .torrent file to be named by ID, got %s", resume.Metainfo)
+	}
+
+	if _, err := s.Move("0000", archive); !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestResumeCompleted(t *testing.T) {
+	content := t.TempDir()
+	os.WriteFile(filepath.Join(content, "film.mkv"), []byte("not really a film"), 0644)
+	created, err := torrent.Create(torrent.CreateOptions{Path: filepath.Join(content, "film.mkv")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hooks <- struct{}{} }))
+	defer server.Close()
+
+	// Finished by an earlier run
+	downloadDir := t.TempDir()
+	created.WriteMetadataFile(downloadDir)
+	created.SetDataDir(content)
+	created.SetBitfield([]byte{0x80})
+	created.SetCompleted()
+	cfg := config.Default()
+	cfg.DownloadDir = downloadDir
+	cfg.CompletionHook = server.URL
+	s := New(cfg)
+	if err := s.saveResume(created); err != nil {
+		t.Fatal(err)
+	}
+	var resume ResumeData
+	data, _ := os.ReadFile(s.resumePath(created.ID()))
+	if json.Unmarshal(data, &resume); !resume.Completed || resume.Pieces != "80" {
+		t.Errorf("completion not saved: %s", data)
+	}
+
+	s = New(cfg)
+	defer s.Stop()
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	resumed, _ := s.Get(created.ID())
+	if state, _ := resumed.State(); state != torrent.COMPLETED || !resumed.Complete() {
+		t.Errorf("expected resumed torrent to be complete, got %s", state)
+	}
+	select {
+	case <-hooks:
+		t.Errorf("completion hook run again")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	s := New(config.Default())
+	cfg := s.Config()
+	cfg.MaxConnections = 25
+	if err := s.SetConfig(cfg); err != nil || s.Config().MaxConnections != 25 {
+		t.Fatalf("config not changed: %v", err)
+	}
+
+	cfg.MaxConnections = 0
+	if err := s.SetConfig(cfg); err == nil || s.Config().MaxConnections != 25 {
+		t.Errorf("invalid config accepted: %v", err)
+	}
+	cfg = s.Config()
+	cfg.Port++
+	if err := s.SetConfig(cfg); !errors.Is(err, ErrRestartRequired) {
+		t.Errorf("expected restart required, got %v", err)
+	}
+	cfg = s.Config()
+	cfg.CompletionHook = "/bin/sh"
+	if err := s.SetConfig(cfg); !errors.Is(err, ErrRestartRequired) || s.Config().CompletionHook != "" {
+		t.Errorf("expected completion_hook to need a restart, got %v", err)
+	}
+}
+
+func TestPeerIDPerSession(t *testing.T) {
+	a, b := New(config.Default()), New(config.Default())
+	if len(a.Config().PeerID) != 20 || a.Config().PeerID == b.Config().PeerID {
+		t.Errorf("expected a peer ID for each session, got %q and %q", a.Config().PeerID, b.Config().PeerID)
+	}
+
+	cfg := config.Default()
+	cfg.PeerID = "-MW0100-fixedfixedfi"
+	if id := New(cfg).Config().PeerID; id != cfg.PeerID {
+		t.Errorf("configured peer ID replaced with %q", id)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	content := t.TempDir()
+	os.WriteFile(filepath.Join(content, "film.mkv"), []byte("not really a film"), 0644)
+	created, err := torrent.Create(torrent.CreateOptions{Path: filepath.Join(content, "film.mkv")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.DownloadDir = t.TempDir()
+	cfg.DataDir = content
+	cfg.PeerUploadLimit = 1024
+	s := New(cfg)
+	data, _ := created.Metainfo()
+	added, err := s.AddMetainfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits := added.Limits(); limits.PeerUpload != 1024 {
+		t.Errorf("expected the session's peer limit, got %+v", limits)
+	}
+
+	limits := torrent.Limits{Download: 200 * 1024, PeerUpload: 10 * 1024}
+	if _, err := s.SetLimits(added.ID(), limits); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetLimits(added.ID(), torrent.Limits{Upload: -1}); err == nil {
+		t.Error("expected negative limit to be refused")
+	}
+	if _, err := s.SetLimits("0000", limits); !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	// Session limits change straight away
+	cfg = s.Config()
+	cfg.DownloadLimit = 1024 * 1024
+	if err := s.SetConfig(cfg); err != nil || s.download.Rate() != 1024*1024 {
+		t.Errorf("session limit not changed: %v", err)
+	}
+	s.Stop()
+
+	// A torrent's own limits are kept across restarts
+	s = New(cfg)
+	defer s.Stop()
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	resumed, ok := s.Get(added.ID())
+	if !ok || resumed.Limits() != limits {
+		t.Errorf("limits not resumed")
+	}
+}
@@ -0,0 +1,64 @@
+package session
+
+import (
+	"fmt"
+	"time"
+)
+
+// How often the speed schedule is checked
+const SCHEDULE_INTERVAL = 15 * time.Second
+
+// Speed is which rate limits the session is running with
+type Speed struct {
+	Turtle        bool   `json:"turtle"`
+	Profile       string `json:"profile,omitempty"` // empty when download_limit and upload_limit apply
+	DownloadLimit int64  `json:"download_limit"`
+	UploadLimit   int64  `json:"upload_limit"`
+}
+
+// Speed returns the session's current rate limits and where they come from
+func (s *Session) Speed() Speed {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.speed
+}
+
+// SetTurtle turns turtle mode on or off. While on, the turtle profile's limits apply whatever the schedule says.
+func (s *Session) SetTurtle(on bool) Speed {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.speed.Turtle = on
+	s.applySpeed()
+	return s.speed
+}
+
+// applySpeed sets the session's limits to those of turtle mode, the profile scheduled for now, or the config. Hold mu.
+func (s *Session) applySpeed() {
+	name, profile := s.cfg.ActiveProfile(s.now(), s.speed.Turtle)
+	if name != s.speed.Profile {
+		if name == "" {
+			fmt.Println("Using the configured speed limits")
+		} else {
+			fmt.Printf("Switching to speed profile %q\n", name)
+		}
+	}
+	s.speed.Profile, s.speed.DownloadLimit, s.speed.UploadLimit = name, profile.DownloadLimit, profile.UploadLimit
+	s.download.SetRate(profile.DownloadLimit)
+	s.upload.SetRate(profile.UploadLimit)
+}
+
+// runSchedule switches speed profiles as the schedule says, until Stop
+func (s *Session) runSchedule() {
+	ticker := time.NewTicker(SCHEDULE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.applySpeed()
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"torrent-pi/internal/config"
+)
+
+func TestSpeedSchedule(t *testing.T) {
+	cfg := config.Default()
+	cfg.DownloadLimit = 1024 * 1024
+	cfg.Profiles["day"] = config.Profile{DownloadLimit: 200 * 1024}
+	cfg.Profiles["night"] = config.Profile{}
+	cfg.Schedule = []config.ScheduleRule{
+		{Profile: "night", Start: "22:00", End: "07:00"},
+		{Profile: "day", Days: []string{"weekdays"}, Start: "09:00", End: "18:00"},
+	}
+
+	// A Monday morning
+	now := time.Date(2024, 6, 3, 8, 0, 0, 0, time.Local)
+	s := newSession(cfg, func() time.Time { return now })
+	defer s.Stop()
+	tick := func(d time.Duration) Speed {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		now = now.Add(d)
+		s.applySpeed()
+		return s.speed
+	}
+
+	if speed := s.Speed(); speed.Profile != "" || s.download.Rate() != 1024*1024 {
+		t.Errorf("expected the configured limits before work, got %+v", speed)
+	}
+	if speed := tick(time.Hour); speed.Profile != "day" || s.download.Rate() != 200*1024 {
+		t.Errorf("expected the day profile, got %+v", speed)
+	}
+	if speed := tick(13 * time.Hour); speed.Profile != "night" || s.download.Rate() != 0 {
+		t.Errorf("expected unlimited at night, got %+v", speed)
+	}
+
+	// Turtle mode wins over the schedule, until turned off
+	turtle := cfg.Profiles[config.TURTLE_PROFILE]
+	if speed := s.SetTurtle(true); !speed.Turtle || speed.DownloadLimit != turtle.DownloadLimit || s.upload.Rate() != turtle.UploadLimit {
+		t.Errorf("expected turtle limits, got %+v", speed)
+	}
+	if speed := tick(12 * time.Hour); speed.Profile != config.TURTLE_PROFILE {
+		t.Errorf("schedule overrode turtle mode: %+v", speed)
+	}
+	if speed := s.SetTurtle(false); speed.Turtle || speed.Profile != "day" {
+		t.Errorf("expected the schedule back, got %+v", speed)
+	}
+
+	// Changing the config changes the limits straight away
+	cfg = s.Config()
+	cfg.Profiles = map[string]config.Profile{config.TURTLE_PROFILE: {}, "day": {DownloadLimit: 100 * 1024}, "night": {}}
+	if err := s.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s.download.Rate() != 100*1024 {
+		t.Errorf("expected the new day limit, got %d", s.download.Rate())
+	}
+}
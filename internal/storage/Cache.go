@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default size of a torrent's cache, split evenly between writes and reads
+const DEFAULT_CACHE_SIZE = 16 * 1024 * 1024
+
+// Verified pieces are flushed at least this often
+const FLUSH_INTERVAL = 2 * time.Second
+
+// Number of pieces hashed at once
+var HASHERS = runtime.NumCPU()
+
+// Cache sits in front of a storage backend so the goroutines talking to peers never wait on the disk.
+// Blocks are held in memory until their piece is complete, hashed on a pool of workers,
+// and verified pieces are flushed to the backend in batches, in file order.
+// When the write cache is full, blocks go straight to the backend and are read back for hashing.
+// Recently read pieces are kept for uploads and streams.
+type Cache struct {
+	Storage
+	layout Layout
+	verify func(piece int, data []byte) bool
+
+	// OnHashed is called once a complete piece has been hashed. Set it before writing any blocks.
+	OnHashed func(piece int, ok bool)
+	// OnError is called when the flusher can't write to the backend. Unflushed pieces are kept to try again.
+	OnError func(err error)
+	// OnStored is called once a verified piece is in the backend
+	OnStored func(piece int)
+
+	writeSize int64
+	readSize  int64
+
+	mu      sync.Mutex
+	idle    *sync.Cond            // signalled when a piece finishes hashing
+	pending map[int]*cachedPiece  // pieces being written or hashed
+	ready   map[int][]byte        // verified pieces waiting to be flushed
+	dirty   int64                 // bytes held by pending and ready
+	hashing int                   // pieces queued or being hashed
+	waiting map[int][]chan bool   // WritePiece calls waiting for a piece's hash
+	reads   *list.List            // of *readPiece, most recently used first
+	readMap map[int]*list.Element // by piece
+	readLen int64                 // bytes held by reads
+	stats   CacheStats
+	closed  bool
+
+	flushMu sync.Mutex
+	hash    chan int
+	flush   chan struct{}
+	stop    chan struct{}
+	workers sync.WaitGroup
+}
+
+type cachedPiece struct {
+	data    []byte      // nil if the piece is being written straight to the backend
+	blocks  map[int]int // offset to length of the blocks written
+	filled  int
+	hashing bool
+}
+
+type readPiece struct {
+	piece int
+	data  []byte
+}
+
+// CacheStats are counters for a torrent's cache
+type CacheStats struct {
+	ReadHits      uint64  `json:"read_hits"`
+	ReadMisses    uint64  `json:"read_misses"`
+	WriteHits     uint64  `json:"write_hits"`     // blocks held in memory
+	WriteThroughs uint64  `json:"write_throughs"` // blocks written straight to the backend as the cache was full
+	Dirty         int64   `json:"dirty"`          // bytes waiting to be hashed or flushed
+	ReadHitRatio  float64 `json:"read_hit_ratio"`
+	WriteHitRatio float64 `json:"write_hit_ratio"`
+}
+
+// NewCache wraps a storage backend with a cache of size bytes. verify checks a complete piece against its hash.
+func NewCache(s Storage, layout Layout, size int64, verify func(piece int, data []byte) bool) *Cache {
+	c := &Cache{
+		Storage:   s,
+		layout:    layout,
+		verify:    verify,
+		writeSize: size / 2,
+		readSize:  size / 2,
+		pending:   map[int]*cachedPiece{},
+		waiting:   map[int][]chan bool{},
+		ready:     map[int][]byte{},
+		reads:     list.New(),
+		readMap:   map[int]*list.Element{},
+		hash:      make(chan int, layout.Pieces),
+		flush:     make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	c.idle = sync.NewCond(&c.mu)
+
+	for i := 0; i < max(HASHERS, 1); i++ {
+		c.workers.Add(1)
+		go c.hasher()
+	}
+	c.workers.Add(1)
+	go c.flusher()
+	return c
+}
+
+func (c *Cache) WriteBlock(piece int, offset int, data []byte) error {
+	if err := c.layout.checkBlock(piece, offset, len(data)); err != nil {
+		return err
+	}
+	size := int(c.layout.PieceSize(piece))
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.dropRead(piece)
+	p, ok := c.pending[piece]
+	if !ok {
+		p = &cachedPiece{blocks: map[int]int{}}
+		if c.dirty+int64(size) <= c.writeSize {
+			p.data = make([]byte, size)
+			c.dirty += int64(size)
+		}
+		c.pending[piece] = p
+	}
+	if p.hashing {
+		// Already have the whole piece, perhaps from another peer
+		c.mu.Unlock()
+		return nil
+	}
+
+	if p.data != nil {
+		copy(p.data[offset:], data)
+		c.stats.WriteHits++
+	} else {
+		c.mu.Unlock()
+		if err := c.Storage.WriteBlock(piece, offset, data); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return ErrClosed
+		}
+		c.stats.WriteThroughs++
+		c.requestFlush()
+	}
+
+	if _, seen := p.blocks[offset]; !seen {
+		p.blocks[offset] = len(data)
+		p.filled += len(data)
+	}
+	if p.filled >= size && !p.hashing {
+		p.hashing = true
+		c.hashing++
+		c.hash <- piece
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// WritePiece writes a whole piece and waits for it to be hashed, so whoever fetched it hears whether it was corrupt
+func (c *Cache) WritePiece(piece int, data []byte) (bool, error) {
+	if len(data) != int(c.layout.PieceSize(piece)) {
+		return false, fmt.Errorf("%w: piece #%d is %d bytes", ErrOutOfRange, piece, len(data))
+	}
+	hashed := make(chan bool, 1)
+	c.mu.Lock()
+	c.waiting[piece] = append(c.waiting[piece], hashed)
+	c.mu.Unlock()
+
+	if err := c.WriteBlock(piece, 0, data); err != nil {
+		c.mu.Lock()
+		c.waiting[piece] = slices.DeleteFunc(c.waiting[piece], func(ch chan bool) bool { return ch == hashed })
+		c.mu.Unlock()
+		return false, err
+	}
+	return <-hashed, nil
+}
+
+// hasher verifies complete pieces, moving good ones on to be flushed
+func (c *Cache) hasher() {
+	defer c.workers.Done()
+	for piece := range c.hash {
+		c.mu.Lock()
+		p := c.pending[piece]
+		c.mu.Unlock()
+
+		data := p.data
+		var err error
+		if data == nil {
+			data = make([]byte, c.layout.PieceSize(piece))
+			err = c.Storage.ReadBlock(piece, 0, data)
+		}
+		ok := err == nil && c.verify(piece, data)
+		if ok && p.data == nil {
+			// Already on disk
+			if err := c.Storage.MarkVerified(piece); err != nil {
+				fmt.Printf("Error marking piece #%d verified: %s\n", piece, err)
+			} else if c.OnStored != nil {
+				c.OnStored(piece)
+			}
+		}
+
+		c.mu.Lock()
+		delete(c.pending, piece)
+		if ok && p.data != nil {
+			c.ready[piece] = p.data
+			if c.readyLen() >= c.writeSize/2 {
+				c.requestFlush()
+			}
+		} else if p.data != nil {
+			c.dirty -= int64(len(p.data))
+		}
+		c.hashing--
+		c.idle.Broadcast()
+		for _, hashed := range c.waiting[piece] {
+			hashed <- ok
+		}
+		delete(c.waiting, piece)
+		c.mu.Unlock()
+
+		if c.OnHashed != nil {
+			c.OnHashed(piece, ok)
+		}
+	}
+}
+
+// readyLen is the number of bytes waiting to be flushed. Hold mu.
+func (c *Cache) readyLen() int64 {
+	var n int64
+	for _, data := range c.ready {
+		n += int64(len(data))
+	}
+	return n
+}
+
+// requestFlush wakes the flusher without waiting for it
+func (c *Cache) requestFlush() {
+	select {
+	case c.flush <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Cache) flusher() {
+	defer c.workers.Done()
+	ticker := time.NewTicker(FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.flush:
+		case <-ticker.C:
+		}
+		if err := c.flushReady(); err != nil {
+			fmt.Println("Error flushing cache:", err)
+			if c.OnError != nil {
+				c.OnError(err)
+			}
+		}
+	}
+}
+
+// flushReady writes every verified piece to the backend, in piece order so writes sweep through each file
+func (c *Cache) flushReady() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	batch := make([]int, 0, len(c.ready))
+	for piece := range c.ready {
+		batch = append(batch, piece)
+	}
+	c.mu.Unlock()
+	sort.Ints(batch)
+
+	for _, piece := range batch {
+		c.mu.Lock()
+		data := c.ready[piece]
+		c.mu.Unlock()
+		if err := c.Storage.WriteBlock(piece, 0, data); err != nil {
+			return err
+		}
+		if err := c.Storage.MarkVerified(piece); err != nil {
+			return err
+		}
+		if c.OnStored != nil {
+			c.OnStored(piece)
+		}
+		c.mu.Lock()
+		delete(c.ready, piece)
+		c.dirty -= int64(len(data))
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Flush waits for complete pieces to be hashed, then writes every verified piece to the backend
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	for c.hashing > 0 {
+		c.idle.Wait()
+	}
+	c.mu.Unlock()
+	return c.flushReady()
+}
+
+func (c *Cache) ReadBlock(piece int, offset int, buf []byte) error {
+	if err := c.layout.checkBlock(piece, offset, len(buf)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if data, ok := c.ready[piece]; ok {
+		copy(buf, data[offset:])
+		c.stats.ReadHits++
+		c.mu.Unlock()
+		return nil
+	}
+	if e, ok := c.readMap[piece]; ok {
+		c.reads.MoveToFront(e)
+		copy(buf, e.Value.(*readPiece).data[offset:])
+		c.stats.ReadHits++
+		c.mu.Unlock()
+		return nil
+	}
+	c.stats.ReadMisses++
+	c.mu.Unlock()
+
+	size := c.layout.PieceSize(piece)
+	if size > c.readSize {
+		return c.Storage.ReadBlock(piece, offset, buf)
+	}
+	// Read the whole piece, the rest of it is likely to be asked for next
+	data := make([]byte, size)
+	if err := c.Storage.ReadBlock(piece, 0, data); err != nil {
+		return err
+	}
+	copy(buf, data[offset:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.readMap[piece]; ok || c.pending[piece] != nil {
+		return nil
+	}
+	c.readMap[piece] = c.reads.PushFront(&readPiece{piece: piece, data: data})
+	c.readLen += size
+	for c.readLen > c.readSize {
+		c.dropRead(c.reads.Back().Value.(*readPiece).piece)
+	}
+	return nil
+}
+
+// dropRead removes a piece from the read cache. Hold mu.
+func (c *Cache) dropRead(piece int) {
+	if e, ok := c.readMap[piece]; ok {
+		c.reads.Remove(e)
+		delete(c.readMap, piece)
+		c.readLen -= int64(len(e.Value.(*readPiece).data))
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Dirty = c.dirty
+	if reads := stats.ReadHits + stats.ReadMisses; reads > 0 {
+		stats.ReadHitRatio = float64(stats.ReadHits) / float64(reads)
+	}
+	if writes := stats.WriteHits + stats.WriteThroughs; writes > 0 {
+		stats.WriteHitRatio = float64(stats.WriteHits) / float64(writes)
+	}
+	return stats
+}
+
+// Close flushes everything verified, then closes the backend. Pieces still being written are lost.
+// Writes fail with ErrClosed afterwards, and closing again does nothing.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	err := c.Flush()
+	close(c.stop)
+	close(c.hash)
+	c.workers.Wait()
+	if closeErr := c.Storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// testCache caches a memory backend holding testLayout, recording which pieces hashed ok
+func testCache(size int64) (*Cache, *MemoryStorage, map[int]bool, *sync.Mutex) {
+	backend := NewMemoryStorage(testLayout)
+	verify := func(piece int, data []byte) bool {
+		start := piece * int(testLayout.PieceLength)
+		return bytes.Equal(data, testContent[start:start+len(data)])
+	}
+	cache := NewCache(backend, testLayout, size, verify)
+	hashed := map[int]bool{}
+	mu := &sync.Mutex{}
+	cache.OnHashed = func(piece int, ok bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		hashed[piece] = ok
+	}
+	return cache, backend, hashed, mu
+}
+
+func writePiece(t *testing.T, s Storage, piece int, content []byte) {
+	start := piece * int(testLayout.PieceLength)
+	end := start + int(testLayout.PieceSize(piece))
+	for offset := start; offset < end; offset += 4 {
+		if err := s.WriteBlock(piece, offset-start, content[offset:min(offset+4, end)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCacheWriteBack(t *testing.T) {
+	cache, backend, hashed, mu := testCache(1024)
+
+	corrupt := bytes.ToUpper(testContent)
+	writePiece(t, cache, 0, testContent)
+	writePiece(t, cache, 1, corrupt)
+	writePiece(t, cache, 2, testContent)
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	if !hashed[0] || hashed[1] || !hashed[2] {
+		t.Errorf("unexpected hash results %v", hashed)
+	}
+	mu.Unlock()
+	if c := backend.Completion(); c.Verified != 2 {
+		t.Errorf("expected 2 pieces flushed, got %+v", c)
+	}
+	buf := make([]byte, 5)
+	backend.ReadBlock(2, 0, buf)
+	if string(buf) != "bbbbb" {
+		t.Errorf("unexpected flushed data %q", buf)
+	}
+
+	// The bad piece is written again
+	writePiece(t, cache, 1, testContent)
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !backend.Completion().Complete() {
+		t.Errorf("expected every piece flushed on close")
+	}
+	if stats := cache.Stats(); stats.WriteThroughs != 0 || stats.WriteHitRatio != 1 || stats.Dirty != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Once closed, writes are refused and closing again is harmless
+	if err := cache.WriteBlock(0, 0, testContent[:8]); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
+
+func TestCacheWritePiece(t *testing.T) {
+	for _, size := range []int64{1024, 0} {
+		cache, _, _, _ := testCache(size)
+		// The writer hears how the piece hashed, in memory or written through
+		if ok, err := cache.WritePiece(0, testContent[:8]); !ok || err != nil {
+			t.Errorf("expected piece 0 to verify, got %v %v", ok, err)
+		}
+		if ok, err := cache.WritePiece(1, bytes.ToUpper(testContent[8:16])); ok || err != nil {
+			t.Errorf("expected piece 1 to be corrupt, got %v %v", ok, err)
+		}
+		if _, err := cache.WritePiece(2, testContent[16:18]); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("expected short piece to be refused, got %v", err)
+		}
+		cache.Close()
+		if _, err := cache.WritePiece(0, testContent[:8]); !errors.Is(err, ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+	}
+}
+
+func TestCacheWriteThrough(t *testing.T) {
+	// Too small to hold a piece, so every block goes to the backend and is read back for hashing
+	cache, backend, hashed, mu := testCache(0)
+	for piece := 0; piece < testLayout.Pieces; piece++ {
+		writePiece(t, cache, piece, testContent)
+	}
+	cache.Flush()
+	mu.Lock()
+	if len(hashed) != 3 || !hashed[0] || !hashed[1] || !hashed[2] {
+		t.Errorf("unexpected hash results %v", hashed)
+	}
+	mu.Unlock()
+	if !backend.Completion().Complete() {
+		t.Errorf("expected every piece verified")
+	}
+	if stats := cache.Stats(); stats.WriteHits != 0 || stats.WriteHitRatio != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	cache.Close()
+}
+
+func TestCacheReads(t *testing.T) {
+	cache, backend, _, _ := testCache(16)
+	backend.WriteBlock(0, 0, testContent[:8])
+	backend.WriteBlock(1, 0, testContent[8:16])
+
+	buf := make([]byte, 4)
+	for _, read := range []struct{ piece, offset int }{{0, 0}, {0, 4}, {1, 0}, {0, 0}} {
+		if err := cache.ReadBlock(read.piece, read.offset, buf); err != nil {
+			t.Fatal(err)
+		}
+		start := read.piece*8 + read.offset
+		if !bytes.Equal(buf, testContent[start:start+4]) {
+			t.Errorf("read %q at piece #%d offset %d", buf, read.piece, read.offset)
+		}
+	}
+	// The read cache holds one piece, so piece 0 was evicted by piece 1
+	if stats := cache.Stats(); stats.ReadHits != 1 || stats.ReadMisses != 3 || stats.ReadHitRatio != 0.25 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Writing a piece drops it from the read cache
+	cache.ReadBlock(1, 0, buf)
+	writePiece(t, cache, 1, bytes.ToUpper(testContent))
+	if _, ok := cache.readMap[1]; ok {
+		t.Errorf("expected piece #1 to leave the read cache")
+	}
+	cache.Close()
+}
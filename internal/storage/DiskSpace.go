@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Preallocation modes, for Prepare
+const (
+	PREALLOC_NONE   = "none"   // files grow as pieces arrive
+	PREALLOC_SPARSE = "sparse" // files are created at full size without using disk space
+	PREALLOC_FULL   = "full"   // disk space is reserved up front, so a full disk is found before downloading
+)
+
+var (
+	ErrDiskFull         = errors.New("not enough free disk space")
+	ErrFreeSpaceUnknown = errors.New("can't find free disk space on this system")
+)
+
+// diskError marks running out of space so callers can tell it apart from other errors
+func diskError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %s", ErrDiskFull, err)
+	}
+	return err
+}
+
+// CheckFreeSpace makes sure there are at least needed bytes free on the filesystem holding dir
+func CheckFreeSpace(dir string, needed int64) error {
+	if needed <= 0 {
+		return nil
+	}
+	// dir might not exist yet, so look at the closest parent which does
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := FreeSpace(dir)
+	if errors.Is(err, ErrFreeSpaceUnknown) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if uint64(needed) > free {
+		return fmt.Errorf("%w: need %d bytes in %s, have %d", ErrDiskFull, needed, dir, free)
+	}
+	return nil
+}
+
+// Prepare checks there is room for the given files on disk, then preallocates them.
+// Backends which don't keep files on disk have nothing to do.
+func Prepare(s Storage, files []int, mode string) error {
+	switch s := s.(type) {
+	case *Cache:
+		return Prepare(s.Storage, files, mode)
+	case *Movable:
+		return Prepare(s.Backend(), files, mode)
+
+	case *FileStorage:
+		var needed int64
+		for _, index := range files {
+			needed += s.missing(index)
+		}
+		if err := CheckFreeSpace(s.dir, needed); err != nil {
+			return err
+		}
+		for _, index := range files {
+			if err := s.preallocate(index, mode); err != nil {
+				return err
+			}
+		}
+
+	case *PieceFileStorage:
+		// Room for the pieces, then for the files they are moved into
+		var needed int64
+		for _, index := range files {
+			needed += s.unverified(s.layout.Files[index]) + s.files.missing(index)
+		}
+		return CheckFreeSpace(s.pieceDir, needed)
+
+	case *MmapStorage:
+		if mode == PREALLOC_FULL {
+			return s.preallocate()
+		}
+	}
+	return nil
+}
+
+// missing is the number of bytes a file still needs on disk: what's left to download,
+// less anything already allocated to it. Sparse files take up no room until they are written.
+func (s *FileStorage) missing(index int) int64 {
+	file := s.layout.Files[index]
+	if file.Padding {
+		return 0
+	}
+	needed := s.unverified(file)
+	if info, err := os.Stat(s.layout.filePath(s.dir, file)); err == nil {
+		needed = min(needed, file.Length-allocated(info))
+	}
+	return max(needed, 0)
+}
+
+// preallocate grows a file to its full length
+func (s *FileStorage) preallocate(index int, mode string) error {
+	file := s.layout.Files[index]
+	if file.Padding || file.Length == 0 {
+		return nil
+	}
+	switch mode {
+	case PREALLOC_NONE, "":
+		return nil
+	case PREALLOC_SPARSE, PREALLOC_FULL:
+	default:
+		return fmt.Errorf("unknown preallocation mode %q", mode)
+	}
+
+	f, err := s.open(index, true)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() >= file.Length {
+		return err
+	}
+	if mode == PREALLOC_SPARSE {
+		return diskError(f.Truncate(file.Length))
+	}
+	return diskError(allocate(f, info.Size(), file.Length-info.Size()))
+}
+
+// writeZeros allocates space by writing it, for filesystems without fallocate
+func writeZeros(f *os.File, offset int64, length int64) error {
+	zeros := make([]byte, min(length, 1024*1024))
+	for length > 0 {
+		n, err := f.WriteAt(zeros[:min(int64(len(zeros)), length)], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		length -= int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := FreeSpace(dir)
+	if errors.Is(err, ErrFreeSpaceUnknown) {
+		t.Skip(err)
+	}
+	if err != nil || free == 0 {
+		t.Fatalf("unexpected free space %d: %v", free, err)
+	}
+	if err := CheckFreeSpace(filepath.Join(dir, "not", "made", "yet"), 1); err != nil {
+		t.Error(err)
+	}
+	if err := CheckFreeSpace(dir, 1<<62); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("expected disk full, got %v", err)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	for _, mode := range []string{PREALLOC_NONE, PREALLOC_SPARSE, PREALLOC_FULL} {
+		dir := t.TempDir()
+		s := NewFileStorage(dir, testLayout)
+		// The cache is looked through to the backend
+		cache := NewCache(s, testLayout, 0, nil)
+		if err := Prepare(cache, []int{0, 1, 2}, mode); err != nil {
+			t.Fatal(err)
+		}
+		cache.Close()
+
+		info, err := os.Stat(filepath.Join(dir, "dir", "b"))
+		if mode == PREALLOC_NONE {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: expected no file, got %v", mode, err)
+			}
+			continue
+		}
+		if err != nil || info.Size() != 5 {
+			t.Errorf("%s: expected a 5 byte file: %v", mode, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".pad")); !os.IsNotExist(err) {
+			t.Errorf("%s: padding file allocated", mode)
+		}
+	}
+
+	if err := Prepare(NewFileStorage(t.TempDir(), testLayout), []int{0}, "most"); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+	huge := Layout{PieceLength: 1 << 30, Pieces: 1 << 30, Files: []File{{Path: []string{"huge"}, Length: 1 << 60}}}
+	if _, err := FreeSpace(os.TempDir()); err == nil {
+		if err := Prepare(NewFileStorage(t.TempDir(), huge), []int{0}, PREALLOC_SPARSE); !errors.Is(err, ErrDiskFull) {
+			t.Errorf("expected disk full, got %v", err)
+		}
+	}
+	if err := Prepare(NewMemoryStorage(testLayout), []int{0}, PREALLOC_FULL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	layout := Layout{ID: "big", PieceLength: 256 * 1024, Pieces: 4, Files: []File{{Path: []string{"big"}, Length: 1024 * 1024}}}
+	s := NewFileStorage(t.TempDir(), layout)
+	defer s.Close()
+
+	// A sparse file is full size but still needs all of its space
+	if err := Prepare(s, []int{0}, PREALLOC_SPARSE); err != nil {
+		t.Fatal(err)
+	}
+	if missing := s.missing(0); missing != layout.Files[0].Length {
+		t.Errorf("expected a sparse file to need %d bytes, got %d", layout.Files[0].Length, missing)
+	}
+	// Verified pieces are on disk
+	s.MarkVerified(1)
+	if missing := s.missing(0); missing != 3*layout.PieceLength {
+		t.Errorf("expected %d bytes needed, got %d", 3*layout.PieceLength, missing)
+	}
+	// As is space reserved up front
+	full := NewFileStorage(t.TempDir(), layout)
+	defer full.Close()
+	if err := Prepare(full, []int{0}, PREALLOC_FULL); err != nil {
+		t.Fatal(err)
+	}
+	if missing := full.missing(0); missing != 0 {
+		t.Errorf("expected nothing needed once preallocated, got %d", missing)
+	}
+}
+
+func TestDiskError(t *testing.T) {
+	err := diskError(&os.PathError{Op: "write", Path: "a", Err: syscall.ENOSPC})
+	if !errors.Is(err, ErrDiskFull) {
+		t.Errorf("expected disk full, got %v", err)
+	}
+	if err := diskError(os.ErrPermission); errors.Is(err, ErrDiskFull) {
+		t.Errorf("unexpected disk full")
+	}
+}
@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// allocate reserves disk space for part of a file without changing what is already there
+func allocate(f *os.File, offset int64, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, offset, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return writeZeros(f, offset, length)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// allocate reserves disk space for part of a file by writing zeros to it
+func allocate(f *os.File, offset int64, length int64) error {
+	return writeZeros(f, offset, length)
+}
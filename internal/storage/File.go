@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage writes pieces straight into the torrent's files under a directory.
+// Files are created when first written to.
+type FileStorage struct {
+	verified
+	dir string
+
+	mu    sync.Mutex
+	files map[int]*os.File
+}
+
+func NewFileStorage(dir string, layout Layout) *FileStorage {
+	return &FileStorage{verified: newVerified(layout), dir: dir, files: map[int]*os.File{}}
+}
+
+// open returns the open file, creating it if create is set. Files which don't exist yet return nil.
+func (s *FileStorage) open(index int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[index]; ok {
+		return f, nil
+	}
+
+	path := s.layout.filePath(s.dir, s.layout.Files[index])
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.files[index] = f
+	return f, nil
+}
+
+func (s *FileStorage) ReadBlock(piece int, offset int, buf []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(buf)); err != nil {
+		return err
+	}
+	clear(buf)
+	for _, span := range s.layout.spans(piece, offset, len(buf)) {
+		if s.layout.Files[span.file].Padding {
+			continue
+		}
+		f, err := s.open(span.file, false)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			continue
+		}
+		// Reading past the end of a file which hasn't been fully written yet gives zeros
+		if _, err := f.ReadAt(buf[span.blockStart:span.blockStart+span.length], span.fileOffset); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) WriteBlock(piece int, offset int, data []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(data)); err != nil {
+		return err
+	}
+	for _, span := range s.layout.spans(piece, offset, len(data)) {
+		if s.layout.Files[span.file].Padding {
+			continue
+		}
+		f, err := s.open(span.file, true)
+		if err != nil {
+			return diskError(err)
+		}
+		if _, err := f.WriteAt(data[span.blockStart:span.blockStart+span.length], span.fileOffset); err != nil {
+			return diskError(err)
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) MarkVerified(piece int) error {
+	_, err := s.markVerified(piece)
+	return err
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for index, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, index)
+	}
+	return firstErr
+}
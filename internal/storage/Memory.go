@@ -0,0 +1,39 @@
+package storage
+
+// MemoryStorage keeps every piece in memory
+type MemoryStorage struct {
+	verified
+	data []byte
+}
+
+func NewMemoryStorage(layout Layout) *MemoryStorage {
+	return &MemoryStorage{verified: newVerified(layout), data: make([]byte, layout.Size())}
+}
+
+func (s *MemoryStorage) ReadBlock(piece int, offset int, buf []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(buf)); err != nil {
+		return err
+	}
+	start := int64(piece)*s.layout.PieceLength + int64(offset)
+	copy(buf, s.data[start:])
+	return nil
+}
+
+func (s *MemoryStorage) WriteBlock(piece int, offset int, data []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(data)); err != nil {
+		return err
+	}
+	start := int64(piece)*s.layout.PieceLength + int64(offset)
+	copy(s.data[start:], data)
+	return nil
+}
+
+func (s *MemoryStorage) MarkVerified(piece int) error {
+	_, err := s.markVerified(piece)
+	return err
+}
+
+func (s *MemoryStorage) Close() error {
+	s.data = nil
+	return nil
+}
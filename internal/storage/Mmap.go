@@ -0,0 +1,89 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// MmapStorage keeps every piece in one memory mapped file, laid end to end.
+// The whole torrent must fit in the address space, so keep to small torrents on 32 bit systems.
+type MmapStorage struct {
+	verified
+	file    *os.File
+	data    []byte
+	created bool // the file didn't exist, so has no space allocated yet
+}
+
+func NewMmapStorage(path string, layout Layout) (*MmapStorage, error) {
+	size := layout.Size()
+	if size <= 0 || size != int64(int(size)) {
+		return nil, fmt.Errorf("can't mmap %d bytes", size)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("mmap %s: %w", path, err)
+	}
+	return &MmapStorage{verified: newVerified(layout), file: f, data: data, created: info.Size() == 0}, nil
+}
+
+// preallocate reserves space for a new file. Writes to a mapped file on a full disk crash the process.
+func (s *MmapStorage) preallocate() error {
+	if !s.created {
+		return nil
+	}
+	if err := CheckFreeSpace(s.file.Name(), int64(len(s.data))); err != nil {
+		return err
+	}
+	return diskError(allocate(s.file, 0, int64(len(s.data))))
+}
+
+func (s *MmapStorage) ReadBlock(piece int, offset int, buf []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(buf)); err != nil {
+		return err
+	}
+	copy(buf, s.data[int64(piece)*s.layout.PieceLength+int64(offset):])
+	return nil
+}
+
+func (s *MmapStorage) WriteBlock(piece int, offset int, data []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(data)); err != nil {
+		return err
+	}
+	copy(s.data[int64(piece)*s.layout.PieceLength+int64(offset):], data)
+	return nil
+}
+
+func (s *MmapStorage) MarkVerified(piece int) error {
+	_, err := s.markVerified(piece)
+	return err
+}
+
+func (s *MmapStorage) Close() error {
+	err := syscall.Munmap(s.data)
+	s.data = nil
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package storage
+
+import "fmt"
+
+// MmapStorage is only available on unix systems
+type MmapStorage struct {
+	FileStorage
+}
+
+func NewMmapStorage(path string, layout Layout) (*MmapStorage, error) {
+	return nil, fmt.Errorf("mmap storage is not supported on this system")
+}
+
+func (s *MmapStorage) preallocate() error {
+	return nil
+}
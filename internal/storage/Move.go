@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Movable lets a backend be moved to another directory while it is in use.
+// Reads and writes wait while the data is moved.
+type Movable struct {
+	mu      sync.RWMutex
+	backend Storage
+	dir     string
+	layout  Layout
+	open    func(dir string, layout Layout) (Storage, error)
+	closed  bool
+}
+
+// NewMovable opens a backend in dir with open, which is called again to reopen it after a move
+func NewMovable(dir string, layout Layout, open func(dir string, layout Layout) (Storage, error)) (*Movable, error) {
+	backend, err := open(dir, layout)
+	if err != nil {
+		return nil, err
+	}
+	return &Movable{backend: backend, dir: dir, layout: layout, open: open}, nil
+}
+
+func (m *Movable) ReadBlock(piece int, offset int, buf []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.backend.ReadBlock(piece, offset, buf)
+}
+
+func (m *Movable) WriteBlock(piece int, offset int, data []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.backend.WriteBlock(piece, offset, data)
+}
+
+func (m *Movable) MarkVerified(piece int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.backend.MarkVerified(piece)
+}
+
+func (m *Movable) Completion() Completion {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.backend.Completion()
+}
+
+// Backend is the storage being moved around
+func (m *Movable) Backend() Storage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.backend
+}
+
+func (m *Movable) Dir() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dir
+}
+
+func (m *Movable) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return m.backend.Close()
+}
+
+// Move closes the backend, moves its data to dir and reopens it there, keeping track of verified pieces.
+// Once closed, only the data is moved.
+func (m *Movable) Move(dir string) error {
+	return m.relocate(dir, m.layout.PartSuffix)
+}
+
+// Finish moves the data to dir like Move, dropping the part suffix from file names
+func (m *Movable) Finish(dir string) error {
+	return m.relocate(dir, "")
+}
+
+func (m *Movable) relocate(dir string, suffix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		if err := m.backend.Close(); err != nil {
+			return err
+		}
+	}
+
+	moveErr := moveData(m.layout, m.dir, dir, suffix)
+	if moveErr == nil {
+		m.dir = dir
+		m.layout.PartSuffix = suffix
+	}
+	if m.closed {
+		return moveErr
+	}
+
+	// Reopen wherever the data ended up
+	backend, err := m.open(m.dir, m.layout)
+	if err != nil {
+		m.closed = true
+		return errors.Join(moveErr, err)
+	}
+	if v, ok := m.backend.(interface{ verifiedPieces() []bool }); ok {
+		if r, ok := backend.(interface{ restore([]bool) }); ok {
+			r.restore(v.verifiedPieces())
+		}
+	}
+	m.backend = backend
+	return moveErr
+}
+
+// MoveData moves a torrent's files, and the working files of any backend, from one directory to another.
+// Moves between filesystems copy the data, then delete the original.
+func MoveData(layout Layout, from string, to string) error {
+	return moveData(layout, from, to, layout.PartSuffix)
+}
+
+// FinishData moves a torrent's files like MoveData, dropping the part suffix from their names
+func FinishData(layout Layout, from string, to string) error {
+	return moveData(layout, from, to, "")
+}
+
+// moveData moves the data to to, where files are named with suffix
+func moveData(layout Layout, from string, to string, suffix string) error {
+	if filepath.Clean(from) == filepath.Clean(to) && suffix == layout.PartSuffix {
+		return nil
+	}
+	if err := layout.Validate(); err != nil {
+		return err
+	}
+	dstLayout := layout
+	dstLayout.PartSuffix = suffix
+	paths := [][2]string{
+		{filepath.Join(PIECE_DIR, layout.ID), filepath.Join(PIECE_DIR, layout.ID)},
+		{layout.ID, layout.ID},
+	}
+	for _, file := range layout.Files {
+		if !file.Padding {
+			paths = append(paths, [2]string{layout.fileName(file), dstLayout.fileName(file)})
+		}
+	}
+
+	var moved [][2]string
+	for _, path := range paths {
+		src := filepath.Join(from, path[0])
+		dst := filepath.Join(to, path[1])
+		if _, err := os.Lstat(src); os.IsNotExist(err) || src == dst {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(dst), 0755)
+		if err == nil {
+			err = move(src, dst)
+		}
+		if err != nil {
+			err = fmt.Errorf("moving %s to %s: %w", src, dst, diskError(err))
+			return errors.Join(err, moveBack(moved, from, to))
+		}
+		moved = append(moved, [2]string{src, dst})
+		removeEmptyDirs(filepath.Dir(src), from)
+	}
+	return nil
+}
+
+// moveBack undoes a move that failed partway, so the data isn't left split across both directories
+func moveBack(moved [][2]string, from string, to string) error {
+	for i := len(moved) - 1; i >= 0; i-- {
+		src, dst := moved[i][0], moved[i][1]
+		err := os.MkdirAll(filepath.Dir(src), 0755)
+		if err == nil {
+			err = move(dst, src)
+		}
+		if err != nil {
+			return fmt.Errorf("data left split between %s and %s, %s is still in %s: %w", from, to, filepath.Base(src), to, diskError(err))
+		}
+		removeEmptyDirs(filepath.Dir(dst), to)
+	}
+	return nil
+}
+
+// move renames a file or directory, falling back to copy then delete across filesystems
+func move(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	// Copy next to dst, so it only appears once it is all there
+	tmp := dst + ".moving"
+	if err := copyAll(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyAll(src string, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyAll(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeEmptyDirs tidies up the directories left behind by a move, stopping at root
+func removeEmptyDirs(dir string, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
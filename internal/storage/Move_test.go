@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMovable(t *testing.T) {
+	from, to := t.TempDir(), filepath.Join(t.TempDir(), "archive")
+	m, err := NewMovable(from, testLayout, func(dir string, layout Layout) (Storage, error) {
+		return Open(FILE, dir, layout)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.WriteBlock(0, 0, testContent[:8])
+	m.MarkVerified(0)
+
+	// Writes carry on while the data moves
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := m.WriteBlock(2, 0, testContent[16:21]); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	if err := m.Move(to); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	m.WriteBlock(1, 0, testContent[8:16])
+
+	if m.Dir() != to || m.Completion().Verified != 1 {
+		t.Errorf("unexpected state after move: %s %+v", m.Dir(), m.Completion())
+	}
+	a, _ := os.ReadFile(filepath.Join(to, "a"))
+	b, _ := os.ReadFile(filepath.Join(to, "dir", "b"))
+	if string(a) != "aaaaaaaaaa" || string(b) != "bbbbb" {
+		t.Errorf("unexpected files %q %q", a, b)
+	}
+	if entries, _ := os.ReadDir(from); len(entries) != 0 {
+		t.Errorf("expected %s to be left empty, got %v", from, entries)
+	}
+
+	// Once closed only the data moves
+	m.Close()
+	if err := m.Move(from); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(from, "dir", "b")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMoveData(t *testing.T) {
+	from, to := t.TempDir(), t.TempDir()
+	s, _ := NewPieceFileStorage(from, filepath.Join(from, PIECE_DIR, testLayout.ID), testLayout)
+	s.WriteBlock(1, 0, testContent[8:16])
+	s.Close()
+	os.WriteFile(filepath.Join(from, "unrelated"), nil, 0644)
+
+	if err := MoveData(testLayout, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(to, PIECE_DIR, testLayout.ID, "1")); err != nil {
+		t.Errorf("piece file not moved: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(from, "unrelated")); err != nil {
+		t.Errorf("unrelated file moved: %v", err)
+	}
+}
+
+func TestMoveDataRollback(t *testing.T) {
+	from, to := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(from, "dir"), 0755)
+	os.WriteFile(filepath.Join(from, "a"), []byte("aaaaaaaaaa"), 0644)
+	os.WriteFile(filepath.Join(from, "dir", "b"), []byte("bbbbb"), 0644)
+	// Something in the way of the second file
+	os.MkdirAll(filepath.Join(to, "dir", "b", "in the way"), 0755)
+
+	if err := MoveData(testLayout, from, to); err == nil {
+		t.Fatal("expected move to fail")
+	}
+	for _, name := range []string{"a", filepath.Join("dir", "b")} {
+		if info, err := os.Stat(filepath.Join(from, name)); err != nil || info.IsDir() {
+			t.Errorf("%s not moved back: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(to, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected a to be moved back, got %v", err)
+	}
+}
+
+func TestCopyAll(t *testing.T) {
+	// The copy used for moves across filesystems
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "copy")
+	os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	os.WriteFile(filepath.Join(src, "dir", "b"), []byte("bbbbb"), 0755)
+	os.Symlink(filepath.Join("dir", "b"), filepath.Join(src, "link"))
+
+	if err := copyAll(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "dir", "b"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("file not copied with its mode: %v", err)
+	}
+	if target, _ := os.Readlink(filepath.Join(dst, "link")); target != filepath.Join("dir", "b") {
+		t.Errorf("unexpected symlink %q", target)
+	}
+}
+
+func TestFinish(t *testing.T) {
+	incomplete, complete := t.TempDir(), t.TempDir()
+	layout := testLayout
+	layout.PartSuffix = PART_SUFFIX
+	m, err := NewMovable(incomplete, layout, func(dir string, layout Layout) (Storage, error) {
+		return Open(FILE, dir, layout)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.WriteBlock(2, 0, testContent[16:21])
+	if _, err := os.Stat(filepath.Join(incomplete, "dir", "b.part")); err != nil {
+		t.Fatalf("expected a part file: %v", err)
+	}
+
+	if err := m.Finish(complete); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(complete, "dir", "b"))
+	if err != nil || string(b) != "bbbbb" {
+		t.Errorf("unexpected finished file %q: %v", b, err)
+	}
+	// Later writes go to the finished files
+	m.WriteBlock(0, 0, testContent[:8])
+	if _, err := os.Stat(filepath.Join(complete, "a")); err != nil {
+		t.Error(err)
+	}
+	if entries, _ := os.ReadDir(incomplete); len(entries) != 0 {
+		t.Errorf("expected nothing left in %s, got %v", incomplete, entries)
+	}
+}
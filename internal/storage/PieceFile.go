@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// PieceFileStorage keeps each piece in its own file under pieceDir until every piece is verified,
+// then moves them into the torrent's files under dir. Half written files never appear in dir.
+type PieceFileStorage struct {
+	verified
+	pieceDir string
+	files    *FileStorage
+}
+
+func NewPieceFileStorage(dir string, pieceDir string, layout Layout) (*PieceFileStorage, error) {
+	if err := os.MkdirAll(pieceDir, 0755); err != nil {
+		return nil, err
+	}
+	return &PieceFileStorage{verified: newVerified(layout), pieceDir: pieceDir, files: NewFileStorage(dir, layout)}, nil
+}
+
+func (s *PieceFileStorage) piecePath(piece int) string {
+	return filepath.Join(s.pieceDir, strconv.Itoa(piece))
+}
+
+func (s *PieceFileStorage) ReadBlock(piece int, offset int, buf []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(buf)); err != nil {
+		return err
+	}
+	if s.Completion().Complete() {
+		return s.files.ReadBlock(piece, offset, buf)
+	}
+	clear(buf)
+	f, err := os.Open(s.piecePath(piece))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(buf, int64(offset)); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (s *PieceFileStorage) WriteBlock(piece int, offset int, data []byte) error {
+	if err := s.layout.checkBlock(piece, offset, len(data)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.piecePath(piece), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, int64(offset))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return diskError(err)
+}
+
+func (s *PieceFileStorage) MarkVerified(piece int) error {
+	complete, err := s.markVerified(piece)
+	if err != nil || !complete {
+		return err
+	}
+	return s.assemble()
+}
+
+// assemble copies every piece into the torrent's files, then removes the piece files
+func (s *PieceFileStorage) assemble() error {
+	buf := make([]byte, s.layout.PieceLength)
+	for piece := 0; piece < s.layout.Pieces; piece++ {
+		data, err := os.ReadFile(s.piecePath(piece))
+		if err != nil {
+			return err
+		}
+		size := int(s.layout.PieceSize(piece))
+		copy(buf, data)
+		clear(buf[min(len(data), size):size])
+		if err := s.files.WriteBlock(piece, 0, buf[:size]); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.pieceDir)
+}
+
+func (s *PieceFileStorage) Close() error {
+	return s.files.Close()
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// FreeSpace is the number of bytes available to us on the filesystem holding path
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// allocated is the number of bytes of disk used by a file, which is less than its size when it is sparse
+func allocated(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+	return 0
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package storage
+
+import "os"
+
+// FreeSpace isn't available on this system, so free space checks are skipped
+func FreeSpace(path string) (uint64, error) {
+	return 0, ErrFreeSpaceUnknown
+}
+
+// allocated can't be found on this system either, so only verified pieces count as being on disk
+func allocated(info os.FileInfo) int64 {
+	return 0
+}
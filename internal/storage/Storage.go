@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Storage keeps a torrent's pieces. Blocks can be read and written concurrently.
+type Storage interface {
+	// ReadBlock fills buf with the piece's data starting at offset
+	ReadBlock(piece int, offset int, buf []byte) error
+	// WriteBlock stores data in the piece starting at offset
+	WriteBlock(piece int, offset int, data []byte) error
+	// MarkVerified records that a piece has been checked against its hash
+	MarkVerified(piece int) error
+	Completion() Completion
+	Close() error
+}
+
+// Names of the storage backends, for Open
+const (
+	FILE      = "file"      // the torrent's files, as they will end up
+	MMAP      = "mmap"      // one memory mapped file holding every piece
+	MEMORY    = "memory"    // nothing on disk, for tests and small streams
+	PIECEFILE = "piecefile" // a file per piece, moved into the torrent's files once complete
+)
+
+// Where piece file storage keeps its pieces under the download directory
+const PIECE_DIR = ".pieces"
+
+// Suffix for files which are still downloading, when asked for
+const PART_SUFFIX = ".part"
+
+var ErrOutOfRange = errors.New("block out of range")
+
+var ErrBadPath = errors.New("unsafe file path")
+
+var ErrClosed = errors.New("storage closed")
+
+// File is one of the torrent's files
+type File struct {
+	Path    []string
+	Length  int64
+	Offset  int64 // where the file starts in the torrent's pieces. Not always the end of the last file for v2 torrents.
+	Padding bool  // BEP 47 padding files are never written, and read as zeros
+}
+
+// Layout maps a torrent's pieces onto its files
+type Layout struct {
+	ID          string // identifies the torrent, keeping working files of different torrents apart
+	PieceLength int64
+	Pieces      int
+	Files       []File
+	PartSuffix  string // added to file names until the download is finished, like ".part"
+}
+
+// Size is the length of the torrent's pieces laid end to end
+func (l Layout) Size() int64 {
+	var size int64
+	for _, file := range l.Files {
+		size = max(size, file.Offset+file.Length)
+	}
+	return size
+}
+
+// PieceSize is the length of a piece, which is shorter than PieceLength for the last one
+func (l Layout) PieceSize(piece int) int64 {
+	return max(min(l.PieceLength, l.Size()-int64(piece)*l.PieceLength), 0)
+}
+
+// checkBlock makes sure a block lies within a piece
+func (l Layout) checkBlock(piece int, offset int, length int) error {
+	if piece < 0 || piece >= l.Pieces || offset < 0 || int64(offset+length) > l.PieceSize(piece) {
+		return fmt.Errorf("%w: piece #%d offset %d length %d", ErrOutOfRange, piece, offset, length)
+	}
+	return nil
+}
+
+// span is the part of a block stored in one file
+type span struct {
+	file       int
+	fileOffset int64
+	blockStart int // offset into the block
+	length     int
+}
+
+// spans maps a block onto the files it covers. Gaps between files have no span.
+func (l Layout) spans(piece int, offset int, length int) []span {
+	start := int64(piece)*l.PieceLength + int64(offset)
+	end := start + int64(length)
+	var spans []span
+	for i, file := range l.Files {
+		fileEnd := file.Offset + file.Length
+		if start < fileEnd && end > file.Offset {
+			from := max(start, file.Offset)
+			to := min(end, fileEnd)
+			spans = append(spans, span{file: i, fileOffset: from - file.Offset, blockStart: int(from - start), length: int(to - from)})
+		}
+	}
+	return spans
+}
+
+// ValidPath makes sure a file's path stays inside the directory it is stored in.
+// Every component must be a plain name: not empty, . or .., and without separators.
+func ValidPath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("%w: empty path", ErrBadPath)
+	}
+	for _, name := range path {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+			return fmt.Errorf("%w: %q", ErrBadPath, strings.Join(path, "/"))
+		}
+	}
+	return nil
+}
+
+// Validate checks the paths of every file, since they come from the torrent
+func (l Layout) Validate() error {
+	if err := ValidPath([]string{l.ID}); err != nil {
+		return err
+	}
+	for _, file := range l.Files {
+		if err := ValidPath(file.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filePath is where a file is stored under dir
+func (l Layout) filePath(dir string, file File) string {
+	return filepath.Join(dir, l.fileName(file))
+}
+
+// fileName is a file's path relative to the torrent's directory
+func (l Layout) fileName(file File) string {
+	return filepath.Join(file.Path...) + l.PartSuffix
+}
+
+// Open creates a storage backend by name. dir is the download directory.
+func Open(backend string, dir string, layout Layout) (Storage, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	switch backend {
+	case FILE, "":
+		return NewFileStorage(dir, layout), nil
+	case MMAP:
+		return NewMmapStorage(filepath.Join(dir, layout.ID), layout)
+	case MEMORY:
+		return NewMemoryStorage(layout), nil
+	case PIECEFILE:
+		return NewPieceFileStorage(dir, filepath.Join(dir, PIECE_DIR, layout.ID), layout)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// Completion is how much of a torrent has been verified
+type Completion struct {
+	Pieces   int   `json:"pieces"`
+	Verified int   `json:"verified"`
+	Bytes    int64 `json:"bytes"` // size of the verified pieces
+}
+
+func (c Completion) Complete() bool {
+	return c.Verified == c.Pieces
+}
+
+// verified tracks which pieces have been verified, for every backend
+type verified struct {
+	layout Layout
+	mu     sync.Mutex
+	pieces []bool
+	count  int
+	bytes  int64
+}
+
+func newVerified(layout Layout) verified {
+	return verified{layout: layout, pieces: make([]bool, layout.Pieces)}
+}
+
+// markVerified returns true if the piece was the last one left
+func (v *verified) markVerified(piece int) (bool, error) {
+	if piece < 0 || piece >= v.layout.Pieces {
+		return false, fmt.Errorf("%w: piece #%d", ErrOutOfRange, piece)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pieces[piece] {
+		return false, nil
+	}
+	v.pieces[piece] = true
+	v.count++
+	v.bytes += v.layout.PieceSize(piece)
+	return v.count == v.layout.Pieces, nil
+}
+
+func (v *verified) Completion() Completion {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return Completion{Pieces: v.layout.Pieces, Verified: v.count, Bytes: v.bytes}
+}
+
+// unverified is the number of bytes of a file in pieces we don't have yet
+func (v *verified) unverified(file File) int64 {
+	if file.Length <= 0 {
+		return 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var n int64
+	first := int(file.Offset / v.layout.PieceLength)
+	last := min(int((file.Offset+file.Length-1)/v.layout.PieceLength), len(v.pieces)-1)
+	for piece := first; piece <= last; piece++ {
+		if !v.pieces[piece] {
+			start := max(int64(piece)*v.layout.PieceLength, file.Offset)
+			end := min(int64(piece+1)*v.layout.PieceLength, file.Offset+file.Length)
+			n += end - start
+		}
+	}
+	return n
+}
+
+func (v *verified) verifiedPieces() []bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]bool{}, v.pieces...)
+}
+
+// restore marks pieces verified without the side effects of MarkVerified, for a backend reopened after a move
+func (v *verified) restore(pieces []bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for piece, ok := range pieces {
+		if ok && piece < len(v.pieces) && !v.pieces[piece] {
+			v.pieces[piece] = true
+			v.count++
+			v.bytes += v.layout.PieceSize(piece)
+		}
+	}
+}
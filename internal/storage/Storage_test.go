@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLayout has a file, padding to align the next file to a piece, then a short file
+var testLayout = Layout{
+	ID:          "test",
+	PieceLength: 8,
+	Pieces:      3,
+	Files: []File{
+		{Path: []string{"a"}, Length: 10, Offset: 0},
+		{Path: []string{".pad", "6"}, Length: 6, Offset: 10, Padding: true},
+		{Path: []string{"dir", "b"}, Length: 5, Offset: 16},
+	},
+}
+
+var testContent = []byte("aaaaaaaaaa\x00\x00\x00\x00\x00\x00bbbbb")
+
+func TestLayout(t *testing.T) {
+	if testLayout.Size() != 21 || testLayout.PieceSize(2) != 5 || testLayout.PieceSize(0) != 8 {
+		t.Errorf("unexpected sizes %d %d", testLayout.Size(), testLayout.PieceSize(2))
+	}
+	spans := testLayout.spans(1, 0, 8)
+	if len(spans) != 2 || spans[0] != (span{file: 0, fileOffset: 8, blockStart: 0, length: 2}) || spans[1] != (span{file: 1, fileOffset: 0, blockStart: 2, length: 6}) {
+		t.Errorf("unexpected spans %+v", spans)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for _, backend := range []string{FILE, MMAP, MEMORY, PIECEFILE} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(backend, dir, testLayout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// Write each piece in two blocks, out of order
+			for _, piece := range []int{2, 0, 1} {
+				start := piece * 8
+				end := start + int(testLayout.PieceSize(piece))
+				half := start + 3
+				if err := s.WriteBlock(piece, 3, testContent[half:end]); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.WriteBlock(piece, 0, testContent[start:half]); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, end-start)
+				if err := s.ReadBlock(piece, 0, buf); err != nil || !bytes.Equal(buf, testContent[start:end]) {
+					t.Errorf("piece #%d read %q: %v", piece, buf, err)
+				}
+			}
+
+			if err := s.WriteBlock(2, 4, []byte("xx")); !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("expected out of range error, got %v", err)
+			}
+			if err := s.ReadBlock(3, 0, make([]byte, 1)); !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("expected out of range error, got %v", err)
+			}
+
+			for piece := 0; piece < testLayout.Pieces; piece++ {
+				if s.Completion().Complete() {
+					t.Errorf("complete before piece #%d was verified", piece)
+				}
+				if err := s.MarkVerified(piece); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.MarkVerified(0)
+			if c := s.Completion(); c != (Completion{Pieces: 3, Verified: 3, Bytes: 21}) {
+				t.Errorf("unexpected completion %+v", c)
+			}
+
+			buf := make([]byte, 5)
+			if err := s.ReadBlock(2, 0, buf); err != nil || string(buf) != "bbbbb" {
+				t.Errorf("read %q after completion: %v", buf, err)
+			}
+			if backend == FILE || backend == PIECEFILE {
+				a, _ := os.ReadFile(filepath.Join(dir, "a"))
+				b, _ := os.ReadFile(filepath.Join(dir, "dir", "b"))
+				if string(a) != "aaaaaaaaaa" || string(b) != "bbbbb" {
+					t.Errorf("unexpected files %q %q", a, b)
+				}
+				if _, err := os.Stat(filepath.Join(dir, ".pad")); !os.IsNotExist(err) {
+					t.Errorf("padding file written")
+				}
+			}
+			if backend == PIECEFILE {
+				if _, err := os.Stat(filepath.Join(dir, PIECE_DIR, "test")); !os.IsNotExist(err) {
+					t.Errorf("piece files left after completion")
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := Open("nfs", t.TempDir(), testLayout); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestBadPaths(t *testing.T) {
+	for _, path := range [][]string{nil, {".."}, {"a", "..", "b"}, {"."}, {""}, {"../b"}, {"/etc/passwd"}, {`a\b`}} {
+		layout := testLayout
+		layout.Files = []File{{Path: path, Length: 21}}
+		if _, err := Open(FILE, t.TempDir(), layout); !errors.Is(err, ErrBadPath) {
+			t.Errorf("%q: expected ErrBadPath, got %v", path, err)
+		}
+	}
+}
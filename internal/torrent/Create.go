@@ -0,0 +1,212 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"torrent-pi/internal/constants"
+	"torrent-pi/internal/peer"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Bounds for the automatically chosen piece length
+const MIN_PIECE_LENGTH = 16 * 1024
+const MAX_PIECE_LENGTH = 16 * 1024 * 1024
+
+// Number of pieces we aim for when choosing a piece length
+const TARGET_PIECES = 1500
+
+// CreateOptions describes a torrent to build from local content
+type CreateOptions struct {
+	Path        string     `json:"path"`         // file or directory to share
+	PieceLength uint       `json:"piece_length"` // 0 picks one from the content size
+	Trackers    [][]string `json:"trackers"`     // tiers of announce urls
+	WebSeeds    []string   `json:"web_seeds"`
+	Comment     string     `json:"comment"`
+	Private     bool       `json:"private"` // BEP 27
+	Source      string     `json:"source"`  // private trackers use this to make the info hash unique
+}
+
+// contentFile is a file on disk included in a torrent we are creating
+type contentFile struct {
+	path   string // on disk
+	length int64
+}
+
+// Create builds a v1 torrent from a file or directory, hashing its pieces in parallel
+func Create(opts CreateOptions) (*Torrent, error) {
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. Find the content
+	name := filepath.Base(root)
+	info := map[string]interface{}{"name": name}
+	var content []contentFile
+	var total int64
+	if stat.IsDir() {
+		var files []interface{}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			fileInfo, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			files = append(files, map[string]interface{}{
+				"length": fileInfo.Size(),
+				"path":   strings.Split(filepath.ToSlash(rel), "/"),
+			})
+			content = append(content, contentFile{path: path, length: fileInfo.Size()})
+			total += fileInfo.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s has no files", opts.Path)
+		}
+		info["files"] = files
+	} else {
+		content = []contentFile{{path: root, length: stat.Size()}}
+		total = stat.Size()
+		info["length"] = total
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s is empty", opts.Path)
+	}
+
+	// 2. Hash the pieces
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	} else if pieceLength < MIN_PIECE_LENGTH || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length must be a power of two of at least %d", MIN_PIECE_LENGTH)
+	}
+	pieces, err := hashContent(content, total, int64(pieceLength))
+	if err != nil {
+		return nil, err
+	}
+	info["piece length"] = pieceLength
+	info["pieces"] = string(pieces)
+	if opts.Private {
+		info["private"] = 1
+	}
+	if opts.Source != "" {
+		info["source"] = opts.Source
+	}
+
+	var infoBytes bytes.Buffer
+	if err := bencode.Marshal(&infoBytes, info); err != nil {
+		return nil, err
+	}
+
+	// 3. Build the torrent
+	t := newTorrent(sha1.Sum(infoBytes.Bytes()), name, peer.NewTiers("", opts.Trackers))
+	if err := t.setInfo(infoBytes.Bytes()); err != nil {
+		return nil, err
+	}
+	t.WebSeeds = opts.WebSeeds
+	t.Comment = opts.Comment
+	t.CreatedBy = string(constants.CLIENT_NAME + constants.VERSION)
+	t.CreationDate = time.Unix(time.Now().Unix(), 0)
+	return t, nil
+}
+
+// choosePieceLength picks the power of two giving roughly TARGET_PIECES pieces
+func choosePieceLength(total int64) uint {
+	pieceLength := uint(MIN_PIECE_LENGTH)
+	for pieceLength < MAX_PIECE_LENGTH && total/int64(pieceLength) > TARGET_PIECES {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashContent returns the concatenated SHA1s of every piece, treating the files as one continuous stream
+func hashContent(content []contentFile, total, pieceLength int64) ([]byte, error) {
+	files := make([]*os.File, len(content))
+	for i, c := range content {
+		f, err := os.Open(c.path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	numPieces := int((total + pieceLength - 1) / pieceLength)
+	hashes := make([]byte, numPieces*sha1.Size)
+	work := make(chan int)
+	errs := make(chan error, runtime.NumCPU())
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for piece := range work {
+				start := int64(piece) * pieceLength
+				n := min(pieceLength, total-start)
+				if err := readContent(content, files, start, buf[:n]); err != nil {
+					errs <- err
+					// Drain the queue so the sender isn't blocked
+					for range work {
+					}
+					return
+				}
+				hash := sha1.Sum(buf[:n])
+				copy(hashes[piece*sha1.Size:], hash[:])
+			}
+		}()
+	}
+	for piece := 0; piece < numPieces; piece++ {
+		work <- piece
+	}
+	close(work)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+		return hashes, nil
+	}
+}
+
+// readContent fills buf from the files, starting at offset in the stream of all files
+func readContent(content []contentFile, files []*os.File, offset int64, buf []byte) error {
+	for i, c := range content {
+		if len(buf) == 0 {
+			break
+		}
+		if offset >= c.length {
+			offset -= c.length
+			continue
+		}
+		n := min(int64(len(buf)), c.length-offset)
+		if _, err := files[i].ReadAt(buf[:n], offset); err != nil {
+			return fmt.Errorf("error reading %s, has it changed? %s", c.path, err)
+		}
+		buf = buf[n:]
+		offset = 0
+	}
+	return nil
+}
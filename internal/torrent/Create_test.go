@@ -0,0 +1,78 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "build")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	a := bytes.Repeat([]byte("a"), 20000)
+	b := bytes.Repeat([]byte("b"), 30000)
+	os.WriteFile(filepath.Join(dir, "a.bin"), a, 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.bin"), b, 0644)
+
+	created, err := Create(CreateOptions{
+		Path:        dir,
+		PieceLength: MIN_PIECE_LENGTH,
+		Trackers:    [][]string{{"http://a.example.com/announce"}},
+		WebSeeds:    []string{"http://mirror.example.com/"},
+		Private:     true,
+		Source:      "builds",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pieces span the boundary between files
+	content := append(a, b...)
+	if len(created.PieceHashes) != 4 {
+		t.Fatalf("expected 4 pieces, got %d", len(created.PieceHashes))
+	}
+	for i := range created.PieceHashes {
+		piece := content[i*MIN_PIECE_LENGTH : min((i+1)*MIN_PIECE_LENGTH, len(content))]
+		if hash := sha1.Sum(piece); !bytes.Equal(hash[:], created.PieceHashes[i]) {
+			t.Errorf("piece %d hash does not match", i)
+		}
+	}
+	if created.Name != "build" || len(created.Files) != 2 || created.Files[1].Path[0] != "sub" || created.TotalLength() != 50000 {
+		t.Errorf("unexpected files %s", created.Files)
+	}
+	if !bytes.Contains(created.InfoBytes, []byte("7:privatei1e6:source6:builds")) {
+		t.Errorf("private flag and source missing from %q", created.InfoBytes)
+	}
+
+	data, err := created.Metainfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := FromMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.InfoHash != created.InfoHash || len(loaded.WebSeeds) != 1 || len(loaded.Trackers) != 1 {
+		t.Errorf("created .torrent did not load back: %s", loaded)
+	}
+
+	magnet := created.Magnet()
+	if !strings.HasPrefix(magnet, "magnet:?xt=urn:btih:"+created.ID()) || !strings.Contains(magnet, "tr=http%3A%2F%2Fa.example.com%2Fannounce") {
+		t.Errorf("unexpected magnet %s", magnet)
+	}
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	for total, expected := range map[int64]uint{
+		1000:               MIN_PIECE_LENGTH,
+		1500 * 1024 * 1024: 1024 * 1024,
+		1 << 50:            MAX_PIECE_LENGTH,
+	} {
+		if pieceLength := choosePieceLength(total); pieceLength != expected {
+			t.Errorf("choosePieceLength(%d) = %d, expected %d", total, pieceLength, expected)
+		}
+	}
+}
@@ -1,21 +1,177 @@
 package torrent
 
-import "fmt"
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"torrent-pi/internal/storage"
+)
 
 type File struct {
 	Length int      `bencode:"length"`
 	Path   []string `bencode:"path"`
+
+	// BEP 47 extensions
+	Attr        string   `bencode:"attr,omitempty"`         // any of p (padding), x (executable), h (hidden), l (symlink)
+	SymlinkPath []string `bencode:"symlink path,omitempty"` // target of a symlink, relative to the torrent's root
+	Sha1        string   `bencode:"sha1,omitempty"`         // SHA1 of the whole file, 20 bytes
 }
 
 func (f File) String() string {
 	return fmt.Sprintf("File: %s (%d)", f.Path[0], f.Length)
 }
 
+// IsPadding is true for the filler files some clients add to align files to pieces.
+// Their content is all zeros and they are never written to disk.
+func (f File) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+func (f File) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+func (f File) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+func (f File) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// filePath is where a file is stored under dir
+func filePath(dir string, file File) string {
+	return filepath.Join(append([]string{dir}, file.Path...)...)
+}
+
+// VerifySha1 checks a completed file against its sha1 key. Files without one always pass.
+func (f File) VerifySha1(path string) (bool, error) {
+	if len(f.Sha1) != 20 {
+		return true, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false, err
+	}
+	return string(hash.Sum(nil)) == f.Sha1, nil
+}
+
+// applyAttributes sets up a completed file stored under root: making it executable, hidden,
+// or replacing it with a symlink
+func (f File) applyAttributes(root string) error {
+	path := filePath(root, f)
+	if f.IsSymlink() {
+		if len(f.SymlinkPath) == 0 {
+			return fmt.Errorf("symlink %s has no symlink path", path)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// The paths were checked when the torrent was read, but the directories on the way
+		// could be symlinks themselves, so make sure both ends resolve inside root
+		target := filePath(root, File{Path: f.SymlinkPath})
+		if !inside(root, filepath.Dir(path)) || !inside(root, filepath.Dir(target)) {
+			return fmt.Errorf("symlink %s leads outside %s", path, root)
+		}
+		link, err := filepath.Rel(filepath.Dir(path), target)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(path); err == nil {
+			if info.IsDir() {
+				return fmt.Errorf("symlink %s is a directory", path)
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(link, path)
+	}
+	if f.IsExecutable() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, info.Mode()|0111); err != nil {
+			return err
+		}
+	}
+	if f.IsHidden() {
+		return setHidden(path)
+	}
+	return nil
+}
+
+// inside is true if path, with any symlinks resolved, is root or under it
+func inside(root string, path string) bool {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// checkPaths makes sure none of a torrent's files, or the targets of its symlinks, lead outside its directory.
+// Single file torrents are stored under their name.
+func checkPaths(name string, files []File) error {
+	if len(files) == 0 {
+		return storage.ValidPath([]string{name})
+	}
+	for _, file := range files {
+		if err := storage.ValidPath(file.Path); err != nil {
+			return err
+		}
+		if file.IsSymlink() {
+			if err := storage.ValidPath(file.SymlinkPath); err != nil {
+				return fmt.Errorf("symlink path: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// completeFiles checks a downloaded file's sha1 and applies its attributes, then creates the torrent's symlinks
+func (t *Torrent) completeFiles(dir string, downloaded File) error {
+	if ok, err := downloaded.VerifySha1(filePath(dir, downloaded)); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s does not match its sha1", filePath(dir, downloaded))
+	}
+	if err := downloaded.applyAttributes(dir); err != nil {
+		return err
+	}
+	for _, file := range t.Files {
+		if file.IsSymlink() {
+			if err := file.applyAttributes(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type Files []File
 
 func (f Files) String() string {
 	var s string
 	for _, file := range f {
+		if file.IsPadding() {
+			continue
+		}
 		s += fmt.Sprintf("%s\n", file)
 	}
 	return s
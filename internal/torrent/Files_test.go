@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"torrent-pi/internal/peer"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// paddedSample is a torrent whose second file is aligned to a piece by a padding file
+func paddedSample(t *testing.T) (*Torrent, []byte, []byte) {
+	a := bytes.Repeat([]byte("a"), 20000)
+	script := []byte("#!/bin/sh\necho hi\n")
+	scriptHash := sha1.Sum(script)
+
+	content := append(append(append([]byte{}, a...), make([]byte, 12768)...), script...)
+	var pieces []byte
+	for start := 0; start < len(content); start += MIN_PIECE_LENGTH {
+		hash := sha1.Sum(content[start:min(start+MIN_PIECE_LENGTH, len(content))])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info := map[string]interface{}{
+		"name":         "release",
+		"piece length": MIN_PIECE_LENGTH,
+		"pieces":       string(pieces),
+		"files": []map[string]interface{}{
+			{"length": len(a), "path": []string{"a.bin"}},
+			{"length": 12768, "path": []string{".pad", "12768"}, "attr": "p"},
+			{"length": len(script), "path": []string{"bin", "run.sh"}, "attr": "x", "sha1": string(scriptHash[:])},
+			{"length": 0, "path": []string{"run"}, "attr": "l", "symlink path": []string{"bin", "run.sh"}},
+		},
+	}
+	var infoBytes bytes.Buffer
+	if err := bencode.Marshal(&infoBytes, info); err != nil {
+		t.Fatal(err)
+	}
+	torrent := newTorrent(sha1.Sum(infoBytes.Bytes()), "", peer.NewTiers("", nil))
+	if err := torrent.setInfo(infoBytes.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return torrent, a, script
+}
+
+func TestFileAttributes(t *testing.T) {
+	torrent, _, _ := paddedSample(t)
+
+	files := torrent.Files
+	if !files[1].IsPadding() || files[0].IsPadding() || !files[2].IsExecutable() || !files[3].IsSymlink() || files[2].IsHidden() {
+		t.Errorf("unexpected attributes %+v", files)
+	}
+	if filepath.Join(files[3].SymlinkPath...) != filepath.Join("bin", "run.sh") || len(files[2].Sha1) != 20 {
+		t.Errorf("unexpected file keys %+v", files)
+	}
+	if s := files.String(); bytes.Contains([]byte(s), []byte(".pad")) {
+		t.Errorf("padding file listed: %s", s)
+	}
+	if torrent.TotalLength() != 20000+12768+18 {
+		t.Errorf("unexpected length %d", torrent.TotalLength())
+	}
+}
+
+func TestWebSeedPadding(t *testing.T) {
+	torrent, a, script := paddedSample(t)
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "release", "bin"), 0755)
+	os.WriteFile(filepath.Join(root, "release", "a.bin"), a, 0644)
+	os.WriteFile(filepath.Join(root, "release", "bin", "run.sh"), script, 0644)
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer server.Close()
+
+	ws := &webSeed{url: server.URL}
+	for i := range torrent.PieceHashes {
+		piece, err := ws.fetchPiece(torrent, uint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !torrent.VerifyPiece(uint(i), piece) {
+			t.Errorf("piece #%d did not verify", i)
+		}
+	}
+}
+
+func TestCompleteFiles(t *testing.T) {
+	torrent, _, script := paddedSample(t)
+	dir := t.TempDir()
+	run := torrent.Files[2]
+	os.MkdirAll(filepath.Join(dir, "bin"), 0755)
+	os.WriteFile(filePath(dir, run), script, 0644)
+
+	if err := torrent.completeFiles(dir, run); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filePath(dir, run)); err != nil || info.Mode()&0111 == 0 {
+		t.Errorf("expected run.sh to be executable")
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "run")); err != nil || target != filepath.Join("bin", "run.sh") {
+		t.Errorf("unexpected symlink %q: %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding file written to disk")
+	}
+
+	os.WriteFile(filePath(dir, run), []byte("corrupt"), 0644)
+	if err := torrent.completeFiles(dir, run); err == nil {
+		t.Errorf("expected sha1 mismatch")
+	}
+}
+
+func TestUnsafePaths(t *testing.T) {
+	for _, files := range [][]map[string]interface{}{
+		{{"length": 1, "path": []string{"..", "evil"}}},
+		{{"length": 1, "path": []string{"/etc", "passwd"}}},
+		{{"length": 1, "path": []string{"a", ""}}},
+		{{"length": 0, "path": []string{"run"}, "attr": "l", "symlink path": []string{"..", "..", "etc", "passwd"}}},
+	} {
+		info := map[string]interface{}{"name": "release", "piece length": MIN_PIECE_LENGTH, "pieces": string(make([]byte, 20)), "files": files}
+		var infoBytes bytes.Buffer
+		bencode.Marshal(&infoBytes, info)
+		torrent := newTorrent(sha1.Sum(infoBytes.Bytes()), "", peer.NewTiers("", nil))
+		if err := torrent.setInfo(infoBytes.Bytes()); err == nil {
+			t.Errorf("expected %v to be rejected", files)
+		}
+	}
+}
+
+func TestSymlinkOutsideRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "keep"), []byte("keep"), 0644)
+	// A directory inside the torrent which is really a symlink out of it
+	os.Symlink(outside, filepath.Join(root, "bin"))
+
+	link := File{Path: []string{"bin", "keep"}, Attr: "l", SymlinkPath: []string{"run.sh"}}
+	if err := link.applyAttributes(root); err == nil {
+		t.Errorf("expected symlink outside root to be refused")
+	}
+	if data, err := os.ReadFile(filepath.Join(outside, "keep")); err != nil || string(data) != "keep" {
+		t.Errorf("file outside root was touched: %q %v", data, err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package torrent
+
+// setHidden does nothing outside windows, where files are hidden by starting their name with a dot
+func setHidden(path string) error {
+	return nil
+}
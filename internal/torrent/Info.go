@@ -0,0 +1,70 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"torrent-pi/internal/peer"
+	"torrent-pi/internal/storage"
+)
+
+// TorrentInfo is the summary of a torrent returned by the web api
+type TorrentInfo struct {
+	ID           string               `json:"id"`
+	InfoHashV2   string               `json:"info_hash_v2,omitempty"`
+	Name         string               `json:"name"`
+	State        State                `json:"state"`
+	Error        string               `json:"error,omitempty"`
+	DataDir      string               `json:"data_dir"`
+	CompleteDir  string               `json:"complete_dir,omitempty"` // where the files go once downloaded
+	Comment      string               `json:"comment,omitempty"`
+	CreatedBy    string               `json:"created_by,omitempty"`
+	CreationDate *time.Time           `json:"creation_date,omitempty"`
+	Length       uint64               `json:"length"`
+	Downloaded   uint64               `json:"downloaded"`
+	Uploaded     uint64               `json:"uploaded"`
+	Trackers     []peer.TrackerState  `json:"trackers"`
+	Scrape       []peer.TrackerScrape `json:"scrape"`
+	Cache        *storage.CacheStats  `json:"cache,omitempty"`
+	Limits       Limits               `json:"limits"`
+	Peers        []PeerInfo           `json:"peers"`
+	Clients      []ClientStats        `json:"clients"`
+}
+
+// ID identifies the torrent in the web api. It is the hex encoded info hash.
+func (t *Torrent) ID() string {
+	return hex.EncodeToString(t.InfoHash[:])
+}
+
+// Info summarises the torrent, including the last scrape of its trackers
+func (t *Torrent) Info() TorrentInfo {
+	info := TorrentInfo{
+		ID:         t.ID(),
+		Name:       t.Name,
+		DataDir:    t.DataDir(),
+		Comment:    t.Comment,
+		CreatedBy:  t.CreatedBy,
+		Length:     t.TotalLength(),
+		Downloaded: atomic.LoadUint64(&t.Downloaded),
+		Uploaded:   atomic.LoadUint64(&t.Uploaded),
+		Trackers:   t.PeerManager.TrackerStates(),
+		Scrape:     t.PeerManager.LastScrape(),
+		Cache:      t.CacheStats(),
+	}
+	info.CompleteDir, _ = t.CompleteDir()
+	info.Limits = t.Limits()
+	info.Peers, info.Clients = t.Peers()
+	state, err := t.State()
+	info.State = state
+	if err != nil {
+		info.Error = err.Error()
+	}
+	if !t.CreationDate.IsZero() {
+		info.CreationDate = &t.CreationDate
+	}
+	if t.InfoHashV2 != [32]byte{} {
+		info.InfoHashV2 = hex.EncodeToString(t.InfoHashV2[:])
+	}
+	return info
+}
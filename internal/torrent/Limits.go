@@ -0,0 +1,44 @@
+package torrent
+
+import (
+	"torrent-pi/internal/ratelimit"
+)
+
+// Limits are a torrent's transfer rates in bytes a second, 0 for unlimited
+type Limits struct {
+	Download     int64 `json:"download"`
+	Upload       int64 `json:"upload"`
+	PeerDownload int64 `json:"peer_download"` // for each peer
+	PeerUpload   int64 `json:"peer_upload"`
+}
+
+// Limits returns the torrent's rate limits
+func (t *Torrent) Limits() Limits {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	return Limits{
+		Download:     t.downLimit.Rate(),
+		Upload:       t.upLimit.Rate(),
+		PeerDownload: t.peerLimits.PeerDownload,
+		PeerUpload:   t.peerLimits.PeerUpload,
+	}
+}
+
+// SetLimits changes the torrent's rate limits, including those of the peers it is connected to
+func (t *Torrent) SetLimits(limits Limits) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	t.downLimit.SetRate(limits.Download)
+	t.upLimit.SetRate(limits.Upload)
+	t.peerLimits = limits
+	for p := range t.peers {
+		p.down.SetRate(limits.PeerDownload)
+		p.up.SetRate(limits.PeerUpload)
+	}
+}
+
+// LimitWithin shares the session's limiters between this torrent and the others in it
+func (t *Torrent) LimitWithin(download *ratelimit.Limiter, upload *ratelimit.Limiter) {
+	t.downLimit.SetParent(download)
+	t.upLimit.SetParent(upload)
+}
@@ -0,0 +1,61 @@
+package torrent
+
+import (
+	"net"
+	"strconv"
+
+	"torrent-pi/internal/magnet"
+	"torrent-pi/internal/peer"
+)
+
+// Magnet formats a magnet link for the torrent
+func (t *Torrent) Magnet() string {
+	m := magnet.Magnet{
+		InfoHash:   t.InfoHash,
+		HasV1:      !t.IsV2Only(),
+		InfoHashV2: t.InfoHashV2,
+		Name:       t.Name,
+		Length:     int64(t.TotalLength()),
+		WebSeeds:   t.WebSeeds,
+	}
+	for _, tracker := range t.Trackers.Trackers() {
+		m.Trackers = append(m.Trackers, tracker.String())
+	}
+	return m.String()
+}
+
+// ScrapeMagnet checks the swarm health on each of a magnet link's trackers, without adding the torrent
+func ScrapeMagnet(m *magnet.Magnet) []peer.TrackerScrape {
+	return peer.ScrapeTrackers(magnetTiers(m).Trackers(), m.InfoHash)
+}
+
+// magnetTiers puts each of a magnet link's trackers in its own tier
+func magnetTiers(m *magnet.Magnet) peer.Tiers {
+	announceList := make([][]string, len(m.Trackers))
+	for i, tracker := range m.Trackers {
+		announceList[i] = []string{tracker}
+	}
+	return peer.NewTiers("", announceList)
+}
+
+// resolvePeers looks up the host:port peer addresses from a magnet link. Unresolvable hosts are skipped.
+func resolvePeers(addrs []string) []peer.Peer {
+	var peers []peer.Peer
+	for _, addr := range addrs {
+		host, portString, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, _ := strconv.ParseUint(portString, 10, 16)
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			if ips, err = net.LookupIP(host); err != nil {
+				continue
+			}
+		}
+		for _, ip := range ips {
+			peers = append(peers, peer.Peer{IP: ip, Port: uint16(port)})
+		}
+	}
+	return peers
+}
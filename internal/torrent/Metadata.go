@@ -0,0 +1,347 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"torrent-pi/internal/client"
+	"torrent-pi/internal/peer"
+	message "torrent-pi/internal/peerMessage"
+)
+
+// Peers we fetch metadata pieces from at the same time
+const METADATA_PEERS = 4
+
+// How long a peer has to send a metadata piece before we ask another peer
+const METADATA_PIECE_TIMEOUT = 20 * time.Second
+
+// Largest info dictionary we will fetch
+const MAX_METADATA_SIZE = 16 * 1024 * 1024
+
+var ErrMetadataTimeout = errors.New("timed out fetching metadata")
+
+// errMetadataDone stops the peers fetching metadata once it is complete, or we have given up
+var errMetadataDone = errors.New("metadata fetch finished")
+
+// metadataFetch assembles the info dictionary from ut_metadata pieces sent by several peers (BEP 9)
+type metadataFetch struct {
+	infoHash [20]byte
+	verify   func(metadata []byte) bool // checks the metadata against the info hash
+	ban      func(ip string)            // called for peers which sent pieces of corrupt metadata
+
+	mu       sync.Mutex
+	size     int
+	round    int // bumped each time the metadata fails to verify
+	pieces   [][]byte
+	from     []string // the peer each piece came from
+	queue    []int    // pieces nobody is fetching
+	changed  chan struct{}
+	claimed  map[string]int // the metadata size each peer told us
+	rejected []metadataCopy // pieces of metadata which failed to verify
+	banned   map[string]bool
+
+	done     chan struct{}
+	doneOnce sync.Once
+	metadata []byte
+	stop     chan struct{} // closed when we give up
+}
+
+// metadataCopy is a piece of metadata a peer sent us
+type metadataCopy struct {
+	piece int
+	data  []byte
+	ip    string
+}
+
+func newMetadataFetch(infoHash [20]byte, verify func([]byte) bool, ban func(ip string)) *metadataFetch {
+	return &metadataFetch{
+		infoHash: infoHash,
+		verify:   verify,
+		ban:      ban,
+		changed:  make(chan struct{}),
+		claimed:  map[string]int{},
+		banned:   map[string]bool{},
+		done:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+}
+
+// setSize sets the metadata size from the first peer to ask for a piece. Later peers must agree with it
+// until the metadata fails to verify, when the size is up for grabs again. Hold mu.
+func (f *metadataFetch) setSize(size int, ip string) error {
+	if size <= 0 || size > MAX_METADATA_SIZE {
+		return fmt.Errorf("bad metadata size: %d", size)
+	}
+	f.claimed[ip] = size
+	if f.size != 0 {
+		if size != f.size {
+			return fmt.Errorf("metadata size %d does not match %d", size, f.size)
+		}
+		return nil
+	}
+
+	f.size = size
+	numPieces := (size + message.METADATA_PAYLOAD_SIZE - 1) / message.METADATA_PAYLOAD_SIZE
+	f.pieces = make([][]byte, numPieces)
+	f.from = make([]string, numPieces)
+	f.queue = make([]int, numPieces)
+	for i := range f.queue {
+		f.queue[i] = i
+	}
+	f.wake()
+	return nil
+}
+
+// next picks a piece for a peer to fetch, and the round it belongs to. Peers are not given pieces they
+// sent in metadata which failed to verify. It returns errMetadataDone once the metadata is complete or we have given up.
+func (f *metadataFetch) next(ip string, size int) (int, int, error) {
+	for {
+		f.mu.Lock()
+		if f.banned[ip] {
+			f.mu.Unlock()
+			return 0, 0, fmt.Errorf("peer sent corrupt metadata")
+		}
+		if err := f.setSize(size, ip); err != nil {
+			f.mu.Unlock()
+			return 0, 0, err
+		}
+		for i, piece := range f.queue {
+			if !f.sentRejected(piece, ip) {
+				f.queue = slices.Delete(f.queue, i, i+1)
+				round := f.round
+				f.mu.Unlock()
+				return piece, round, nil
+			}
+		}
+		if len(f.queue) > 0 {
+			// Make way for a peer which can help
+			f.mu.Unlock()
+			return 0, 0, fmt.Errorf("peer only has pieces of metadata we rejected")
+		}
+		changed := f.changed
+		f.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-f.done:
+			return 0, 0, errMetadataDone
+		case <-f.stop:
+			return 0, 0, errMetadataDone
+		}
+	}
+}
+
+// requeue hands a piece we failed to get to another peer
+func (f *metadataFetch) requeue(piece int, round int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if round == f.round {
+		f.queue = append(f.queue, piece)
+		f.wake()
+	}
+}
+
+// wake lets peers waiting in next look at the queue again. Hold mu.
+func (f *metadataFetch) wake() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// sentRejected is whether a peer sent us a piece which failed to verify. Hold mu.
+func (f *metadataFetch) sentRejected(piece int, ip string) bool {
+	for _, c := range f.rejected {
+		if c.piece == piece && c.ip == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *metadataFetch) isBanned(ip string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.banned[ip]
+}
+
+// banPeer bans a peer we know sent corrupt metadata. Hold mu.
+func (f *metadataFetch) banPeer(ip string) {
+	if !f.banned[ip] {
+		f.banned[ip] = true
+		if f.ban != nil {
+			f.ban(ip)
+		}
+	}
+}
+
+// pieceLength is the size of a metadata piece. Only the last one may be short.
+func (f *metadataFetch) pieceLength(piece int) int {
+	if piece == len(f.pieces)-1 {
+		return f.size - piece*message.METADATA_PAYLOAD_SIZE
+	}
+	return message.METADATA_PAYLOAD_SIZE
+}
+
+// store saves a piece from a peer. Once every piece is in, the metadata is checked against the info hash.
+// If it does not match, all the pieces are fetched again from other peers. Once it does, the peers
+// which sent us pieces that don't match are banned.
+func (f *metadataFetch) store(piece int, round int, data []byte, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if round != f.round {
+		// Fetched before the metadata failed to verify
+		return nil
+	}
+	if piece < 0 || piece >= len(f.pieces) || len(data) != f.pieceLength(piece) {
+		f.queue = append(f.queue, piece)
+		f.wake()
+		return fmt.Errorf("metadata piece %d has bad length %d", piece, len(data))
+	}
+	f.pieces[piece] = data
+	f.from[piece] = ip
+
+	for _, p := range f.pieces {
+		if p == nil {
+			return nil
+		}
+	}
+
+	metadata := bytes.Join(f.pieces, nil)
+	if f.verify(metadata) {
+		f.doneOnce.Do(func() {
+			f.metadata = metadata
+			close(f.done)
+		})
+		f.banLiars(metadata)
+		return nil
+	}
+
+	// We can't tell which piece was corrupt, unless one peer sent them all
+	single := true
+	for i := range f.pieces {
+		f.rejected = append(f.rejected, metadataCopy{i, f.pieces[i], f.from[i]})
+		single = single && f.from[i] == ip
+	}
+	if single {
+		f.banPeer(ip)
+	}
+	// The size may have been a lie too, so the next peer to ask gets to set it
+	f.size = 0
+	f.pieces = nil
+	f.from = nil
+	f.queue = nil
+	f.round++
+	f.wake()
+	return fmt.Errorf("metadata does not match info hash %x", f.infoHash)
+}
+
+// banLiars bans the peers which sent pieces or a size that don't match the verified metadata. Hold mu.
+func (f *metadataFetch) banLiars(metadata []byte) {
+	for _, c := range f.rejected {
+		start := c.piece * message.METADATA_PAYLOAD_SIZE
+		if end := start + len(c.data); end > len(metadata) || !bytes.Equal(c.data, metadata[start:end]) {
+			f.banPeer(c.ip)
+		}
+	}
+	for ip, size := range f.claimed {
+		if size != len(metadata) {
+			f.banPeer(ip)
+		}
+	}
+}
+
+// fetchFrom requests metadata pieces from a single peer until the metadata is complete or the peer fails us
+func (f *metadataFetch) fetchFrom(p peer.Peer, peerID [20]byte, settings client.Settings) error {
+	c, err := client.New(p, peerID, f.infoHash, nil, settings)
+	if err != nil {
+		return err
+	}
+	defer c.Conn.Close()
+
+	if c.Extensions["ut_metadata"] == 0 {
+		return fmt.Errorf("peer does not support ut_metadata")
+	}
+
+	ip := p.IP.String()
+	for {
+		piece, round, err := f.next(ip, c.Metadata_size)
+		if errors.Is(err, errMetadataDone) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := c.RequestMetadataPiece(piece, METADATA_PIECE_TIMEOUT)
+		if err != nil {
+			// Rejected or timed out, let another peer have a go
+			f.requeue(piece, round)
+			return err
+		}
+		if err := f.store(piece, round, data, ip); err != nil {
+			fmt.Println("Metadata error from", ip, err)
+		}
+	}
+}
+
+// fetchMetadata downloads the info dictionary of a magnet link from the swarm.
+// Pieces are requested from several peers at once, and the result is verified against the info hash.
+func (t *Torrent) fetchMetadata() ([]byte, error) {
+	f := newMetadataFetch(t.InfoHash, t.matchesInfoHash, func(ip string) {
+		fmt.Println("Banning peer for sending corrupt metadata:", ip)
+		t.PeerManager.SetPeerStatus(ip, peer.BANNED)
+	})
+	defer close(f.stop)
+
+	tried := map[string]bool{}
+	active := 0
+	finished := make(chan error)
+	deadline := time.After(time.Duration(t.cfg.MetadataTimeout))
+	retry := time.NewTicker(5 * time.Second)
+	defer retry.Stop()
+
+	for {
+		// Keep METADATA_PEERS peers busy with peers we have not tried yet
+		for _, p := range t.PeerManager.GetPeers() {
+			if active >= METADATA_PEERS {
+				break
+			}
+			if tried[p.IP.String()] {
+				continue
+			}
+			tried[p.IP.String()] = true
+			active++
+			go func(p peer.Peer) {
+				err := f.fetchFrom(p, t.PeerID, t.clientSettings())
+				if errors.Is(err, client.ErrBlockedClient) || errors.Is(err, client.ErrSelfConnect) {
+					t.PeerManager.SetPeerStatus(p.IP.String(), peer.BANNED)
+				}
+				select {
+				case finished <- err:
+				case <-f.stop:
+				}
+			}(p)
+		}
+		if active == 0 {
+			// Everyone we know of has failed us
+			t.PeerManager.Reannounce()
+		}
+
+		select {
+		case <-f.done:
+			return f.metadata, nil
+		case err := <-finished:
+			active--
+			if err != nil {
+				fmt.Println("Metadata fetch from peer failed:", err)
+			}
+		case <-retry.C:
+		case <-deadline:
+			return nil, fmt.Errorf("%w for %x", ErrMetadataTimeout, t.InfoHash)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"testing"
+
+	message "torrent-pi/internal/peerMessage"
+)
+
+// metadataPiece is the part of metadata in a ut_metadata piece
+func metadataPiece(metadata []byte, piece int) []byte {
+	start := piece * message.METADATA_PAYLOAD_SIZE
+	return metadata[start:min(start+message.METADATA_PAYLOAD_SIZE, len(metadata))]
+}
+
+func TestMetadataFetchVerifies(t *testing.T) {
+	metadata := bytes.Repeat([]byte("x"), message.METADATA_PAYLOAD_SIZE+100)
+	infoHash := sha1.Sum(metadata)
+
+	var banned []string
+	verify := func(data []byte) bool { return sha1.Sum(data) == infoHash }
+	f := newMetadataFetch(infoHash, verify, func(ip string) { banned = append(banned, ip) })
+	piece, round, err := f.next("10.0.0.1", len(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := f.next("10.0.0.9", len(metadata)+1); err == nil {
+		t.Error("expected error for mismatched metadata size")
+	}
+
+	// A short piece is put back to be fetched again
+	if err := f.store(piece, round, []byte("short"), "10.0.0.1"); err == nil {
+		t.Error("expected error for bad piece length")
+	}
+
+	// Corrupt metadata from several peers doesn't tell us who lied
+	corrupt := append([]byte(nil), metadata...)
+	corrupt[0] = 'y'
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		piece, round, _ := f.next(ip, len(metadata))
+		f.store(piece, round, metadataPiece(corrupt, piece), ip)
+	}
+	if len(banned) != 0 {
+		t.Fatalf("expected nobody to be banned yet, got %v", banned)
+	}
+
+	// Every piece is fetched again from a different peer, then whoever sent a bad piece is banned
+	var pieces []int
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		piece, round, err := f.next(ip, len(metadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.store(piece, round, metadataPiece(metadata, piece), ip); err != nil {
+			t.Fatal(err)
+		}
+		pieces = append(pieces, piece)
+	}
+	if pieces[0] != 0 || pieces[1] != 1 {
+		t.Errorf("expected peers to swap pieces, got %v", pieces)
+	}
+	if _, _, err := f.next("10.0.0.3", len(metadata)); !errors.Is(err, errMetadataDone) {
+		t.Error("expected fetch to be done")
+	}
+	if !bytes.Equal(f.metadata, metadata) {
+		t.Error("metadata does not match")
+	}
+	if len(banned) != 2 || !f.isBanned("10.0.0.2") || !f.isBanned("10.0.0.9") {
+		t.Errorf("expected 10.0.0.2 and 10.0.0.9 to be banned, got %v", banned)
+	}
+}
+
+func TestMetadataFetchSinglePeer(t *testing.T) {
+	metadata := bytes.Repeat([]byte("x"), message.METADATA_PAYLOAD_SIZE+100)
+	infoHash := sha1.Sum(metadata)
+
+	var banned []string
+	verify := func(data []byte) bool { return sha1.Sum(data) == infoHash }
+	f := newMetadataFetch(infoHash, verify, func(ip string) { banned = append(banned, ip) })
+
+	// A peer which sends all the metadata, and gets the size wrong, must have lied
+	corrupt := append(bytes.Clone(metadata), 'y')
+	for i := 0; i < 2; i++ {
+		piece, round, err := f.next("10.0.0.1", len(corrupt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.store(piece, round, metadataPiece(corrupt, piece), "10.0.0.1")
+	}
+	if len(banned) != 1 || !f.isBanned("10.0.0.1") {
+		t.Fatalf("expected 10.0.0.1 to be banned, got %v", banned)
+	}
+
+	// Someone else gets to set the size
+	if _, _, err := f.next("10.0.0.2", len(metadata)); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := f.next("10.0.0.1", len(metadata)); err == nil {
+		t.Error("expected banned peer to be refused")
+	}
+}
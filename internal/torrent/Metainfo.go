@@ -0,0 +1,196 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"torrent-pi/internal/lib"
+	"torrent-pi/internal/utils"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Metainfo holds the keys of a .torrent file which sit outside the info dictionary (BEP 3)
+type Metainfo struct {
+	Announce     string
+	AnnounceList [][]string // BEP 12
+	URLList      []string   // web seeds (BEP 19)
+	CreationDate time.Time
+	Comment      string
+	CreatedBy    string
+
+	// The info dictionary exactly as it appears in the file. Its SHA1 is the info hash.
+	InfoBytes []byte
+
+	// Hashes of each piece of every file larger than a piece, keyed by pieces root (BEP 52)
+	PieceLayers map[[32]byte][][32]byte
+}
+
+// InfoDict is the info dictionary of a v1 torrent (BEP 3)
+type InfoDict struct {
+	Name        string `bencode:"name"`
+	PieceLength uint   `bencode:"piece length"`
+	Pieces      string `bencode:"pieces"`
+	Length      uint   `bencode:"length"`
+	Files       Files  `bencode:"files"`
+	MetaVersion int    `bencode:"meta version"` // 2 for v2 and hybrid torrents (BEP 52)
+}
+
+// setInfo fills in the torrent from its info dictionary
+func (t *Torrent) setInfo(infoBytes []byte) error {
+	var info InfoDict
+	if err := bencode.Unmarshal(bytes.NewReader(infoBytes), &info); err != nil {
+		return fmt.Errorf("invalid info dictionary: %s", err)
+	}
+	if info.PieceLength == 0 || len(info.Pieces)%20 != 0 || (len(info.Pieces) == 0 && info.MetaVersion != 2) {
+		return fmt.Errorf("invalid info dictionary: bad pieces")
+	}
+	if err := checkPaths(info.Name, info.Files); err != nil {
+		return fmt.Errorf("invalid info dictionary: %s", err)
+	}
+
+	t.InfoBytes = infoBytes
+	t.Name = info.Name
+	t.PieceLength = info.PieceLength
+	t.PieceHashesString = info.Pieces
+	t.PieceHashes = utils.SplitStringToBytes(info.Pieces, 20)
+	t.Length = info.Length
+	t.Files = info.Files
+	if info.MetaVersion == 2 {
+		return t.setInfoV2(infoBytes)
+	}
+	return nil
+}
+
+// ParseMetainfo reads the contents of a .torrent file
+func ParseMetainfo(data []byte) (*Metainfo, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid .torrent file: %s", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid .torrent file: not a dictionary")
+	}
+
+	infoBytes, err := lib.BencodeDictValue(data, "info")
+	if err != nil {
+		return nil, fmt.Errorf("invalid .torrent file: %s", err)
+	}
+	if len(infoBytes) == 0 || infoBytes[0] != 'd' {
+		return nil, fmt.Errorf("invalid .torrent file: info is not a dictionary")
+	}
+
+	m := &Metainfo{InfoBytes: infoBytes}
+	m.Announce, _ = dict["announce"].(string)
+	m.Comment, _ = dict["comment"].(string)
+	m.CreatedBy, _ = dict["created by"].(string)
+	if date, ok := dict["creation date"].(int64); ok {
+		m.CreationDate = time.Unix(date, 0)
+	}
+	if tiers, ok := dict["announce-list"].([]interface{}); ok {
+		for _, tier := range tiers {
+			m.AnnounceList = append(m.AnnounceList, stringList(tier))
+		}
+	}
+	// url-list is either a single url or a list of them
+	m.URLList = stringList(dict["url-list"])
+	if m.PieceLayers, err = parsePieceLayers(dict["piece layers"]); err != nil {
+		return nil, fmt.Errorf("invalid .torrent file: %s", err)
+	}
+
+	return m, nil
+}
+
+// InfoHash is the SHA1 of the info dictionary.
+// v2 only torrents have no v1 info hash, so use the SHA256 truncated to 20 bytes.
+func (m *Metainfo) InfoHash() [20]byte {
+	if _, err := lib.BencodeDictValue(m.InfoBytes, "pieces"); err != nil {
+		if v2 := m.InfoHashV2(); v2 != [32]byte{} {
+			return [20]byte(v2[:20])
+		}
+	}
+	return sha1.Sum(m.InfoBytes)
+}
+
+// InfoHashV2 is the SHA256 of the info dictionary of a v2 or hybrid torrent, or zero for v1 torrents
+func (m *Metainfo) InfoHashV2() [32]byte {
+	if version, err := lib.BencodeDictValue(m.InfoBytes, "meta version"); err != nil || string(version) != "i2e" {
+		return [32]byte{}
+	}
+	return sha256.Sum256(m.InfoBytes)
+}
+
+// Metainfo encodes the torrent as a .torrent file.
+// The info dictionary is written exactly as received, so the file hashes back to the torrent's info hash.
+func (t *Torrent) Metainfo() ([]byte, error) {
+	if len(t.InfoBytes) == 0 {
+		return nil, fmt.Errorf("metadata for %x not fetched yet", t.InfoHash)
+	}
+
+	// Dictionary keys must be written in sorted order
+	var b bytes.Buffer
+	b.WriteString("d")
+	trackers := t.Trackers.List()
+	if len(trackers) > 0 {
+		writeBencodeKey(&b, "announce", trackers[0][0])
+		writeBencodeKey(&b, "announce-list", trackers)
+	}
+	if t.Comment != "" {
+		writeBencodeKey(&b, "comment", t.Comment)
+	}
+	if t.CreatedBy != "" {
+		writeBencodeKey(&b, "created by", t.CreatedBy)
+	}
+	if !t.CreationDate.IsZero() {
+		writeBencodeKey(&b, "creation date", t.CreationDate.Unix())
+	}
+	bencode.Marshal(&b, "info")
+	b.Write(t.InfoBytes)
+	t.layersMu.RLock()
+	if len(t.pieceLayers) > 0 {
+		layers := map[string]string{}
+		for root, layer := range t.pieceLayers {
+			var hashes bytes.Buffer
+			for _, hash := range layer {
+				hashes.Write(hash[:])
+			}
+			layers[string(root[:])] = hashes.String()
+		}
+		writeBencodeKey(&b, "piece layers", layers)
+	}
+	t.layersMu.RUnlock()
+	if len(t.WebSeeds) > 0 {
+		writeBencodeKey(&b, "url-list", t.WebSeeds)
+	}
+	b.WriteString("e")
+	return b.Bytes(), nil
+}
+
+func writeBencodeKey(b *bytes.Buffer, key string, value interface{}) {
+	bencode.Marshal(b, key)
+	bencode.Marshal(b, value)
+}
+
+// stringList reads a generically decoded string or list of strings
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestParseMetainfo(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "sample",
+		"piece length": 16384,
+		"pieces":       string(make([]byte, 40)),
+		"files": []interface{}{
+			map[string]interface{}{"length": 20000, "path": []string{"a.mkv"}},
+			map[string]interface{}{"length": 100, "path": []string{"subs", "a.srt"}},
+		},
+	}
+	var infoBytes bytes.Buffer
+	bencode.Marshal(&infoBytes, info)
+
+	var file bytes.Buffer
+	bencode.Marshal(&file, map[string]interface{}{
+		"announce":      "udp://tracker.example.com:1337/announce",
+		"announce-list": [][]string{{"udp://a.example.com:1337/announce", "http://b.example.com/announce"}, {"http://c.example.com/announce"}},
+		"url-list":      "http://mirror.example.com/files/",
+		"comment":       "a comment",
+		"created by":    "torrent-pi",
+		"creation date": 1700000000,
+		"info":          info,
+	})
+
+	m, err := ParseMetainfo(file.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.InfoBytes, infoBytes.Bytes()) {
+		t.Errorf("info dictionary not preserved: %q", m.InfoBytes)
+	}
+	if m.InfoHash() != sha1.Sum(infoBytes.Bytes()) {
+		t.Error("info hash is not the SHA1 of the info dictionary")
+	}
+	if len(m.AnnounceList) != 2 || len(m.AnnounceList[0]) != 2 || m.Announce == "" {
+		t.Errorf("unexpected trackers %v %v", m.Announce, m.AnnounceList)
+	}
+	if len(m.URLList) != 1 || m.Comment != "a comment" || m.CreatedBy != "torrent-pi" || m.CreationDate.Unix() != 1700000000 {
+		t.Errorf("unexpected metainfo %+v", m)
+	}
+
+	torrent, err := FromMetadata(file.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Name != "sample" || torrent.TotalLength() != 20100 || len(torrent.PieceHashes) != 2 {
+		t.Errorf("unexpected torrent %s", torrent)
+	}
+	// announce is ignored when there is an announce-list
+	if len(torrent.Trackers) != 2 {
+		t.Errorf("expected 2 tiers, got %v", torrent.Trackers)
+	}
+}
+
+func TestMetainfoExport(t *testing.T) {
+	// Keys out of order and an unknown key, which a decode & re-encode would not preserve
+	info := "d4:name6:sample6:lengthi5e12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei1ee"
+	var file bytes.Buffer
+	bencode.Marshal(&file, map[string]interface{}{
+		"announce":      "http://a.example.com/announce",
+		"announce-list": [][]string{{"http://a.example.com/announce"}, {"udp://b.example.com:1337/announce"}},
+		"comment":       "a comment",
+		"creation date": 1700000000,
+		"url-list":      []string{"http://mirror.example.com/files/"},
+		"info":          info,
+	})
+	// Splice the info dictionary in as raw bytes
+	data := bytes.Replace(file.Bytes(), []byte(fmt.Sprintf("4:info%d:", len(info))), []byte("4:info"), 1)
+
+	original, err := FromMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := original.Metainfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseMetainfo(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InfoHash() != original.InfoHash {
+		t.Error("exported .torrent does not hash back to the info hash")
+	}
+	if m.Announce != "http://a.example.com/announce" || len(m.AnnounceList) != 2 || m.Comment != "a comment" ||
+		m.CreationDate.Unix() != 1700000000 || len(m.URLList) != 1 {
+		t.Errorf("unexpected exported metainfo %+v", m)
+	}
+
+	// Magnet torrents can't be exported until we have the info dictionary
+	if _, err := newTorrent(original.InfoHash, "sample", nil).Metainfo(); err == nil {
+		t.Error("expected error exporting torrent without metadata")
+	}
+}
+
+func TestParseMetainfoInvalid(t *testing.T) {
+	for _, data := range []string{"", "le", "d4:name4:teste", "d4:infoi1ee", "d4:infod"} {
+		if _, err := ParseMetainfo([]byte(data)); err == nil {
+			t.Errorf("expected error parsing %q", data)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"torrent-pi/internal/client"
+	"torrent-pi/internal/peer"
+	"torrent-pi/internal/ratelimit"
+)
+
+// PeerInfo describes a peer we are connected to
+type PeerInfo struct {
+	Address    string          `json:"address"`
+	PeerID     string          `json:"peer_id"` // printable characters as they are, others escaped
+	Client     peer.ClientInfo `json:"client"`
+	Downloaded uint64          `json:"downloaded"`
+}
+
+// ClientStats adds up the peers running each client
+type ClientStats struct {
+	Name       string `json:"name"`
+	Peers      int    `json:"peers"`
+	Downloaded uint64 `json:"downloaded"`
+}
+
+// connectedPeer is a peer we are downloading from
+type connectedPeer struct {
+	address    string
+	peerID     [20]byte
+	client     peer.ClientInfo
+	downloaded uint64 // updated atomically
+	down       *ratelimit.Limiter
+	up         *ratelimit.Limiter
+}
+
+// addPeer keeps track of a peer we've connected to, until removePeer.
+// The connection is slowed to the limits of the peer, the torrent and the session.
+func (t *Torrent) addPeer(c *client.Client) *connectedPeer {
+	p := &connectedPeer{
+		address: c.Conn.RemoteAddr().String(),
+		peerID:  c.RemotePeerID,
+		client:  c.ClientInfo(),
+	}
+	fmt.Printf("Connected to %s running %s\n", p.address, p.client)
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	if t.peers == nil {
+		t.peers = map[*connectedPeer]bool{}
+	}
+	p.down = ratelimit.New(t.peerLimits.PeerDownload, t.downLimit)
+	p.up = ratelimit.New(t.peerLimits.PeerUpload, t.upLimit)
+	c.Conn = ratelimit.NewConn(c.Conn, p.down, p.up)
+	t.peers[p] = true
+	return p
+}
+
+func (t *Torrent) removePeer(p *connectedPeer) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	delete(t.peers, p)
+}
+
+// Peers lists the peers we are connected to, and how much each client has sent us
+func (t *Torrent) Peers() ([]PeerInfo, []ClientStats) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	peers := make([]PeerInfo, 0, len(t.peers))
+	byClient := map[string]*ClientStats{}
+	for p := range t.peers {
+		info := PeerInfo{
+			Address:    p.address,
+			PeerID:     printable(p.peerID[:]),
+			Client:     p.client,
+			Downloaded: atomic.LoadUint64(&p.downloaded),
+		}
+		peers = append(peers, info)
+
+		name := info.Client.Name
+		if name == "" {
+			name = "unknown"
+		}
+		if byClient[name] == nil {
+			byClient[name] = &ClientStats{Name: name}
+		}
+		byClient[name].Peers++
+		byClient[name].Downloaded += info.Downloaded
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+
+	clients := make([]ClientStats, 0, len(byClient))
+	for _, stats := range byClient {
+		clients = append(clients, *stats)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return peers, clients
+}
+
+// printable shows a peer ID as text, escaping the random bytes many clients end them with
+func printable(id []byte) string {
+	s := make([]byte, 0, len(id))
+	for _, b := range id {
+		if b >= ' ' && b <= '~' {
+			s = append(s, b)
+		} else {
+			s = append(s, fmt.Sprintf("\\x%02x", b)...)
+		}
+	}
+	return string(s)
+}
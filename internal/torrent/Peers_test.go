@@ -0,0 +1,29 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+
+	"torrent-pi/internal/peer"
+)
+
+func TestPeers(t *testing.T) {
+	torrent := newTorrent([20]byte{}, "sample", nil)
+	torrent.peers = map[*connectedPeer]bool{
+		{address: "10.0.0.2:6881", client: peer.ClientInfo{Name: "qBittorrent", Version: "4.5.2"}, downloaded: 100}: true,
+		{address: "10.0.0.1:6881", client: peer.ClientInfo{Name: "qBittorrent", Version: "4.6.0"}, downloaded: 50}:  true,
+		{address: "10.0.0.3:6881", peerID: [20]byte{'-', 'X', 0xff}}:                                                true,
+	}
+
+	peers, clients := torrent.Info().Peers, torrent.Info().Clients
+	if len(peers) != 3 || peers[0].Address != "10.0.0.1:6881" {
+		t.Fatalf("expected peers sorted by address, got %+v", peers)
+	}
+	if peers[2].PeerID != `-X\xff`+strings.Repeat(`\x00`, 17) {
+		t.Errorf("peer ID not escaped: %q", peers[2].PeerID)
+	}
+	expected := []ClientStats{{Name: "qBittorrent", Peers: 2, Downloaded: 150}, {Name: "unknown", Peers: 1}}
+	if len(clients) != 2 || clients[0] != expected[0] || clients[1] != expected[1] {
+		t.Errorf("expected %+v, got %+v", expected, clients)
+	}
+}
@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"container/heap"
+	"sync"
+
+	"torrent-pi/internal/lib"
+)
+
+// pieceQueue holds the pieces left to download, earliest first. Peers and web seeds share it.
+// A popped piece is in flight until it is put back with Push, or Done once it has been verified.
+type pieceQueue struct {
+	mu       sync.Mutex
+	changed  *sync.Cond // signalled when a piece comes back or lands
+	pq       lib.PriorityQueue
+	inFlight map[uint]bool
+	end      uint
+	closed   bool
+}
+
+// newPieceQueue queues the pieces from startPiece up to, not including, endPiece, leaving out those we have.
+// A nil have queues every piece.
+func newPieceQueue(startPiece, endPiece uint, have func(pieceIndex uint) bool) *pieceQueue {
+	q := &pieceQueue{end: endPiece, inFlight: map[uint]bool{}}
+	q.changed = sync.NewCond(&q.mu)
+	for pieceIndex := startPiece; pieceIndex < endPiece; pieceIndex++ {
+		if have != nil && have(pieceIndex) {
+			continue
+		}
+		q.pq = append(q.pq, &lib.Item{Value: pieceIndex, Priority: q.priority(pieceIndex), Index: len(q.pq)})
+	}
+	heap.Init(&q.pq)
+	return q
+}
+
+func (q *pieceQueue) priority(pieceIndex uint) int {
+	return max(int(q.end-pieceIndex), 1)
+}
+
+// Pop takes the first piece for which has returns true. A nil has accepts any piece.
+// While other pieces are in flight it waits, as they may fail and come back.
+// Nothing is returned once the queue is closed.
+func (q *pieceQueue) Pop(has func(pieceIndex uint) bool) (uint, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed {
+		if pieceIndex, ok := q.take(has); ok {
+			q.inFlight[pieceIndex] = true
+			return pieceIndex, true
+		}
+		if len(q.inFlight) == 0 {
+			break
+		}
+		q.changed.Wait()
+	}
+	return 0, false
+}
+
+// take removes the first piece for which has returns true. Hold mu.
+func (q *pieceQueue) take(has func(pieceIndex uint) bool) (uint, bool) {
+	var skipped []uint
+	defer func() {
+		for _, pieceIndex := range skipped {
+			heap.Push(&q.pq, lib.NewPriorityItem(pieceIndex, q.priority(pieceIndex)))
+		}
+	}()
+	for !q.pq.IsEmpty() {
+		pieceIndex := heap.Pop(&q.pq).(uint)
+		if has == nil || has(pieceIndex) {
+			return pieceIndex, true
+		}
+		skipped = append(skipped, pieceIndex)
+	}
+	return 0, false
+}
+
+// Push puts back a piece which failed to download or verify
+func (q *pieceQueue) Push(pieceIndex uint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inFlight, pieceIndex)
+	heap.Push(&q.pq, lib.NewPriorityItem(pieceIndex, q.priority(pieceIndex)))
+	q.changed.Broadcast()
+}
+
+// Done lands a piece which has been verified
+func (q *pieceQueue) Done(pieceIndex uint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inFlight, pieceIndex)
+	q.changed.Broadcast()
+}
+
+func (q *pieceQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pq.Len()
+}
+
+// Close stops the download, leaving the remaining pieces queued
+func (q *pieceQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.changed.Broadcast()
+}
@@ -0,0 +1,32 @@
+package torrent
+
+// State is what a torrent is doing, as shown by the web api
+type State string
+
+const (
+	DOWNLOADING State = "downloading"
+	COMPLETED   State = "completed"
+	ERRORED     State = "error" // stopped, see Err
+)
+
+// State returns what the torrent is doing, and why it stopped if there was an error
+func (t *Torrent) State() (State, error) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	if t.state == "" {
+		return DOWNLOADING, nil
+	}
+	return t.state, t.err
+}
+
+func (t *Torrent) setState(state State, err error) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	t.state = state
+	t.err = err
+}
+
+// SetCompleted marks a torrent which finished downloading in an earlier run, so it isn't downloaded again
+func (t *Torrent) SetCompleted() {
+	t.setState(COMPLETED, nil)
+}
@@ -0,0 +1,206 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"torrent-pi/internal/storage"
+)
+
+// errCorruptPiece is returned by savePiece for a piece which doesn't match its hash
+var errCorruptPiece = errors.New("piece failed verification")
+
+// StorageLayout maps the torrent's pieces onto its files for a storage backend
+func (t *Torrent) StorageLayout() storage.Layout {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	return t.storageLayout()
+}
+
+// storageLayout is StorageLayout with dataMu held
+func (t *Torrent) storageLayout() storage.Layout {
+	layout := storage.Layout{ID: t.ID(), PieceLength: int64(t.PieceLength), Pieces: len(t.PieceHashes), PartSuffix: t.partSuffix}
+	if len(t.Files) == 0 {
+		layout.Files = []storage.File{{Path: []string{t.Name}, Length: int64(t.Length)}}
+		return layout
+	}
+	if t.IsV2Only() {
+		layout.Pieces = 0
+		for _, file := range t.V2Files {
+			layout.Pieces += t.filePieces(file)
+		}
+	}
+	for i, file := range t.Files {
+		layout.Files = append(layout.Files, storage.File{
+			Path:    file.Path,
+			Length:  int64(file.Length),
+			Offset:  int64(t.fileOffset(i)),
+			Padding: file.IsPadding(),
+		})
+	}
+	return layout
+}
+
+// openStorage sets up the torrent's storage backend, unless it already has one, behind a cache of CacheSize bytes
+func (t *Torrent) openStorage() error {
+	if t.cache.Load() != nil {
+		return nil
+	}
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	layout := t.storageLayout()
+	if t.Storage == nil {
+		backend := t.StorageBackend
+		m, err := storage.NewMovable(t.dataDirLocked(), layout, func(dir string, layout storage.Layout) (storage.Storage, error) {
+			return storage.Open(backend, dir, layout)
+		})
+		if err != nil {
+			return err
+		}
+		// Pieces verified by an earlier download are already in place
+		for piece := 0; piece < layout.Pieces; piece++ {
+			if t.hasPiece(uint(piece)) {
+				m.MarkVerified(piece)
+			}
+		}
+		t.movable = m
+		t.Storage = m
+	}
+	cache := storage.NewCache(t.Storage, layout, t.CacheSize, func(piece int, data []byte) bool {
+		return t.VerifyPiece(uint(piece), data)
+	})
+	t.cache.Store(cache)
+	t.Storage = cache
+	return nil
+}
+
+// savePiece writes a downloaded piece to the cache and waits for it to be checked against the metadata
+func (t *Torrent) savePiece(cache *storage.Cache, layout storage.Layout, pieceIndex uint, data []byte) error {
+	data = data[:min(len(data), int(layout.PieceSize(int(pieceIndex))))]
+	ok, err := cache.WritePiece(int(pieceIndex), data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Printf("Checksum Fail! for piece #%v\n", pieceIndex)
+		return fmt.Errorf("%w: #%d", errCorruptPiece, pieceIndex)
+	}
+	fmt.Printf("Matching Checksums for piece #%v!\n", pieceIndex)
+	atomic.AddUint64(&t.Downloaded, uint64(len(data)))
+	return nil
+}
+
+// closeStorage closes the storage opened by openStorage, so the next download opens it again.
+// The closed movable is kept, for Move and finish to move its data.
+func (t *Torrent) closeStorage() error {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	cache := t.cache.Swap(nil)
+	if cache == nil {
+		return nil
+	}
+	t.Storage = nil
+	return cache.Close()
+}
+
+// DataDir is where the torrent's files are stored
+func (t *Torrent) DataDir() string {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	return t.dataDirLocked()
+}
+
+func (t *Torrent) dataDirLocked() string {
+	if t.dataDir == "" {
+		return t.cfg.DataDir
+	}
+	return t.dataDir
+}
+
+// SetDataDir chooses where the torrent's files go before downloading starts. Use Move after that.
+func (t *Torrent) SetDataDir(dir string) {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	t.dataDir = dir
+}
+
+// Move relocates the torrent's data to dir. Reads and writes wait until the move is done,
+// downloaded pieces are held in the cache meanwhile.
+func (t *Torrent) Move(dir string) error {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	if t.movable != nil {
+		err := t.movable.Move(dir)
+		t.dataDir = t.movable.Dir()
+		return err
+	}
+	if err := storage.MoveData(t.storageLayout(), t.dataDirLocked(), dir); err != nil {
+		return err
+	}
+	t.dataDir = dir
+	return nil
+}
+
+// SetCompleteDir stages the download: files are named with partSuffix, if any, until the download
+// is finished, then moved to dir. An empty dir leaves them where they are.
+func (t *Torrent) SetCompleteDir(dir string, partSuffix string) {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	t.completeDir = dir
+	t.partSuffix = partSuffix
+}
+
+// CompleteDir is where the files will go when finished, and the suffix they have until then
+func (t *Torrent) CompleteDir() (string, string) {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	return t.completeDir, t.partSuffix
+}
+
+// finish moves downloaded files out of staging into the complete directory, under their final names
+func (t *Torrent) finish() error {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	dir := t.completeDir
+	if dir == "" {
+		dir = t.dataDirLocked()
+	}
+	var err error
+	if t.movable != nil {
+		err = t.movable.Finish(dir)
+	} else {
+		err = storage.FinishData(t.storageLayout(), t.dataDirLocked(), dir)
+	}
+	if err != nil {
+		return err
+	}
+	t.dataDir, t.completeDir, t.partSuffix = dir, "", ""
+	return nil
+}
+
+// CacheStats returns the counters of the torrent's cache, or nil when it isn't downloading
+func (t *Torrent) CacheStats() *storage.CacheStats {
+	cache := t.cache.Load()
+	if cache == nil {
+		return nil
+	}
+	stats := cache.Stats()
+	return &stats
+}
+
+// filesOnDisk is true once the torrent's files can be found in its data directory
+func (t *Torrent) filesOnDisk() bool {
+	t.dataMu.Lock()
+	defer t.dataMu.Unlock()
+	if t.movable == nil {
+		return false
+	}
+	switch s := t.movable.Backend().(type) {
+	case *storage.FileStorage:
+		return true
+	case *storage.PieceFileStorage:
+		return s.Completion().Complete()
+	}
+	return false
+}
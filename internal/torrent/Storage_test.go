@@ -0,0 +1,163 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"torrent-pi/internal/storage"
+)
+
+func TestStorageLayout(t *testing.T) {
+	torrent, a, script := paddedSample(t)
+	layout := torrent.StorageLayout()
+	if layout.Pieces != 3 || layout.Size() != 20000+12768+18 || !layout.Files[1].Padding || layout.Files[2].Offset != 32768 {
+		t.Errorf("unexpected layout %+v", layout)
+	}
+
+	// Pieces written to storage come back out of the right files
+	s := storage.NewMemoryStorage(layout)
+	content := append(append(append([]byte{}, a...), make([]byte, 12768)...), script...)
+	for piece := 0; piece < layout.Pieces; piece++ {
+		data := content[piece*MIN_PIECE_LENGTH : min((piece+1)*MIN_PIECE_LENGTH, len(content))]
+		if err := s.WriteBlock(piece, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		s.ReadBlock(piece, 0, buf)
+		if !bytes.Equal(buf, data) || !torrent.VerifyPiece(uint(piece), buf) {
+			t.Errorf("piece #%d did not verify", piece)
+		}
+	}
+}
+
+func TestStorageCache(t *testing.T) {
+	torrent, a, _ := paddedSample(t)
+	if torrent.CacheStats() != nil {
+		t.Errorf("expected no cache before downloading")
+	}
+	backend := storage.NewMemoryStorage(torrent.StorageLayout())
+	torrent.Storage = backend
+	torrent.CacheSize = storage.DEFAULT_CACHE_SIZE
+	if err := torrent.openStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent.Storage.WriteBlock(0, 0, a[:MIN_PIECE_LENGTH])
+	torrent.Storage.WriteBlock(1, 0, a[:MIN_PIECE_LENGTH])
+	torrent.cache.Load().Flush()
+	if c := backend.Completion(); c.Verified != 1 {
+		t.Errorf("expected only the good piece to be verified, got %+v", c)
+	}
+	if stats := torrent.CacheStats(); stats == nil || stats.WriteHits != 2 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+	torrent.closeStorage()
+	if torrent.Storage != nil || torrent.CacheStats() != nil {
+		t.Errorf("expected storage to be let go once closed")
+	}
+}
+
+func TestDownloadAgain(t *testing.T) {
+	withShortBackoff(t)
+	torrent, server := webSeedSample(t, func(h http.Handler) http.Handler { return h })
+	torrent.WebSeeds = []string{server.URL}
+	torrent.SelectedFiles = []int{1}
+	torrent.SetDataDir(t.TempDir())
+
+	// As after a move, or when a resumed torrent is added again
+	for i := 0; i < 2; i++ {
+		torrent.Download()
+		if state, err := torrent.State(); state != COMPLETED {
+			t.Fatalf("download %d: expected completed, got %s %v", i, state, err)
+		}
+	}
+}
+
+// diskFullStorage fails every write as if the disk had filled up
+type diskFullStorage struct {
+	*storage.MemoryStorage
+}
+
+func (s diskFullStorage) WriteBlock(piece int, offset int, data []byte) error {
+	return fmt.Errorf("%w: write failed", storage.ErrDiskFull)
+}
+
+func TestDownloadDiskFull(t *testing.T) {
+	withShortBackoff(t)
+	for _, full := range []bool{false, true} {
+		torrent, server := webSeedSample(t, func(h http.Handler) http.Handler { return h })
+		torrent.WebSeeds = []string{server.URL}
+		torrent.SelectedFiles = []int{1}
+		torrent.Storage = storage.NewMemoryStorage(torrent.StorageLayout())
+		if full {
+			torrent.Storage = diskFullStorage{torrent.Storage.(*storage.MemoryStorage)}
+		}
+		torrent.Download()
+
+		state, err := torrent.State()
+		if full && (state != ERRORED || !errors.Is(err, storage.ErrDiskFull)) {
+			t.Errorf("expected download to stop with a full disk, got %s %v", state, err)
+		}
+		if !full && (state != COMPLETED || err != nil) {
+			t.Errorf("expected download to complete, got %s %v", state, err)
+		}
+		if info := torrent.Info(); full && info.Error == "" {
+			t.Errorf("expected error in info")
+		}
+	}
+}
+
+func TestDownloadStaging(t *testing.T) {
+	withShortBackoff(t)
+	torrent, server := webSeedSample(t, func(h http.Handler) http.Handler { return h })
+	torrent.WebSeeds = []string{server.URL}
+	torrent.SelectedFiles = []int{1}
+	incomplete, complete := t.TempDir(), t.TempDir()
+	torrent.SetDataDir(incomplete)
+	torrent.SetCompleteDir(complete, storage.PART_SUFFIX)
+
+	var completed *Torrent
+	torrent.OnComplete = func(t *Torrent) { completed = t }
+	torrent.Download()
+
+	if completed != torrent || torrent.DataDir() != complete {
+		t.Fatalf("expected download to finish in %s, got %s", complete, torrent.DataDir())
+	}
+	if _, err := os.Stat(filepath.Join(complete, "sub", "b b.bin")); err != nil {
+		t.Errorf("file not moved to complete dir: %v", err)
+	}
+	if entries, _ := os.ReadDir(incomplete); len(entries) != 0 {
+		t.Errorf("expected nothing left in %s, got %v", incomplete, entries)
+	}
+	if dir, suffix := torrent.CompleteDir(); dir != "" || suffix != "" {
+		t.Errorf("expected staging to be cleared, got %q %q", dir, suffix)
+	}
+}
+
+func TestDownloadLastPiece(t *testing.T) {
+	withShortBackoff(t)
+	torrent, server := webSeedSample(t, func(h http.Handler) http.Handler { return h })
+	torrent.WebSeeds = []string{server.URL}
+	torrent.SelectedFiles = []int{1}
+	dir := t.TempDir()
+	torrent.SetDataDir(dir)
+	torrent.Download()
+
+	// b b.bin runs from byte 20000 to the end of the torrent, pieces 1 to 3
+	data, err := os.ReadFile(filepath.Join(dir, "sub", "b b.bin"))
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte("b"), 30000)) {
+		t.Errorf("file not fully downloaded: %d bytes, %v", len(data), err)
+	}
+	if !torrent.hasPiece(1) || !torrent.hasPiece(3) || torrent.missingPieces(1, 4) != 0 {
+		t.Errorf("expected pieces 1 to 3 verified")
+	}
+	// Piece 0 only holds the other file, so the torrent as a whole isn't complete
+	if torrent.hasPiece(0) || torrent.Complete() {
+		t.Errorf("expected the torrent to be incomplete")
+	}
+}
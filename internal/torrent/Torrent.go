@@ -1,27 +1,24 @@
 package torrent
 
 import (
-	"bytes"
-	"container/heap"
-	"crypto/sha1"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
-	"net/url"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"torrent-pi/internal/client"
+	"torrent-pi/internal/config"
 	"torrent-pi/internal/constants"
-	"torrent-pi/internal/lib"
+	"torrent-pi/internal/magnet"
 	"torrent-pi/internal/peer"
 	message "torrent-pi/internal/peerMessage"
-	"torrent-pi/internal/utils"
-
-	"github.com/jackpal/bencode-go"
+	"torrent-pi/internal/ratelimit"
+	"torrent-pi/internal/storage"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
@@ -36,22 +33,11 @@ type PeerID [20]byte
 // If length is present then the download represents a single file
 // otherwise it represents a set of files which go in a directory structure.
 
-type Trackers []*url.URL
-
-func (t Trackers) String() []string {
-	strs := make([]string, len(t))
-
-	for _, tracker := range t {
-		strs = append(strs, tracker.String())
-	}
-	return strs
-}
-
 type Torrent struct {
-	PeerID   [20]byte `bencode:"-"`
-	InfoHash [20]byte `bencode:"info_hash"`
-	Name     string   `bencode:"name"`
-	Trackers Trackers `bencode:"announce_list"`
+	PeerID   [20]byte   `bencode:"-"`
+	InfoHash [20]byte   `bencode:"info_hash"`
+	Name     string     `bencode:"name"`
+	Trackers peer.Tiers `bencode:"-"`
 
 	// pieces maps to a string whose length is a multiple of 20.
 	// It is to be subdivided into strings of length 20, each of which is the SHA1 hash of the piece at the corresponding index.
@@ -62,71 +48,199 @@ type Torrent struct {
 
 	// For the purposes of the other keys, the multi-file case is treated as only having a single file
 	// by concatenating the files in the order they appear in the files list.
-	Files       Files            `bencode:"files"`
-	Downloaded  uint64           `bencode:"-"`
-	PeerManager peer.PeerManager `bencode:"-"`
+	Files       Files             `bencode:"files"`
+	Downloaded  uint64            `bencode:"-"` // verified bytes, updated atomically
+	Uploaded    uint64            `bencode:"-"`
+	PeerManager *peer.PeerManager `bencode:"-"`
+
+	// Keys from outside the info dictionary of a .torrent file
+	WebSeeds     []string  `bencode:"-"`
+	CreationDate time.Time `bencode:"-"`
+	Comment      string    `bencode:"-"`
+	CreatedBy    string    `bencode:"-"`
+
+	// The info dictionary, as received
+	InfoBytes []byte `bencode:"-"`
+
+	// Indices of the files to download, from a magnet link's so parameter (BEP 53). Empty for all.
+	SelectedFiles []int `bencode:"-"`
+
+	// BitTorrent v2 (BEP 52). Hybrid torrents have v1 and v2 hashes.
+	// For v2 only torrents, InfoHash is InfoHashV2 truncated to 20 bytes, as used in handshakes and announces.
+	MetaVersion int      `bencode:"-"`
+	InfoHashV2  [32]byte `bencode:"-"`
+	V2Files     []V2File `bencode:"-"`
+	pieceLayers map[[32]byte][][32]byte
+	layersMu    sync.RWMutex
+
+	// Where the pieces are kept. Opened by Download with StorageBackend unless already set,
+	// then put behind a cache of CacheSize bytes.
+	Storage        storage.Storage `bencode:"-"`
+	StorageBackend string          `bencode:"-"`
+	CacheSize      int64           `bencode:"-"`
+	cache          atomic.Pointer[storage.Cache]
+	// How to allocate the files before downloading, see storage.Prepare
+	Preallocation string `bencode:"-"`
+
+	// Called once the download has finished and the files are in place
+	OnComplete func(t *Torrent) `bencode:"-"`
+
+	cfg config.Config
+
+	peersMu    sync.Mutex
+	peers      map[*connectedPeer]bool // we're downloading from
+	downLimit  *ratelimit.Limiter
+	upLimit    *ratelimit.Limiter
+	peerLimits Limits // the limits given to each peer
+
+	dataMu      sync.Mutex
+	dataDir     string
+	completeDir string
+	partSuffix  string
+	movable     *storage.Movable
+
+	stateMu sync.Mutex
+	state   State
+	err     error
+
+	verifiedMu sync.Mutex
+	verified   []bool // by piece, see markVerified
+
+	startOnce sync.Once
 }
 
 const MAX_PORT = 65535
 
-// Construct a Torrent from magnet URL
-func NewTorrentFromMagnet(magnetURL *url.URL) (Torrent, error) {
-	var err error
-
-	var trackerUrls = magnetURL.Query()["tr"]
-	var name = magnetURL.Query().Get("dn")
-	var infoHash_hex = strings.TrimPrefix(magnetURL.Query().Get("xt"), "urn:btih:")
-	infoHash, err := hex.DecodeString(infoHash_hex)
-	// TODO: Validate magnet link & info hash
-
-	// parse trackers
-	trackers := make([]*url.URL, len(trackerUrls))
-	for i, t := range trackerUrls {
-		tracker, err := url.Parse(t)
-		if err != nil {
-			continue
-		}
-		trackers[i] = tracker
-	}
-
-	t := Torrent{
+// newTorrent sets up a torrent and its PeerManager, without contacting the trackers
+func newTorrent(infoHash [20]byte, name string, trackers peer.Tiers) *Torrent {
+	t := &Torrent{
 		Name:        name,
 		Trackers:    trackers,
-		PeerManager: peer.NewPeerManager(infoHash, []byte(constants.PEER_ID), trackers),
+		InfoHash:    infoHash,
+		PeerManager: peer.NewPeerManager(infoHash[:], nil, trackers),
+		downLimit:   ratelimit.New(0, nil),
+		upLimit:     ratelimit.New(0, nil),
+	}
+	t.PeerManager.Stats = t.Stats
+	t.Configure(config.Default())
+	return t
+}
+
+// Configure applies the session's settings. Call it before Start.
+// Torrents outside a session, with no peer ID in cfg, make their own.
+func (t *Torrent) Configure(cfg config.Config) {
+	if cfg.PeerID == "" {
+		id := peer.NewPeerID()
+		cfg.PeerID = string(id[:])
+	}
+	t.cfg = cfg
+	copy(t.PeerID[:], cfg.PeerID)
+	t.PeerManager.PeerID = t.PeerID[:]
+	t.PeerManager.TrackerTimeout = time.Duration(cfg.TrackerTimeout)
+	t.StorageBackend = cfg.StorageBackend
+	t.CacheSize = cfg.CacheSize
+	t.Preallocation = cfg.Preallocation
+	t.SetLimits(Limits{
+		Download:     t.downLimit.Rate(),
+		Upload:       t.upLimit.Rate(),
+		PeerDownload: cfg.PeerDownloadLimit,
+		PeerUpload:   cfg.PeerUploadLimit,
+	})
+}
+
+// clientSettings are how we connect to the torrent's peers
+func (t *Torrent) clientSettings() client.Settings {
+	return client.Settings{
+		Port:             t.cfg.PeerPort,
+		DialTimeout:      time.Duration(t.cfg.DialTimeout),
+		HandshakeTimeout: time.Duration(t.cfg.HandshakeTimeout),
+		BlockedClients:   t.cfg.BlockedClients,
 	}
-	copy(t.PeerID[:], []byte(constants.PEER_ID))
-	copy(t.InfoHash[:], infoHash)
+}
 
-	// TODO Retrieve torrent metadata from the "swarm"... http://www.bittorrent.org/beps/bep_0009.html
+// Start joins the swarm. Only the first call has any effect.
+func (t *Torrent) Start() {
+	t.startOnce.Do(func() {
+		// Start PeerManager which polls/updates trackers at intervals
+		go t.PeerManager.Start(uint16(t.cfg.PeerPort), t.Complete())
+		go t.PeerManager.Scrape()
+	})
+}
 
-	// Start PeerManager which polls/updates trackers at intervals
-	go t.PeerManager.Start(6881)
+// Construct a Torrent from magnet URL
+func NewTorrentFromMagnet(m *magnet.Magnet, cfg config.Config) (*Torrent, error) {
+	t := newTorrent(m.InfoHash, m.Name, magnetTiers(m))
+	t.Configure(cfg)
+	t.InfoHashV2 = m.InfoHashV2
+	t.WebSeeds = m.WebSeeds
+	// Peers from the link itself don't need a tracker
+	t.PeerManager.AddPeers(resolvePeers(m.Peers))
+	t.Start()
 
 	t.PeerManager.WaitReady()
 	fmt.Println("Peers in Torrent module", t.PeerManager.GetPeers())
 
 	// Retrieve file metadata with metadata extension protocol
-	for _, peer := range t.PeerManager.GetPeers() {
-		c, err := client.New(peer, t.PeerID, t.InfoHash)
-		if err != nil {
-			// fmt.Println("Error connecting to peer:", err)
-			continue
-		}
-		defer c.Conn.Close()
+	metadata, err := t.fetchMetadata()
+	if err != nil {
+		t.Stop()
+		return nil, err
+	}
+	if err := t.setInfo(metadata); err != nil {
+		t.Stop()
+		return nil, err
+	}
+	if len(m.SelectOnly) > 0 {
+		t.SelectedFiles = m.SelectOnly.Files(max(len(t.Files), 1))
+	}
+	if m.Length > 0 && t.TotalLength() != uint64(m.Length) {
+		fmt.Printf("Magnet link length %d does not match torrent length %d\n", m.Length, t.TotalLength())
+	}
+	return t, nil
+}
 
-		metadata := c.FetchMetadata()
+/* Torrent Methods */
 
-		r := bytes.NewReader(metadata)
-		bencode.Unmarshal(r, &t)
-		break
+// TotalLength is the size of all the torrent's content in bytes
+func (t *Torrent) TotalLength() uint64 {
+	if len(t.Files) == 0 {
+		return uint64(t.Length)
 	}
-	t.PieceHashes = utils.SplitStringToBytes(t.PieceHashesString, 20)
+	var total uint64
+	for _, file := range t.Files {
+		total += uint64(file.Length)
+	}
+	return total
+}
 
-	return t, err
+// Stats returns the transfer counters reported to trackers
+func (t *Torrent) Stats() peer.TorrentStats {
+	stats := peer.TorrentStats{
+		Downloaded: atomic.LoadUint64(&t.Downloaded),
+		Uploaded:   atomic.LoadUint64(&t.Uploaded),
+	}
+	total := t.TotalLength()
+	if total == 0 {
+		// Size is unknown until we have the metadata, but we are definitely not a seed
+		stats.Left = uint64(constants.BLOCK_SIZE)
+	} else if t.Complete() {
+		stats.Left = 0
+	} else if stats.Downloaded < total {
+		stats.Left = total - stats.Downloaded
+	}
+	return stats
 }
 
-/* Torrent Methods */
-func (t Torrent) Download() {
+// Stop leaves the swarm, letting the trackers know we have gone
+func (t *Torrent) Stop() {
+	t.PeerManager.Stop()
+}
+
+func (t *Torrent) Download() {
+	if len(t.WebSeeds) == 0 {
+		// Nothing to download from until the trackers give us peers
+		t.PeerManager.WaitReady()
+	}
 	fmt.Println("Downloading", t.Name)
 	// 1. connect to Peer
 	// 2. send handshake
@@ -151,6 +265,7 @@ func (t Torrent) Download() {
 	// For now, find the .mp4 file
 
 	var fileToDownload File
+	var fileIndex int
 
 	fmt.Println("##### Files #####")
 	if t.Length > 0 {
@@ -160,10 +275,23 @@ func (t Torrent) Download() {
 		}
 		fmt.Println(fileToDownload.String())
 	}
-	for _, file := range t.Files {
+	for i, file := range t.Files {
+		if file.IsPadding() {
+			continue
+		}
 		fmt.Println(file.String())
+		if len(t.SelectedFiles) > 0 {
+			if i == t.SelectedFiles[0] {
+				fileToDownload = file
+				fileIndex = i
+				fmt.Println("Found selected file to download ", fileToDownload.String())
+				break
+			}
+			continue
+		}
 		if strings.HasSuffix(file.Path[0], "mp4") || strings.HasSuffix(file.Path[0], ".mkv") {
 			fileToDownload = file
+			fileIndex = i
 			fmt.Println("Found media to download ", fileToDownload.String())
 			break
 		}
@@ -171,43 +299,71 @@ func (t Torrent) Download() {
 
 	// Calculate the piece range for a file in a .torrent distribution
 
-	var startByte uint
-
 	// Find file startPiece by summing length of all files with file index smaller than target file
-	for _, file := range t.Files {
-		if file.String() == fileToDownload.String() {
-			break
-		}
-		startByte += uint(file.Length)
-	}
+	startByte := t.fileOffset(fileIndex)
 	startPiece := startByte / t.PieceLength
-	endPiece := (startByte+uint(fileToDownload.Length))/t.PieceLength - 1
+	// One past the file's last piece, which is usually shared with the next file
+	endPiece := (startByte + uint(fileToDownload.Length) + t.PieceLength - 1) / t.PieceLength
 	blockCount := t.PieceLength / constants.BLOCK_SIZE
 
 	fmt.Printf("startPiece: %d, endPiece: %d\n", startPiece, endPiece)
 	connections := make([]client.Client, 0)
-	piecesQueue := make(lib.PriorityQueue, (endPiece - startPiece))
-	i := 0
-	for pieceIndex := startPiece; pieceIndex < endPiece; pieceIndex++ {
-		piecesQueue[i] = &lib.Item{
-			Value:    pieceIndex,
-			Priority: max(int(endPiece-pieceIndex), 1),
-			Index:    i,
-		}
-		i++
-	}
-	heap.Init(&piecesQueue)
+	piecesQueue := newPieceQueue(startPiece, endPiece, t.hasPiece)
 
-	max_connections := 10
+	max_connections := t.cfg.MaxConnections
 	wg := sync.WaitGroup{}
 	wg.Add(1)
-	fileLock := sync.Mutex{}
-	f, err := os.OpenFile("downloads/"+string(fileToDownload.Path[0]), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Println("Error opening file", fileToDownload.Path[0], err)
+	if err := t.openStorage(); err != nil {
+		fmt.Println("Error opening storage for", t.Name, err)
+		return
+	}
+	defer t.closeStorage()
+	cache := t.cache.Load()
+	layout := t.StorageLayout()
+
+	// Make sure there is room for the file before asking anyone for it
+	selected := []int{0}
+	if len(t.Files) > 0 {
+		selected = []int{fileIndex}
+	}
+	if err := storage.Prepare(cache, selected, t.Preallocation); err != nil {
+		fmt.Println("Can't download", t.Name, err)
+		t.setState(ERRORED, err)
+		return
+	}
+	t.setState(DOWNLOADING, nil)
+
+	// fail pauses the download, leaving what we have on disk. Out of disk space is the usual reason.
+	fail := func(err error) {
+		fmt.Printf("Pausing %s: %s\n", t.Name, err)
+		t.setState(ERRORED, err)
+		piecesQueue.Close()
+	}
+	cache.OnError = fail
+
+	// savePiece hands a downloaded piece to the cache, which checks it against the metadata before writing it out.
+	// Whoever fetched the piece puts it back if this fails.
+	savePiece := func(pieceIndex uint, data []byte) error {
+		err := t.savePiece(cache, layout, pieceIndex, data)
+		if err != nil && !errors.Is(err, errCorruptPiece) {
+			fmt.Printf("Error writing piece #%v: %v\n", pieceIndex, err)
+			fail(err)
+		}
+		return err
+	}
+	cache.OnStored = t.markVerified
+
+	// Web seeds download alongside peers
+	for _, seedURL := range t.WebSeeds {
+		wg.Add(1)
+		go func(ws *webSeed) {
+			defer wg.Done()
+			t.downloadFromWebSeed(ws, piecesQueue, savePiece)
+		}(&webSeed{url: seedURL})
 	}
 
 	go func() {
+		defer wg.Done()
 		for len(connections) < max_connections {
 			p := t.PeerManager.GetPeer()
 			if len(p.IP) == 0 {
@@ -217,28 +373,43 @@ func (t Torrent) Download() {
 			fmt.Printf("Peer Connection %s -> starting \n", p.String())
 			defer t.PeerManager.DropPeer(p.IP.String())
 
-			c, err := client.New(p, t.PeerID, t.InfoHash)
+			c, err := client.New(p, t.PeerID, t.InfoHash, t.InfoBytes, t.clientSettings())
 			if err != nil {
 				fmt.Println(err)
+				if errors.Is(err, client.ErrBlockedClient) || errors.Is(err, client.ErrSelfConnect) {
+					t.PeerManager.SetPeerStatus(p.IP.String(), peer.BANNED)
+				}
 				// t.PeerManager.SetPeerStatus(p.IP.String(), peer.BAD)
 				continue
 			}
+			c.PieceLayer = t.clientPieceLayer
+			if t.IsV2Only() && t.needsPieceLayer(t.V2Files[fileIndex]) {
+				if err := t.fetchPieceLayer(c, t.V2Files[fileIndex]); err != nil {
+					fmt.Println("Error fetching piece layer:", err)
+					c.Conn.Close()
+					continue
+				}
+			}
 			// defer c.Conn.Close()
-			if msg, err := c.Read(); err == nil && msg.ID == message.MsgBitfield {
+			if msg, err := c.Read(); err == nil && msg != nil && msg.ID == message.MsgBitfield {
 				c.Bitfield = msg.Payload
 			}
+			connections = append(connections, *c)
+			connected := t.addPeer(c)
 			wg.Add(1)
 			go func(peerIp net.IP) {
 				defer c.Conn.Close()
 				defer wg.Done()
+				defer t.removePeer(connected)
 
-				for !piecesQueue.IsEmpty() {
-					var pieceIndex = heap.Pop(&piecesQueue).(uint)
-
-					if !c.Bitfield.HasPiece(int(pieceIndex)) {
-						fmt.Printf("%v does not have piece #%v\n", peerIp, pieceIndex)
-						heap.Push(&piecesQueue, lib.NewPriorityItem(pieceIndex, max(int(endPiece-pieceIndex), 1)))
-						continue
+				hasPiece := func(pieceIndex uint) bool {
+					return int(pieceIndex)/8 < len(c.Bitfield) && c.Bitfield.HasPiece(int(pieceIndex))
+				}
+				for {
+					pieceIndex, ok := piecesQueue.Pop(hasPiece)
+					if !ok {
+						fmt.Printf("%v has no pieces we need\n", peerIp)
+						return
 					}
 					fmt.Printf("Piece #%d -> %v\n", pieceIndex, peerIp)
 					pieceBuffer := make([]byte, t.PieceLength)
@@ -246,29 +417,22 @@ func (t Torrent) Download() {
 					err := c.DownloadPiece(pieceBuffer, pieceIndex, blockCount)
 					if err != nil {
 						fmt.Printf("Error downloading piece #%v: %v Dropping peer %v\n", pieceIndex, err, peerIp)
-						heap.Push(&piecesQueue, lib.NewPriorityItem(pieceIndex, max(int(endPiece-pieceIndex), 1)))
+						piecesQueue.Push(pieceIndex)
 						return
 					}
 
 					fmt.Printf("Piece #%v downloaded. bytes: %v\n", pieceIndex, len(pieceBuffer))
-
-					// Compare sha1 hash against metadata checksum
-					pieceHash := sha1.Sum(pieceBuffer[:])
-					checkSumMatch := pieceHash == [20]byte(t.PieceHashes[pieceIndex])
-					if !checkSumMatch {
-						fmt.Printf("Checksum Fail! for piece #%v\n", pieceIndex)
-
-						heap.Push(&piecesQueue, lib.NewPriorityItem(pieceIndex, max(int(endPiece-pieceIndex), 1)))
+					atomic.AddUint64(&connected.downloaded, uint64(layout.PieceSize(int(pieceIndex))))
+					if err := savePiece(pieceIndex, pieceBuffer); err != nil {
+						piecesQueue.Push(pieceIndex)
+						if errors.Is(err, errCorruptPiece) {
+							fmt.Printf("Banning %v for sending corrupt piece #%v\n", peerIp, pieceIndex)
+							t.PeerManager.SetPeerStatus(peerIp.String(), peer.BANNED)
+							return
+						}
 						continue
 					}
-					fmt.Printf("Matching Checksums for piece #%v!\n", pieceIndex)
-
-					byteOffset := int64((pieceIndex - startPiece) * t.PieceLength)
-
-					fmt.Printf("Writing piece #%v at byte offset %v\n", pieceIndex, byteOffset)
-					fileLock.Lock()
-					f.WriteAt(pieceBuffer[:], byteOffset)
-					fileLock.Unlock()
+					piecesQueue.Done(pieceIndex)
 				}
 			}(p.IP)
 		}
@@ -279,42 +443,72 @@ func (t Torrent) Download() {
 	fmt.Println("starting timer")
 	start := time.Now()
 	wg.Wait()
+	if err := cache.Flush(); err != nil {
+		fail(err)
+	}
+	if state, err := t.State(); state == ERRORED {
+		fmt.Printf("Download of %s stopped: %s\n", t.Name, err)
+		return
+	}
+	// Every piece of the file has to have been checked, not just handed out
+	if missing := t.missingPieces(startPiece, endPiece); missing > 0 {
+		fmt.Printf("Download of %s stopped with %d pieces remaining\n", t.Name, missing)
+		return
+	}
 	fmt.Printf("Downloaded %s in %s\n", t.Name, time.Since(start))
+	if err := t.finish(); err != nil {
+		fail(err)
+		return
+	}
+	t.setState(COMPLETED, nil)
+	if t.filesOnDisk() {
+		if err := t.completeFiles(t.DataDir(), fileToDownload); err != nil {
+			fmt.Println("Error completing files:", err)
+		}
+	}
+	// Trackers only hear we're done once we have the whole torrent, not just this file
+	if t.Complete() {
+		t.PeerManager.Completed()
+	}
+	if t.OnComplete != nil {
+		t.OnComplete(t)
+	}
 }
 
-func FromMetadata(metadata []byte) (Torrent, error) {
-	var t Torrent
-
-	if err := bencode.Unmarshal(bytes.NewReader(metadata), &t); err != nil {
+// FromMetadata reads the contents of a .torrent file. Call Start to join the swarm.
+func FromMetadata(metadata []byte) (*Torrent, error) {
+	m, err := ParseMetainfo(metadata)
+	if err != nil {
 		fmt.Println("Error decoding metadata:", err)
-		return t, err
+		return nil, err
 	}
 
+	t := newTorrent(m.InfoHash(), "", peer.NewTiers(m.Announce, m.AnnounceList))
+	t.WebSeeds = m.URLList
+	t.CreationDate = m.CreationDate
+	t.Comment = m.Comment
+	t.CreatedBy = m.CreatedBy
+	if err := t.setInfo(m.InfoBytes); err != nil {
+		return nil, err
+	}
+	if err := t.setPieceLayers(m.PieceLayers); err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
-func (t Torrent) WriteMetadataFile(dir string) error {
-	filename := path.Join(dir, t.Name+".torrent")
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+// MetadataFile is the name WriteMetadataFile gives the .torrent file. It's named by ID,
+// since names aren't unique and can't be trusted as file names.
+func (t *Torrent) MetadataFile() string {
+	return t.ID() + ".torrent"
+}
+
+func (t *Torrent) WriteMetadataFile(dir string) error {
+	data, err := t.Metainfo()
 	if err != nil {
 		return err
 	}
-	save := TorrentOut{
-		Info_hash:     t.InfoHash,
-		Announce_list: t.Trackers.String(),
-		Name:          t.Name,
-		Pieces:        t.PieceHashesString,
-		PieceLength:   t.PieceLength,
-	}
-	if len(t.Files) > 0 {
-		for _, file := range t.Files {
-			save.Files = append(save.Files, FileOut(file))
-		}
-	} else {
-		save.Length = t.Length
-	}
-	err = bencode.Marshal(f, save)
-	return err
+	return os.WriteFile(path.Join(dir, t.MetadataFile()), data, 0644)
 }
 
 func (t *Torrent) String() string {
@@ -15,7 +15,7 @@ func TestFromMetadata(t *testing.T) {
 
 	torrent, err := FromMetadata(data)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	if torrent.Name == "" {
 		t.Error("No Torrent name")
@@ -0,0 +1,280 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"time"
+
+	"torrent-pi/internal/client"
+	"torrent-pi/internal/lib"
+	message "torrent-pi/internal/peerMessage"
+	"torrent-pi/internal/storage"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Most hashes a peer will send in one hashes message
+const MAX_HASHES_PER_REQUEST = 512
+
+const HASH_REQUEST_TIMEOUT = 20 * time.Second
+
+// V2File is a file from the file tree of a v2 torrent (BEP 52)
+type V2File struct {
+	Path   []string
+	Length int64
+	// Root of the merkle tree of the file's 16 KiB blocks. Zero for empty files.
+	PiecesRoot [32]byte
+}
+
+// setInfoV2 reads the file tree of a v2 or hybrid info dictionary
+func (t *Torrent) setInfoV2(infoBytes []byte) error {
+	decoded, err := bencode.Decode(bytes.NewReader(infoBytes))
+	if err != nil {
+		return fmt.Errorf("invalid info dictionary: %s", err)
+	}
+	info, _ := decoded.(map[string]interface{})
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid info dictionary: missing file tree")
+	}
+	if t.PieceLength < lib.MERKLE_BLOCK_SIZE || t.PieceLength&(t.PieceLength-1) != 0 {
+		return fmt.Errorf("invalid info dictionary: v2 piece length must be a power of two of at least 16 KiB")
+	}
+
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		return fmt.Errorf("invalid info dictionary: %s", err)
+	}
+	t.MetaVersion = 2
+	t.V2Files = files
+	t.InfoHashV2 = sha256.Sum256(infoBytes)
+
+	if len(t.PieceHashes) == 0 {
+		// v2 only, so take the file list from the file tree
+		t.Files = nil
+		t.Length = 0
+		for _, file := range files {
+			t.Files = append(t.Files, File{Length: int(file.Length), Path: file.Path})
+		}
+	}
+	return nil
+}
+
+// parseFileTree flattens a file tree. Files are dictionaries keyed by "", directories are anything else.
+func parseFileTree(tree map[string]interface{}, dir []string) ([]V2File, error) {
+	// Files are listed in the same order as the bencoded dictionary
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []V2File
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("bad file tree entry %q", name)
+		}
+		// BEP 52 names are single path components, which can't climb out of the torrent
+		if err := storage.ValidPath([]string{name}); err != nil {
+			return nil, fmt.Errorf("bad file tree entry: %w", err)
+		}
+		path := append(append([]string{}, dir...), name)
+
+		leaf, isFile := node[""].(map[string]interface{})
+		if !isFile {
+			subFiles, err := parseFileTree(node, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+			continue
+		}
+
+		file := V2File{Path: path}
+		file.Length, _ = leaf["length"].(int64)
+		root, _ := leaf["pieces root"].(string)
+		if file.Length > 0 {
+			if len(root) != 32 {
+				return nil, fmt.Errorf("file %q has a bad pieces root", name)
+			}
+			copy(file.PiecesRoot[:], root)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// parsePieceLayers reads the "piece layers" of a .torrent file, mapping pieces roots to hashes of each piece
+func parsePieceLayers(v interface{}) (map[[32]byte][][32]byte, error) {
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	layers := map[[32]byte][][32]byte{}
+	for root, hashes := range dict {
+		data, ok := hashes.(string)
+		if len(root) != 32 || !ok || len(data)%32 != 0 {
+			return nil, fmt.Errorf("bad piece layer")
+		}
+		layer := make([][32]byte, len(data)/32)
+		for i := range layer {
+			copy(layer[i][:], data[i*32:])
+		}
+		layers[[32]byte([]byte(root))] = layer
+	}
+	return layers, nil
+}
+
+// IsV2Only is true for v2 torrents without v1 piece hashes. Their pieces never span files.
+func (t *Torrent) IsV2Only() bool {
+	return t.MetaVersion == 2 && len(t.PieceHashes) == 0
+}
+
+// blocksPerPiece is the number of 16 KiB merkle leaves covered by each piece layer hash
+func (t *Torrent) blocksPerPiece() int {
+	return int(t.PieceLength) / lib.MERKLE_BLOCK_SIZE
+}
+
+// filePieces is the number of v2 pieces in a file
+func (t *Torrent) filePieces(file V2File) int {
+	return int((file.Length + int64(t.PieceLength) - 1) / int64(t.PieceLength))
+}
+
+// setPieceLayer stores a file's piece hashes after checking them against its pieces root
+func (t *Torrent) setPieceLayer(file V2File, layer [][32]byte) error {
+	if len(layer) != t.filePieces(file) {
+		return fmt.Errorf("piece layer for %v has %d hashes, expected %d", file.Path, len(layer), t.filePieces(file))
+	}
+	pad := lib.PadHash(lib.Log2(t.blocksPerPiece()))
+	if lib.MerkleRoot(layer, len(layer), pad) != file.PiecesRoot {
+		return fmt.Errorf("piece layer for %v does not match its pieces root", file.Path)
+	}
+
+	t.layersMu.Lock()
+	defer t.layersMu.Unlock()
+	if t.pieceLayers == nil {
+		t.pieceLayers = map[[32]byte][][32]byte{}
+	}
+	t.pieceLayers[file.PiecesRoot] = layer
+	return nil
+}
+
+// setPieceLayers stores the piece layers from a .torrent file. Files no larger than a piece don't have one.
+func (t *Torrent) setPieceLayers(layers map[[32]byte][][32]byte) error {
+	for _, file := range t.V2Files {
+		if file.Length <= int64(t.PieceLength) {
+			continue
+		}
+		layer, ok := layers[file.PiecesRoot]
+		if !ok {
+			return fmt.Errorf("missing piece layer for %v", file.Path)
+		}
+		if err := t.setPieceLayer(file, layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PieceLayer returns the piece hashes of the file with the given pieces root, if we have them
+func (t *Torrent) PieceLayer(root [32]byte) ([][32]byte, bool) {
+	t.layersMu.RLock()
+	defer t.layersMu.RUnlock()
+	layer, ok := t.pieceLayers[root]
+	return layer, ok
+}
+
+// clientPieceLayer lets peer connections answer hash requests for our piece layers
+func (t *Torrent) clientPieceLayer(root [32]byte) ([][32]byte, uint32, bool) {
+	layer, ok := t.PieceLayer(root)
+	return layer, uint32(lib.Log2(t.blocksPerPiece())), ok
+}
+
+// needsPieceLayer is true if we must fetch the file's piece hashes from peers before we can verify its pieces
+func (t *Torrent) needsPieceLayer(file V2File) bool {
+	if !t.IsV2Only() || file.Length <= int64(t.PieceLength) {
+		return false
+	}
+	_, ok := t.PieceLayer(file.PiecesRoot)
+	return !ok
+}
+
+// fetchPieceLayer asks a peer for a file's piece hashes, checking them against its pieces root
+func (t *Torrent) fetchPieceLayer(c *client.Client, file V2File) error {
+	numPieces := t.filePieces(file)
+	baseLayer := uint32(lib.Log2(t.blocksPerPiece()))
+
+	var layer [][32]byte
+	for index := 0; index < numPieces; index += MAX_HASHES_PER_REQUEST {
+		length := lib.NextPowerOfTwo(min(MAX_HASHES_PER_REQUEST, numPieces-index))
+		hashes, err := c.RequestHashes(message.HashRequest{
+			PiecesRoot: file.PiecesRoot,
+			BaseLayer:  baseLayer,
+			Index:      uint32(index),
+			Length:     uint32(length),
+		}, HASH_REQUEST_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		if len(hashes) < length {
+			return fmt.Errorf("peer sent %d hashes, expected %d", len(hashes), length)
+		}
+		layer = append(layer, hashes[:min(length, numPieces-index)]...)
+	}
+	return t.setPieceLayer(file, layer)
+}
+
+// pieceFile finds the v2 file holding a piece, and the piece's index within that file
+func (t *Torrent) pieceFile(pieceIndex int) (V2File, int, bool) {
+	for _, file := range t.V2Files {
+		if pieceIndex < t.filePieces(file) {
+			return file, pieceIndex, true
+		}
+		pieceIndex -= t.filePieces(file)
+	}
+	return V2File{}, 0, false
+}
+
+// VerifyPiece checks a downloaded piece against the v1 piece hashes, or for v2 only torrents the merkle hashes
+func (t *Torrent) VerifyPiece(pieceIndex uint, data []byte) bool {
+	if !t.IsV2Only() {
+		return pieceIndex < uint(len(t.PieceHashes)) && sha1.Sum(data) == [20]byte(t.PieceHashes[pieceIndex])
+	}
+
+	file, index, ok := t.pieceFile(int(pieceIndex))
+	if !ok {
+		return false
+	}
+	leaves := lib.BlockHashes(data)
+	if file.Length <= int64(t.PieceLength) {
+		// The whole file is one piece, so its tree is only as wide as it needs to be
+		return lib.MerkleRoot(leaves, len(leaves), [32]byte{}) == file.PiecesRoot
+	}
+	layer, ok := t.PieceLayer(file.PiecesRoot)
+	return ok && lib.MerkleRoot(leaves, t.blocksPerPiece(), [32]byte{}) == layer[index]
+}
+
+// fileOffset is where a file starts in the torrent's pieces. v2 only torrents start every file on a piece boundary.
+func (t *Torrent) fileOffset(fileIndex int) uint {
+	var offset uint
+	for i := 0; i < fileIndex; i++ {
+		if t.IsV2Only() {
+			offset += uint(t.filePieces(t.V2Files[i])) * t.PieceLength
+		} else {
+			offset += uint(t.Files[i].Length)
+		}
+	}
+	return offset
+}
+
+// matchesInfoHash checks an info dictionary against the info hashes we know, preferring the v2 hash
+func (t *Torrent) matchesInfoHash(infoBytes []byte) bool {
+	if t.InfoHashV2 != [32]byte{} {
+		return sha256.Sum256(infoBytes) == t.InfoHashV2
+	}
+	return sha1.Sum(infoBytes) == t.InfoHash
+}
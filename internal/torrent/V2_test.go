@@ -0,0 +1,132 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"torrent-pi/internal/lib"
+	"torrent-pi/internal/magnet"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// v2Sample builds a v2 only .torrent with a file spanning 3 pieces and a file smaller than a piece
+func v2Sample(t *testing.T) ([]byte, []byte, []byte) {
+	const pieceLength = 32768
+	a := bytes.Repeat([]byte("abcdefg"), 10000)
+	b := []byte("small file")
+
+	var layer [][32]byte
+	var layerBytes []byte
+	for start := 0; start < len(a); start += pieceLength {
+		hash := lib.MerkleRoot(lib.BlockHashes(a[start:min(start+pieceLength, len(a))]), 2, [32]byte{})
+		layer = append(layer, hash)
+		layerBytes = append(layerBytes, hash[:]...)
+	}
+	rootA := lib.MerkleRoot(layer, len(layer), lib.PadHash(1))
+	// The same root as a tree of every block, padded with zero leaves
+	if lib.MerkleRoot(lib.BlockHashes(a), 8, [32]byte{}) != rootA {
+		t.Fatal("piece layer root does not match block tree root")
+	}
+	rootB := sha256.Sum256(b)
+
+	var file bytes.Buffer
+	bencode.Marshal(&file, map[string]interface{}{
+		"announce": "http://a.example.com/announce",
+		"info": map[string]interface{}{
+			"meta version": 2,
+			"name":         "v2",
+			"piece length": pieceLength,
+			"file tree": map[string]interface{}{
+				"a.bin": map[string]interface{}{"": map[string]interface{}{"length": len(a), "pieces root": string(rootA[:])}},
+				"dir": map[string]interface{}{
+					"b.bin": map[string]interface{}{"": map[string]interface{}{"length": len(b), "pieces root": string(rootB[:])}},
+				},
+			},
+		},
+		"piece layers": map[string]interface{}{string(rootA[:]): string(layerBytes)},
+	})
+	return file.Bytes(), a, b
+}
+
+func TestV2Torrent(t *testing.T) {
+	data, a, b := v2Sample(t)
+
+	torrent, err := FromMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !torrent.IsV2Only() || len(torrent.V2Files) != 2 || torrent.V2Files[1].Path[1] != "b.bin" {
+		t.Fatalf("unexpected v2 files %+v", torrent.V2Files)
+	}
+	if torrent.InfoHash != [20]byte(torrent.InfoHashV2[:20]) {
+		t.Error("v2 only torrents should use the truncated v2 info hash")
+	}
+	if torrent.TotalLength() != uint64(len(a)+len(b)) {
+		t.Errorf("unexpected length %d", torrent.TotalLength())
+	}
+
+	// Every file starts on a piece boundary
+	if torrent.fileOffset(1) != 3*torrent.PieceLength {
+		t.Errorf("unexpected file offset %d", torrent.fileOffset(1))
+	}
+	for i := 0; i < 3; i++ {
+		piece := a[i*32768 : min((i+1)*32768, len(a))]
+		if !torrent.VerifyPiece(uint(i), piece) {
+			t.Errorf("piece %d did not verify", i)
+		}
+	}
+	if !torrent.VerifyPiece(3, b) {
+		t.Error("small file did not verify against its pieces root")
+	}
+	if torrent.VerifyPiece(1, a[:32768]) || torrent.VerifyPiece(4, b) {
+		t.Error("bad pieces verified")
+	}
+
+	// Exports keep the piece layers
+	exported, err := torrent.Metainfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := FromMetadata(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.InfoHashV2 != torrent.InfoHashV2 || !loaded.VerifyPiece(2, a[65536:]) {
+		t.Error("exported v2 torrent did not load back")
+	}
+
+	// Magnets use urn:btmh
+	m, err := magnet.Parse(torrent.Magnet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.HasV1 || m.InfoHashV2 != torrent.InfoHashV2 || m.InfoHash != torrent.InfoHash {
+		t.Errorf("unexpected magnet hashes from %s", torrent.Magnet())
+	}
+	if !torrent.matchesInfoHash(torrent.InfoBytes) {
+		t.Error("info dictionary does not match its v2 info hash")
+	}
+}
+
+func TestV2MissingPieceLayers(t *testing.T) {
+	data, _, _ := v2Sample(t)
+	data = bytes.Replace(data, []byte("12:piece layers"), []byte("12:piece_layers"), 1)
+	if _, err := FromMetadata(data); err == nil {
+		t.Error("expected error for missing piece layers")
+	}
+}
+
+func TestV2BadFileNames(t *testing.T) {
+	file := map[string]interface{}{"": map[string]interface{}{"length": 0}}
+	for _, name := range []string{"..", ".", "a/b", `..\b`} {
+		tree := map[string]interface{}{"dir": map[string]interface{}{name: file}}
+		if _, err := parseFileTree(tree, nil); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+	if _, err := parseFileTree(map[string]interface{}{"": file}, nil); err == nil {
+		t.Errorf("expected an empty name to be rejected")
+	}
+}
@@ -0,0 +1,60 @@
+package torrent
+
+// markVerified records a piece which matched its hash and has been stored
+func (t *Torrent) markVerified(piece int) {
+	pieces := t.StorageLayout().Pieces
+	t.verifiedMu.Lock()
+	defer t.verifiedMu.Unlock()
+	if t.verified == nil {
+		t.verified = make([]bool, pieces)
+	}
+	if piece >= 0 && piece < len(t.verified) {
+		t.verified[piece] = true
+	}
+}
+
+// Bitfield has a bit set for each verified piece, the high bit of the first byte being piece 0 (BEP 3)
+func (t *Torrent) Bitfield() []byte {
+	pieces := t.StorageLayout().Pieces
+	bitfield := make([]byte, (pieces+7)/8)
+	for piece := 0; piece < pieces; piece++ {
+		if t.hasPiece(uint(piece)) {
+			bitfield[piece/8] |= 0x80 >> (piece % 8)
+		}
+	}
+	return bitfield
+}
+
+// SetBitfield marks the pieces in a bitfield from Bitfield verified, for a torrent carried on from an earlier run.
+// The data isn't checked again.
+func (t *Torrent) SetBitfield(bitfield []byte) {
+	for piece := 0; piece < len(bitfield)*8; piece++ {
+		if bitfield[piece/8]&(0x80>>(piece%8)) != 0 {
+			t.markVerified(piece)
+		}
+	}
+}
+
+// hasPiece is true once a piece has been verified, by this download or an earlier one
+func (t *Torrent) hasPiece(piece uint) bool {
+	t.verifiedMu.Lock()
+	defer t.verifiedMu.Unlock()
+	return int(piece) < len(t.verified) && t.verified[piece]
+}
+
+// missingPieces counts the pieces from start up to end which haven't been verified
+func (t *Torrent) missingPieces(start uint, end uint) int {
+	missing := 0
+	for piece := start; piece < end; piece++ {
+		if !t.hasPiece(piece) {
+			missing++
+		}
+	}
+	return missing
+}
+
+// Complete is true once every piece of the torrent has been verified, not just the files we chose
+func (t *Torrent) Complete() bool {
+	pieces := t.StorageLayout().Pieces
+	return pieces > 0 && t.missingPieces(0, uint(pieces)) == 0
+}
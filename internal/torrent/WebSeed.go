@@ -0,0 +1,186 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Web seeds back off after an error, doubling each time up to WEBSEED_MAX_BACKOFF
+var WEBSEED_BACKOFF = 5 * time.Second
+
+const WEBSEED_MAX_BACKOFF = 5 * time.Minute
+
+// We stop using a web seed after this many errors in a row
+const MAX_WEBSEED_FAILURES = 6
+
+var webSeedClient = &http.Client{Timeout: 60 * time.Second}
+
+// webSeed is an http server hosting the torrent's files (BEP 19)
+type webSeed struct {
+	url      string
+	failures int // in a row
+}
+
+// fileSpan is a range of bytes within one of the torrent's files
+type fileSpan struct {
+	file   File
+	offset int64
+	length int64
+}
+
+// isSingleFile is true when the torrent's content is one file named after the torrent
+func (t *Torrent) isSingleFile() bool {
+	if t.IsV2Only() {
+		return len(t.V2Files) == 1 && len(t.V2Files[0].Path) == 1
+	}
+	return len(t.Files) == 0
+}
+
+// pieceSpans maps a piece onto the files it covers
+func (t *Torrent) pieceSpans(pieceIndex uint) []fileSpan {
+	pieceLength := int64(t.PieceLength)
+
+	if t.IsV2Only() {
+		// Pieces never cross files
+		for i, file := range t.V2Files {
+			filePieces := uint(t.filePieces(file))
+			if pieceIndex < filePieces {
+				offset := int64(pieceIndex) * pieceLength
+				return []fileSpan{{file: t.Files[i], offset: offset, length: min(pieceLength, file.Length-offset)}}
+			}
+			pieceIndex -= filePieces
+		}
+		return nil
+	}
+
+	files := t.Files
+	if len(files) == 0 {
+		files = Files{{Length: int(t.Length), Path: []string{t.Name}}}
+	}
+	start := int64(pieceIndex) * pieceLength
+	end := min(start+pieceLength, int64(t.TotalLength()))
+	var spans []fileSpan
+	var fileStart int64
+	for _, file := range files {
+		fileEnd := fileStart + int64(file.Length)
+		if start < fileEnd && end > fileStart {
+			offset := max(start, fileStart) - fileStart
+			spans = append(spans, fileSpan{file: file, offset: offset, length: min(end, fileEnd) - fileStart - offset})
+		}
+		fileStart = fileEnd
+	}
+	return spans
+}
+
+// fileURL is where a web seed hosts one of the torrent's files.
+// Multi-file torrents are hosted in a directory named after the torrent.
+func (ws *webSeed) fileURL(t *Torrent, file File) string {
+	if t.isSingleFile() {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(t.Name)
+		}
+		return ws.url
+	}
+
+	fileURL := ws.url
+	if !strings.HasSuffix(fileURL, "/") {
+		fileURL += "/"
+	}
+	fileURL += url.PathEscape(t.Name)
+	for _, part := range file.Path {
+		fileURL += "/" + url.PathEscape(part)
+	}
+	return fileURL
+}
+
+// fetchPiece downloads a piece with a range request for each file it covers
+func (ws *webSeed) fetchPiece(t *Torrent, pieceIndex uint) ([]byte, error) {
+	spans := t.pieceSpans(pieceIndex)
+	if len(spans) == 0 {
+		return nil, fmt.Errorf("no such piece #%d", pieceIndex)
+	}
+
+	piece := make([]byte, 0, t.PieceLength)
+	for _, span := range spans {
+		if span.length == 0 {
+			continue
+		}
+		if span.file.IsPadding() {
+			// Padding files are all zeros, and not hosted by web seeds
+			piece = append(piece, make([]byte, span.length)...)
+			continue
+		}
+		req, err := http.NewRequest(http.MethodGet, ws.fileURL(t, span.file), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", span.offset, span.offset+span.length-1))
+
+		res, err := webSeedClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch res.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// The server ignored the range, so skip to it
+			_, err = io.CopyN(io.Discard, res.Body, span.offset)
+		default:
+			err = fmt.Errorf("web seed %s: %s", ws.url, res.Status)
+		}
+		if err == nil {
+			data := piece[len(piece) : len(piece)+int(span.length)]
+			_, err = io.ReadFull(res.Body, data)
+			piece = piece[:len(piece)+int(span.length)]
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return piece, nil
+}
+
+// backoff is how long to wait after the latest error
+func (ws *webSeed) backoff() time.Duration {
+	backoff := WEBSEED_BACKOFF
+	for i := 1; i < ws.failures && backoff < WEBSEED_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	return min(backoff, WEBSEED_MAX_BACKOFF)
+}
+
+// downloadFromWebSeed takes pieces from the queue until it is empty, or the web seed has failed too often
+// save reports whether the piece was written and matched its hash. A web seed serving corrupt pieces is backed off like any other error.
+func (t *Torrent) downloadFromWebSeed(ws *webSeed, queue *pieceQueue, save func(pieceIndex uint, data []byte) error) {
+	for {
+		pieceIndex, ok := queue.Pop(nil)
+		if !ok {
+			return
+		}
+		fmt.Printf("Piece #%d -> %s\n", pieceIndex, ws.url)
+
+		data, err := ws.fetchPiece(t, pieceIndex)
+		if err == nil {
+			err = save(pieceIndex, data)
+		}
+		if err == nil {
+			ws.failures = 0
+			queue.Done(pieceIndex)
+			continue
+		}
+
+		queue.Push(pieceIndex)
+		ws.failures++
+		fmt.Printf("Web seed %s error: %s\n", ws.url, err)
+		if ws.failures >= MAX_WEBSEED_FAILURES {
+			fmt.Println("Giving up on web seed", ws.url)
+			return
+		}
+		time.Sleep(ws.backoff())
+	}
+}
@@ -0,0 +1,186 @@
+package torrent
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webSeedSample creates a multi-file torrent whose pieces span files, served by an http file server
+func webSeedSample(t *testing.T, handler func(http.Handler) http.Handler) (*Torrent, *httptest.Server) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "release")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "a.bin"), bytes.Repeat([]byte("a"), 20000), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b b.bin"), bytes.Repeat([]byte("b"), 30000), 0644)
+
+	torrent, err := Create(CreateOptions{Path: dir, PieceLength: MIN_PIECE_LENGTH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler(http.FileServer(http.Dir(root))))
+	t.Cleanup(server.Close)
+	return torrent, server
+}
+
+func withShortBackoff(t *testing.T) {
+	backoff := WEBSEED_BACKOFF
+	WEBSEED_BACKOFF = time.Millisecond
+	t.Cleanup(func() { WEBSEED_BACKOFF = backoff })
+}
+
+func TestWebSeedFetchPiece(t *testing.T) {
+	var ranges atomic.Int32
+	torrent, server := webSeedSample(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				ranges.Add(1)
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	ws := &webSeed{url: server.URL}
+
+	if url := ws.fileURL(torrent, torrent.Files[1]); url != server.URL+"/release/sub/b%20b.bin" {
+		t.Errorf("unexpected file url %s", url)
+	}
+	// Piece #1 spans both files
+	if spans := torrent.pieceSpans(1); len(spans) != 2 || spans[0].offset != 16384 || spans[0].length != 3616 || spans[1].length != 12768 {
+		t.Errorf("unexpected spans %+v", spans)
+	}
+	for i := range torrent.PieceHashes {
+		piece, err := ws.fetchPiece(torrent, uint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !torrent.VerifyPiece(uint(i), piece) {
+			t.Errorf("piece #%d did not verify", i)
+		}
+	}
+	if ranges.Load() != 5 {
+		t.Errorf("expected 5 range requests, got %d", ranges.Load())
+	}
+}
+
+func TestWebSeedIgnoringRange(t *testing.T) {
+	torrent, server := webSeedSample(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del("Range")
+			h.ServeHTTP(w, r)
+		})
+	})
+	piece, err := (&webSeed{url: server.URL + "/"}).fetchPiece(torrent, 2)
+	if err != nil || !torrent.VerifyPiece(2, piece) {
+		t.Errorf("piece did not verify: %v", err)
+	}
+}
+
+func TestWebSeedSingleFileURL(t *testing.T) {
+	torrent := &Torrent{Name: "film one.mkv", Length: 10}
+	if url := (&webSeed{url: "http://a/films/"}).fileURL(torrent, File{}); url != "http://a/films/film%20one.mkv" {
+		t.Errorf("unexpected url %s", url)
+	}
+	if url := (&webSeed{url: "http://a/f.mkv"}).fileURL(torrent, File{}); url != "http://a/f.mkv" {
+		t.Errorf("unexpected url %s", url)
+	}
+}
+
+func TestWebSeedBackoff(t *testing.T) {
+	withShortBackoff(t)
+	var requests atomic.Int32
+	torrent, server := webSeedSample(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Fail the first few requests
+			if requests.Add(1) <= 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	queue := newPieceQueue(0, uint(len(torrent.PieceHashes)), nil)
+	mu := sync.Mutex{}
+	saved := map[uint]bool{}
+	save := func(pieceIndex uint, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if saved[pieceIndex] = torrent.VerifyPiece(pieceIndex, data); !saved[pieceIndex] {
+			return errCorruptPiece
+		}
+		return nil
+	}
+	torrent.downloadFromWebSeed(&webSeed{url: server.URL}, queue, save)
+	if queue.Len() != 0 || len(saved) != len(torrent.PieceHashes) {
+		t.Errorf("expected every piece to be saved, got %v", saved)
+	}
+
+	if backoff := (&webSeed{failures: 3}).backoff(); backoff != 4*WEBSEED_BACKOFF {
+		t.Errorf("unexpected backoff %s", backoff)
+	}
+
+	// A web seed which always fails is given up on, leaving its pieces for peers
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	queue = newPieceQueue(0, uint(len(torrent.PieceHashes)), nil)
+	ws := &webSeed{url: failing.URL}
+	torrent.downloadFromWebSeed(ws, queue, save)
+	if ws.failures != MAX_WEBSEED_FAILURES || queue.Len() != len(torrent.PieceHashes) {
+		t.Errorf("expected web seed to give up with every piece queued, failures %d queued %d", ws.failures, queue.Len())
+	}
+}
+
+func TestWebSeedCorruptPiece(t *testing.T) {
+	withShortBackoff(t)
+	// Serves garbage for the first few requests for the last piece
+	var corrupt atomic.Int32
+	corruptPiece := func(limit int32) func(http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") == "bytes=29152-29999" && corrupt.Add(1) <= limit {
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(bytes.Repeat([]byte("x"), 848))
+					return
+				}
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	// The piece is fetched again once the cache finds it corrupt
+	torrent, server := webSeedSample(t, corruptPiece(1))
+	torrent.WebSeeds = []string{server.URL}
+	torrent.SelectedFiles = []int{1}
+	torrent.SetDataDir(t.TempDir())
+	torrent.Download()
+	if state, err := torrent.State(); state != COMPLETED {
+		t.Fatalf("expected completed, got %s %v", state, err)
+	}
+	if corrupt.Load() != 2 {
+		t.Errorf("expected the corrupt piece to be fetched twice, got %d", corrupt.Load())
+	}
+
+	// A web seed which keeps serving it is given up on
+	corrupt.Store(0)
+	torrent, server = webSeedSample(t, corruptPiece(MAX_WEBSEED_FAILURES))
+	torrent.SetDataDir(t.TempDir())
+	if err := torrent.openStorage(); err != nil {
+		t.Fatal(err)
+	}
+	defer torrent.closeStorage()
+	cache, layout := torrent.cache.Load(), torrent.StorageLayout()
+	queue := newPieceQueue(3, 4, nil)
+	ws := &webSeed{url: server.URL}
+	torrent.downloadFromWebSeed(ws, queue, func(pieceIndex uint, data []byte) error {
+		return torrent.savePiece(cache, layout, pieceIndex, data)
+	})
+	if ws.failures != MAX_WEBSEED_FAILURES || queue.Len() != 1 || torrent.hasPiece(3) {
+		t.Errorf("expected web seed to give up on the corrupt piece, failures %d queued %d", ws.failures, queue.Len())
+	}
+}
@@ -11,38 +11,64 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	torrent "torrent-pi/internal/torrent"
+	"torrent-pi/internal/config"
+	"torrent-pi/internal/session"
 )
 
-const PORT int = 8080
-const DOWNLOAD_DIR = "downloads/torrents"
-
+// Usage:
+//
+//	torrent-pi [-config file.json] [-setting value]...   run the server, see config.Parse
+//	torrent-pi add <file>...                              add .torrent files to a running server
+//	torrent-pi create <path>                              build a .torrent file from a file or directory
 func main() {
-	http.HandleFunc("/download", download)
-	fmt.Println("Listening on port:", PORT)
-	log.Fatal(http.ListenAndServe(":"+fmt.Sprint(PORT), nil))
-}
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "add":
+			os.Exit(runAdd(os.Args[2:]))
+		case "create":
+			os.Exit(runCreate(os.Args[2:]))
+		default:
+			fmt.Fprintln(os.Stderr, "unknown command:", os.Args[1])
+			os.Exit(2)
+		}
+	}
 
-func download(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Initiating download")
+	cfg, err := config.Parse(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	t, err := torrent.NewTorrentFromMagnet(r.URL)
-	fmt.Println("Received metadata for torrent: ", t.Name)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
-		return
+	s := session.New(cfg)
+	if err := s.Resume(); err != nil {
+		fmt.Println("Error resuming torrents:", err)
 	}
-	fmt.Printf("Writing .torrent file")
-	t.WriteMetadataFile(DOWNLOAD_DIR)
+	go stopOnSignal(s)
+
+	registerHandlers(s)
+	fmt.Println("Listening on port:", cfg.Port)
+	log.Fatal(http.ListenAndServe(":"+fmt.Sprint(cfg.Port), nil))
+}
 
-	// Download in goroutine (non-blocking)
-	go t.Download()
+// stopOnSignal lets the trackers know we are leaving every swarm before exiting
+func stopOnSignal(s *session.Session) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "Torrent file downloading...")
+	fmt.Println("Stopping torrents...")
+	s.Stop()
+	os.Exit(0)
 }